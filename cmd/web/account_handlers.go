@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// UserData everything we hold about a user
+type UserData struct {
+	Profile       *models.User           `json:"profile"`
+	Invites       []*models.Invite       `json:"invites"`
+	APITokens     []*models.APIToken     `json:"api_tokens"`
+	Reviews       []*models.Review       `json:"reviews"`
+	ReviewEdits   []*models.ReviewEdit   `json:"review_edits"`
+	Comments      []*models.Comment      `json:"comments"`
+	Reports       []*models.ReviewReport `json:"review_reports"`
+	Collection    []*models.Book         `json:"collection"`
+	Requests      []*models.Request      `json:"requests"`
+	Messages      []*models.Message      `json:"messages"`
+	Blocked       []string               `json:"blocked"`
+	Muted         []string               `json:"muted"`
+	Notifications []*models.Notification `json:"notifications"`
+	Downloads     []*models.Download     `json:"downloads"`
+	Exported      time.Time              `json:"exported"`
+}
+
+// CollectUserData gather everything we hold about a user
+func (app *App) CollectUserData(username string) (*UserData, error) {
+
+	var err error
+	data := &UserData{Exported: time.Now().UTC()}
+
+	if data.Profile, err = app.DB.GetUser(username); err != nil {
+		return nil, err
+	}
+	if data.Invites, err = app.DB.GetInvites(username); err != nil {
+		return nil, err
+	}
+	if data.APITokens, err = app.DB.GetAPITokens(username); err != nil {
+		return nil, err
+	}
+	if data.Reviews, err = app.DB.UserReviews(username); err != nil {
+		return nil, err
+	}
+	if data.ReviewEdits, err = app.DB.UserReviewEdits(username); err != nil {
+		return nil, err
+	}
+	if data.Comments, err = app.DB.UserComments(username); err != nil {
+		return nil, err
+	}
+	if data.Reports, err = app.DB.UserReports(username); err != nil {
+		return nil, err
+	}
+	if data.Collection, err = app.DB.GetCollection(username); err != nil {
+		return nil, err
+	}
+	if data.Requests, err = app.DB.UserRequests(username); err != nil {
+		return nil, err
+	}
+	if data.Messages, err = app.DB.UserMessages(username); err != nil {
+		return nil, err
+	}
+	if data.Blocked, err = app.DB.GetFilters(username, models.FilterBlock); err != nil {
+		return nil, err
+	}
+	if data.Muted, err = app.DB.GetFilters(username, models.FilterMute); err != nil {
+		return nil, err
+	}
+	if data.Notifications, err = app.DB.GetNotifications(username, 100000); err != nil {
+		return nil, err
+	}
+	if data.Downloads, err = app.DB.GetDownloads(username); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// ZipUserData bundle user data as json and csv files
+func ZipUserData(data *UserData) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+
+	// Everything in one json file
+	f, err := writer.Create("data.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// A csv file per table
+	tables := map[string][][]string{
+		"reviews.csv":      {{"id", "book", "rating", "review", "hidden", "edited", "created"}},
+		"review_edits.csv": {{"review", "rating", "review", "created"}},
+		"comments.csv":     {{"id", "on", "target", "reply to", "comment", "created"}},
+		"collection.csv":   {{"book", "title", "authors"}},
+		"requests.csv":     {{"id", "title", "author", "isbn", "format", "edition", "language", "notes", "status", "book", "created"}},
+		"messages.csv":     {{"conversation", "sender", "content", "created"}},
+		"downloads.csv":    {{"book", "title", "created"}},
+	}
+	for _, r := range data.Reviews {
+		edited := ""
+		if r.Edited.Valid {
+			edited = r.Edited.Time.Format(time.RFC3339)
+		}
+		tables["reviews.csv"] = append(tables["reviews.csv"], []string{strconv.Itoa(r.ID), r.BookID, strconv.Itoa(r.Rating), r.Review,
+			strconv.FormatBool(r.Hidden), edited, r.Created.Format(time.RFC3339)})
+	}
+	for _, e := range data.ReviewEdits {
+		tables["review_edits.csv"] = append(tables["review_edits.csv"], []string{strconv.Itoa(e.ReviewID), strconv.Itoa(e.Rating), e.Review, e.Created.Format(time.RFC3339)})
+	}
+	for _, c := range data.Comments {
+		tables["comments.csv"] = append(tables["comments.csv"], []string{strconv.Itoa(c.ID), c.Target, c.TargetID, strconv.FormatInt(c.ParentID.Int64, 10), c.Body, c.Created.Format(time.RFC3339)})
+	}
+	for _, b := range data.Collection {
+		tables["collection.csv"] = append(tables["collection.csv"], []string{b.VolumeID, b.Title, b.Authors})
+	}
+	for _, r := range data.Requests {
+		tables["requests.csv"] = append(tables["requests.csv"], []string{strconv.Itoa(r.ID), r.Title, r.Author, r.ISBN, r.Format, r.Edition, r.Language, r.Notes, r.Status, r.BookID, r.Created.Format(time.RFC3339)})
+	}
+	for _, m := range data.Messages {
+		tables["messages.csv"] = append(tables["messages.csv"], []string{strconv.Itoa(m.ConversationID), m.Sender, m.Content, m.Created.Format(time.RFC3339)})
+	}
+	for _, d := range data.Downloads {
+		tables["downloads.csv"] = append(tables["downloads.csv"], []string{d.VolumeID, d.Title, d.Created.Format(time.RFC3339)})
+	}
+
+	for name, rows := range tables {
+		f, err := writer.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		err = csv.NewWriter(f).WriteAll(rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// RunDataExport build a users export and record the outcome
+func (app *App) RunDataExport(id int, username string) {
+
+	// Mark the export failed on any error
+	fail := func(err error) {
+		log.Printf("Data export %d for %s failed: %s", id, username, err.Error())
+		app.DB.FinishDataExport(id, "failed", "")
+	}
+
+	data, err := app.CollectUserData(username)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	archive, err := ZipUserData(data)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	key := fmt.Sprintf("%s-%d.zip", username, id)
+	err = app.UploadBytes(app.ExportBucket, key, archive)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	err = app.DB.FinishDataExport(id, "ready", key)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	log.Printf("Data export %d for %s ready", id, username)
+}
+
+// CreateDataExport start a background export of the current users data
+func (app *App) CreateDataExport(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	id, err := app.DB.InsertDataExport(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Build the export in the background
+	go app.RunDataExport(id, user.Username)
+
+	session.AddFlash("Your data is being gathered, refresh this page in a minute to download it.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+}
+
+// DownloadDataExport send a finished export to its owner
+func (app *App) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested export id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	export, err := app.DB.GetDataExport(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if export == nil || export.Username != user.Username || export.Status != "ready" {
+		app.NotFound(w)
+		return
+	}
+
+	app.ServeFile(w, app.ExportBucket, export.Key, fmt.Sprintf("louieslibrary-%s.zip", user.Username))
+}
+
+// ReauthWindow how recent a single sign-on must be to confirm an account deletion
+const ReauthWindow = 10 * time.Minute
+
+// DeleteAccount remove the current user after confirming their password, or a recent sign in for linked accounts
+func (app *App) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Linked accounts never saw their local password
+	linked, err := app.DB.HasIdentity(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Confirm the password, or a fresh single sign-on, and username
+	confirmed := false
+	message := "Your account was not deleted, check your password and username."
+	if linked {
+		ssoUser, _ := session.Values["sso_user"].(string)
+		ssoAt, _ := session.Values["sso_at"].(int64)
+		confirmed = ssoUser == user.Username && time.Since(time.Unix(ssoAt, 0)) < ReauthWindow
+		message = fmt.Sprintf("Your account was not deleted, sign in again with single sign-on and delete it within %d minutes.", int(ReauthWindow.Minutes()))
+	} else {
+		authenticated, err := app.DB.AuthenticateUser(user.Username, r.PostForm.Get("password"))
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		confirmed = authenticated.ID != 0
+	}
+	if !confirmed || r.PostForm.Get("confirm") != user.Username {
+		session.AddFlash(message, "default")
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+		return
+	}
+
+	// Remove stored files first, the db rows point at them
+	exports, err := app.DB.GetDataExports(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	for _, export := range exports {
+		if export.Key != "" {
+			app.DeleteObject(app.ExportBucket, export.Key)
+		}
+	}
+	current, err := app.DB.GetUser(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if current.Avatar != "" {
+		app.DeleteObject(app.AvatarBucket, current.Avatar)
+	}
+
+	_, err = app.DB.DeleteUser(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Log out
+	session.Values["user"] = &models.User{}
+	delete(session.Values, "louiesjwt")
+	delete(session.Values, "sso_user")
+	delete(session.Values, "sso_at")
+	session.AddFlash("Your account has been deleted.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// roleName allowed characters in a role name
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,29}$`)
+
+// ShowRoles display the role editor
+func (app *App) ShowRoles(w http.ResponseWriter, r *http.Request) {
+
+	// Get the roles
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Get the users to assign roles
+	users, err := app.DB.GetUsers()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.RenderHTML(w, r, "roles.page.html", &HTMLData{
+		Roles:       roles,
+		Users:       users,
+		Permissions: models.Permissions,
+	})
+}
+
+// UpdateRole replace the permissions of a role
+func (app *App) UpdateRole(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Keep only known permissions
+	name := r.PostForm.Get("role")
+	var permissions []string
+	for _, permission := range models.Permissions {
+		if r.PostForm.Get(permission) != "" {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	// Role must exist
+	known, err := app.DB.RoleExists(name)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Stop admins locking themselves out
+	_, user := app.LoggedIn(r)
+	current, err := app.UserRole(user)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if !known {
+		session.AddFlash("Unknown role.", "default")
+	} else if name == current.Name && !containsString(permissions, models.PermManageUsers) {
+		session.AddFlash("You cannot remove user management from your own role.", "default")
+	} else {
+		err = app.DB.SetRolePermissions(name, permissions)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		// Invite quota, negative for unlimited
+		quota, err := strconv.Atoi(r.PostForm.Get("invitequota"))
+		if err != nil {
+			quota = 0
+		}
+		period, err := strconv.Atoi(r.PostForm.Get("inviteperiod"))
+		if err != nil || period < 1 {
+			period = 30
+		}
+		err = app.DB.SetRoleInviteQuota(name, quota, period)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		session.AddFlash("Role "+name+" updated.", "default")
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+}
+
+// CreateRole add a new role with no permissions
+func (app *App) CreateRole(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(r.PostForm.Get("role")))
+	if !roleName.MatchString(name) {
+		session.AddFlash("Role names are lowercase letters, numbers, - and _.", "default")
+	} else {
+		err = app.DB.InsertRole(name)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		session.AddFlash("Role "+name+" created.", "default")
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+}
+
+// AssignRole change the role of a user
+func (app *App) AssignRole(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	role := r.PostForm.Get("role")
+
+	// Role must exist
+	known, err := app.DB.RoleExists(role)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	_, user := app.LoggedIn(r)
+	if !known {
+		session.AddFlash("Unknown role.", "default")
+	} else if username == user.Username {
+		session.AddFlash("You cannot change your own role.", "default")
+	} else {
+		updated, err := app.DB.SetUserRole(username, role)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if updated {
+			session.AddFlash(username+" is now a "+role+".", "default")
+		} else {
+			session.AddFlash("There is no user called "+username+".", "default")
+		}
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/roles", http.StatusSeeOther)
+}
+
+// InviteNode a user and everyone they invited
+type InviteNode struct {
+	Username string
+	Role     string
+	Joined   time.Time
+	Children []*InviteNode
+}
+
+// ShowInviteTree display who invited whom
+func (app *App) ShowInviteTree(w http.ResponseWriter, r *http.Request) {
+
+	// Get the users
+	users, err := app.DB.GetUsers()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Get the used invites
+	invites, err := app.DB.GetAcceptedInvites()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.RenderHTML(w, r, "invites.page.html", &HTMLData{
+		InviteTree: BuildInviteTree(users, invites),
+	})
+}
+
+// BuildInviteTree link users to the users they invited
+func BuildInviteTree(users models.Users, invites models.Invites) []*InviteNode {
+
+	// Node for every user
+	nodes := make(map[string]*InviteNode)
+	for _, user := range users {
+		nodes[user.Username] = &InviteNode{Username: user.Username, Role: user.Role, Joined: user.Created}
+	}
+
+	// Attach invited users to their inviter
+	invited := make(map[string]bool)
+	for _, invite := range invites {
+		parent, ok := nodes[invite.Creator]
+		child, found := nodes[invite.Username.String]
+		if !ok || !found || !invite.Username.Valid || invited[child.Username] || child == parent {
+			continue
+		}
+		parent.Children = append(parent.Children, child)
+		invited[child.Username] = true
+	}
+
+	// Users nobody invited are the roots
+	var roots []*InviteNode
+	for _, user := range users {
+		if !invited[user.Username] {
+			roots = append(roots, nodes[user.Username])
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Joined.Before(roots[j].Joined) })
+
+	return roots
+}
+
+// Descendants list a user and everyone below them in the tree
+func (n *InviteNode) Descendants() []string {
+	names := []string{n.Username}
+	for _, child := range n.Children {
+		names = append(names, child.Descendants()...)
+	}
+	return names
+}
+
+// PruneInvites revoke the unused invites of a user and everyone they invited
+func (app *App) PruneInvites(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Build the tree to find the branch
+	users, err := app.DB.GetUsers()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	invites, err := app.DB.GetAcceptedInvites()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	branch := findInviteNode(BuildInviteTree(users, invites), r.PostForm.Get("username"))
+	if branch == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Revoke the unused invites of the branch
+	count, err := app.DB.RevokeInvitesBy(branch.Descendants())
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.AddFlash(fmt.Sprintf("Revoked %d unused invites below %s.", count, branch.Username), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/invites", http.StatusSeeOther)
+}
+
+// findInviteNode search the tree for a user
+func findInviteNode(nodes []*InviteNode, username string) *InviteNode {
+	for _, node := range nodes {
+		if node.Username == username {
+			return node
+		}
+		if found := findInviteNode(node.Children, username); found != nil {
+			return found
+		}
+	}
+	return nil
+}
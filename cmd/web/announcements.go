@@ -1,22 +1,69 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
 // NewAnnouncement display the new announcement form
 func (app *App) NewAnnouncement(w http.ResponseWriter, r *http.Request) {
+	app.ShowAnnouncementForm(w, r, nil, &forms.NewAnnouncement{Severity: "info"})
+}
+
+// ShowAnnouncementForm display the announcement form with the roles it can target, editing when given an announcement
+func (app *App) ShowAnnouncementForm(w http.ResponseWriter, r *http.Request, announcement *models.Announcement, form *forms.NewAnnouncement) {
+
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
 	app.RenderHTML(w, r, "newannouncement.page.html", &HTMLData{
-		Form: &forms.NewAnnouncement{},
+		Announcement: announcement,
+		Roles:        roles,
+		Form:         form,
 	})
 }
 
+// announcementForm model an announcement on the posted form, keeping only known roles
+func (app *App) announcementForm(r *http.Request, author string) (*forms.NewAnnouncement, error) {
+
+	form := &forms.NewAnnouncement{
+		Author:   author,
+		Content:  r.PostForm.Get("content"),
+		Severity: r.PostForm.Get("severity"),
+		Starts:   r.PostForm.Get("starts"),
+		Ends:     r.PostForm.Get("ends"),
+	}
+
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if containsString(r.PostForm["roles"], role.Name) {
+			form.Roles = append(form.Roles, role.Name)
+		}
+	}
+
+	return form, nil
+}
+
 // CreateAnnouncement set a new announcement
 func (app *App) CreateAnnouncement(w http.ResponseWriter, r *http.Request) {
 
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
 	// Get current user
 	_, user := app.LoggedIn(r)
 
@@ -28,18 +75,17 @@ func (app *App) CreateAnnouncement(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Model the new announcement on the information from the form
-	announcement := &forms.NewAnnouncement{
-		Author:  user.Username,
-		Content: r.PostForm.Get("content"),
+	announcement, err := app.announcementForm(r, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
 	}
 
 	// Validate the new announcement form
-	// if !announcement.Valid() {
-	// 	app.RenderHTML(w, r, "newannouncement.page.html", &HTMLData{Form: announcement})
-	// 	return
-	// }
-
-	log.Printf("New announcement by %s: %s", announcement.Author, announcement.Content)
+	if !announcement.Valid() {
+		app.ShowAnnouncementForm(w, r, nil, announcement)
+		return
+	}
 
 	// Insert the new announcement
 	_, err = app.DB.InsertAnnouncement(announcement)
@@ -48,6 +94,255 @@ func (app *App) CreateAnnouncement(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Direct to home page
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	// Tell everyone now unless it is scheduled for later
+	app.WakeAnnouncements()
+
+	flash := "Your announcement is up."
+	if announcement.StartTime().After(time.Now().UTC()) {
+		flash = fmt.Sprintf("Your announcement will go up %s.", humanDate(announcement.StartTime()))
+	}
+	session.AddFlash(flash, "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+}
+
+// AnnounceDue tell users about announcements that have started, once each
+func (app *App) AnnounceDue() {
+
+	due, err := app.DB.DueAnnouncements()
+	if err != nil {
+		log.Printf("Unable to find due announcements: %s", err.Error())
+		return
+	}
+
+	for _, announcement := range due {
+
+		// Only whoever claims it announces it, so overlapping runs can't announce it twice
+		claimed, err := app.DB.MarkAnnounced(announcement.ID)
+		if err != nil {
+			log.Printf("Unable to mark announcement %d: %s", announcement.ID, err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		app.NotifyAll(models.NotifyAnnouncement, announcement.Author,
+			fmt.Sprintf("New announcement from %s", announcement.Author), "/announcements", announcement.Roles)
+		app.FireWebhook(models.HookAnnouncementPosted, "/announcements", announcement)
+	}
+}
+
+// PublishAnnouncements announce scheduled announcements as they start, checking at least every interval
+func (app *App) PublishAnnouncements(interval time.Duration) {
+	for {
+		app.AnnounceDue()
+		select {
+		case <-app.AnnounceWake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// WakeAnnouncements have the publisher look for due announcements now rather than on its next check
+func (app *App) WakeAnnouncements() {
+	select {
+	case app.AnnounceWake <- struct{}{}:
+	default:
+	}
+}
+
+// requestedAnnouncement load the announcement in the url, writing the error response when there isn't one
+func (app *App) requestedAnnouncement(w http.ResponseWriter, r *http.Request) *models.Announcement {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		app.NotFound(w)
+		return nil
+	}
+
+	announcement, err := app.DB.GetAnnouncement(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return nil
+	}
+	if announcement == nil {
+		app.NotFound(w)
+		return nil
+	}
+
+	return announcement
+}
+
+// EditAnnouncement display the announcement form with the current announcement
+func (app *App) EditAnnouncement(w http.ResponseWriter, r *http.Request) {
+
+	announcement := app.requestedAnnouncement(w, r)
+	if announcement == nil {
+		return
+	}
+
+	form := &forms.NewAnnouncement{
+		Author:   announcement.Author,
+		Content:  announcement.Content,
+		Severity: announcement.Severity,
+		Roles:    announcement.Roles,
+		Starts:   announcement.Starts.Format(forms.AnnouncementTime),
+	}
+	if announcement.Ends.Valid {
+		form.Ends = announcement.Ends.Time.Format(forms.AnnouncementTime)
+	}
+
+	app.ShowAnnouncementForm(w, r, announcement, form)
+}
+
+// UpdateAnnouncement save changes to an announcement
+func (app *App) UpdateAnnouncement(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	announcement := app.requestedAnnouncement(w, r)
+	if announcement == nil {
+		return
+	}
+
+	form, err := app.announcementForm(r, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Validate the announcement form
+	if !form.Valid() {
+		app.ShowAnnouncementForm(w, r, announcement, form)
+		return
+	}
+
+	err = app.DB.UpdateAnnouncement(announcement.ID, form)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Moving the start up can make it due
+	app.WakeAnnouncements()
+
+	session.AddFlash("Announcement saved.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+}
+
+// DeleteAnnouncement remove an announcement for good
+func (app *App) DeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	announcement := app.requestedAnnouncement(w, r)
+	if announcement == nil {
+		return
+	}
+
+	err := app.DB.DeleteAnnouncement(announcement.ID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.AddFlash("Announcement deleted.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/announcements", http.StatusSeeOther)
+}
+
+// DismissAnnouncement hide an announcement banner for the current user
+func (app *App) DismissAnnouncement(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	announcement := app.requestedAnnouncement(w, r)
+	if announcement == nil {
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	err = app.DB.DismissAnnouncement(announcement.ID, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, "")
+		return
+	}
+
+	// Back to the page the banner was on, only ever on this site
+	next := r.PostForm.Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// ShowAnnouncements list past and current announcements, with scheduled ones for those who post them
+func (app *App) ShowAnnouncements(w http.ResponseWriter, r *http.Request) {
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	announcements, err := app.DB.GetAnnouncements(user.Role, app.Can(user, models.PermPostAnnouncement))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, announcements)
+		return
+	}
+
+	app.RenderHTML(w, r, "announcements.page.html", &HTMLData{
+		Announcements: announcements,
+	})
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+	"gopkg.in/guregu/null.v4"
+)
+
+// APITokenPrefix marks a bearer token as a personal access token
+const APITokenPrefix = "llpat_"
+
+// CreateAPIToken generate a personal access token for the current user
+func (app *App) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Keep only known scopes
+	var scopes []string
+	for _, scope := range models.Scopes {
+		if r.PostForm.Get(scope) != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	// Token needs a name and something to do
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" || len(name) > 100 || len(scopes) == 0 {
+		session.AddFlash("A token needs a name and at least one scope.", "default")
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+		return
+	}
+
+	// Optional expiry in days
+	var expires null.Time
+	if days, err := strconv.Atoi(r.PostForm.Get("expires")); err == nil && days > 0 {
+		expires = null.TimeFrom(time.Now().UTC().AddDate(0, 0, days))
+	}
+
+	// Generate token, only the hash is kept
+	secret, err := CreateOpaqueToken()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	token := APITokenPrefix + secret
+
+	_, err = app.DB.InsertAPIToken(user.Username, name, HashToken(token), scopes, expires)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// The token is only ever shown once
+	session.AddFlash(fmt.Sprintf("Your new token %s is %s - copy it now, it will not be shown again.", name, token), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+}
+
+// DeleteAPIToken revoke one of the current users personal access tokens
+func (app *App) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested token id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Remove the token
+	err = app.DB.DeleteAPIToken(id, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gorilla/sessions"
 	"github.com/rssnyder/louieslibrary/pkg/models"
@@ -8,14 +10,28 @@ import (
 
 // App defines the global attributes
 type App struct {
-	HTMLDir      string
-	StaticDir    string
-	BookDir      string
-	YoutubeDir   string
-	DB           *models.DB
-	Storage      *session.Session
-	BookBucket   string
-	BookAPIKey   string
-	Sessions     *sessions.CookieStore
-	SecureString []byte
+	HTMLDir        string
+	StaticDir      string
+	BookDir        string
+	YoutubeDir     string
+	DB             *models.DB
+	Storage        *session.Session
+	BookBucket     string
+	AvatarBucket   string
+	ExportBucket   string
+	BookAPIKey     string
+	Sessions       *sessions.CookieStore
+	JWTKeys        map[string][]byte
+	JWTKeyID       string
+	OIDC           *OIDCProvider
+	Mailer         Mailer
+	MailQueue      chan *QueuedMail
+	Hub            Hub
+	MessageLimit   *RateLimiter
+	UnsubscribeKey []byte
+	WebhookWake    chan struct{}
+	AnnounceWake   chan struct{}
+	BaseURL        string
+	ClaimTimeout   time.Duration
+	StoreRequestIP bool
 }
@@ -11,6 +11,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
 // ShowBook display a single book
@@ -31,24 +32,53 @@ func (app *App) ShowBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get Reviews
-	reviews, err := app.DB.LatestReviews(id, 50)
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Get Reviews, moderators see hidden ones too
+	sort := r.URL.Query().Get("sort")
+	if _, ok := models.ReviewOrders[sort]; !ok {
+		sort = "latest"
+	}
+	reviews, err := app.DB.LatestReviews(id, 50, app.Can(user, models.PermModerateReviews), sort)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
 
-	// Get current user
-	_, user := app.LoggedIn(r)
+	// Mark the ones the user found helpful
+	err = app.MarkHelpful(reviews, id, user)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
 
 	// See if user has collected book
 	book.Collected = app.DB.GetCollectionItem(user.Username, id)
 
+	// Get the discussion
+	thread, err := app.LoadComments(models.CommentOnBook, book.VolumeID, user)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Get conversations to send it to
+	conversations, err := app.DB.GetConversations(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
 	// Render page
 	app.RenderHTML(w, r, "showbook.page.html", &HTMLData{
-		Book:    book,
-		Reviews: reviews,
-		Form:    &forms.NewReview{},
+		Book:          book,
+		Reviews:       reviews,
+		Thread:        thread,
+		Conversations: conversations,
+		Sort:          sort,
+		Reasons:       forms.ReportReasons,
+		Form:          &forms.NewReview{},
 	})
 }
 
@@ -71,14 +101,17 @@ func (app *App) DownloadBook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Perform nessesary actions on book being downloaded
+	_, user := app.LoggedIn(r)
 	app.DB.DownloadBook(book.VolumeID, book.Downloads+1)
+	app.DB.RecordDownload(user.Username, book.VolumeID)
 
-	// Find the book in the library
-	key, err := app.FindObject(app.BookBucket, book.VolumeID)
+	// Find the book in the library, in the users preferred format if we have it
+	keys, err := app.FindObjects(app.BookBucket, book.VolumeID)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
+	key := PreferredObject(keys, user.PreferredFormat)
 
 	// Present book file to user
 	fileType := strings.Split(key, ".")
@@ -90,10 +123,26 @@ func (app *App) DownloadBook(w http.ResponseWriter, r *http.Request) {
 	app.ServeFile(w, app.BookBucket, key, fmt.Sprintf("%s - %s.%s", book.Title, book.Authors, fileType[1]))
 }
 
-// NewBook display the new book form
+// NewBook display the new book form, filled in from a request when uploading for one
 func (app *App) NewBook(w http.ResponseWriter, r *http.Request) {
+
+	form := &forms.NewBook{}
+
+	// Start from the request being filled
+	if id, err := strconv.Atoi(r.URL.Query().Get("request")); err == nil && id > 0 {
+		request, err := app.DB.GetRequest(id)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if request != nil && models.CanTransition(request.Status, models.RequestFulfilled) {
+			form.RequestID = request.ID
+			form.Title = request.Title
+		}
+	}
+
 	app.RenderHTML(w, r, "newbook.page.html", &HTMLData{
-		Form: &forms.NewBook{},
+		Form: form,
 	})
 }
 
@@ -109,6 +158,9 @@ func (app *App) CreateBook(w http.ResponseWriter, r *http.Request) {
 	// Get current user
 	_, user := app.LoggedIn(r)
 
+	// Request this upload fills, if any
+	requestID, _ := strconv.Atoi(r.PostForm.Get("request"))
+
 	// Grab information from books.google if no title given
 	if r.PostForm.Get("title") == "" {
 
@@ -140,6 +192,7 @@ func (app *App) CreateBook(w http.ResponseWriter, r *http.Request) {
 			ISBN10:         fmt.Sprintf("%s %s", bookInfo.Data.IndustryIdentifiers[0].Type, bookInfo.Data.IndustryIdentifiers[0].Identifier),
 			ISBN13:         fmt.Sprintf("%s %s", bookInfo.Data.IndustryIdentifiers[1].Type, bookInfo.Data.IndustryIdentifiers[1].Identifier),
 			ImageLink:      fmt.Sprint(bookInfo.Data.ImageLinks.Small),
+			RequestID:      requestID,
 		}
 
 		// Display the new book form with the retrived data
@@ -164,6 +217,7 @@ func (app *App) CreateBook(w http.ResponseWriter, r *http.Request) {
 		ISBN10:         r.PostForm.Get("isbn10"),
 		ISBN13:         r.PostForm.Get("isbn13"),
 		ImageLink:      r.PostForm.Get("imagelink"),
+		RequestID:      requestID,
 	}
 
 	// Validate the new book form
@@ -204,8 +258,42 @@ func (app *App) CreateBook(w http.ResponseWriter, r *http.Request) {
 		app.ServerError(w, err)
 		return
 	}
+	app.FireBookWebhook(models.HookBookCreated, form.VolumeID)
+
+	// Link the request this was uploaded for
+	flash := "Your book was added successfully!"
+	if form.RequestID > 0 && !app.Can(user, models.PermFillRequest) {
+		flash = fmt.Sprintf("Your book was added, but you aren't allowed to fill request #%d.", form.RequestID)
+	} else if form.RequestID > 0 {
+		err = app.FulfilRequest(form.RequestID, user.Username, form.VolumeID, "Uploaded for this request.")
+		if err == models.ErrRequestTransition || err == models.ErrRequestClaimed || err == models.ErrNoRequest {
+			flash = fmt.Sprintf("Your book was added, but request #%d couldn't be filled: %s", form.RequestID, err.Error())
+		} else if err != nil {
+			app.ServerError(w, err)
+			return
+		} else {
+			flash = fmt.Sprintf("Your book was added and request #%d is filled!", form.RequestID)
+		}
+	}
+
+	// Fill any other requests the book matches exactly
+	filled, candidates, err := app.MatchNewBook(form.VolumeID, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	for _, id := range filled {
+		flash += fmt.Sprintf(" Request #%d matched by isbn and was filled.", id)
+	}
+
+	// Let the uploader confirm the close matches
+	next := fmt.Sprintf("/book/%s", form.VolumeID)
+	if len(candidates) > 0 && app.Can(user, models.PermFillRequest) {
+		flash += " It might also fill these requests."
+		next = fmt.Sprintf("/book/matches/%s", form.VolumeID)
+	}
 
-	session.AddFlash("Your book was added successfully!", "default")
+	session.AddFlash(flash, "default")
 
 	// Save session
 	err = session.Save(r, w)
@@ -215,7 +303,7 @@ func (app *App) CreateBook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Direct to new book page
-	http.Redirect(w, r, fmt.Sprintf("/book/%s", form.VolumeID), http.StatusSeeOther)
+	http.Redirect(w, r, next, http.StatusSeeOther)
 }
 
 // CreateReview build the new review structure and submit
@@ -244,6 +332,10 @@ func (app *App) CreateReview(w http.ResponseWriter, r *http.Request) {
 
 	// Validate the new review form
 	if !form.Valid() {
+		if WantsJSON(r) {
+			JSONResponse(w, http.StatusBadRequest, form.Failures)
+			return
+		}
 
 		session.AddFlash("Unable to submit your review.", "default")
 
@@ -255,35 +347,68 @@ func (app *App) CreateReview(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Send back to book page
-		http.Redirect(w, r, fmt.Sprintf("/book/%s", r.PostForm.Get("bookid")), http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/book/%s", form.BookID), http.StatusSeeOther)
 		return
 	}
 
-	// Insert the new review
-	_, err = app.DB.InsertReview(form.BookID, form.Username, form.Rating, form.Review)
+	// Make sure the book exists
+	book, err := app.DB.GetBook(form.BookID)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
+	if book == nil {
+		app.NotFound(w)
+		return
+	}
 
-	session.AddFlash("Your review was added successfully!", "default")
-
-	// Save session
-	err = session.Save(r, w)
+	// Insert the new review, replacing any earlier one
+	id, replaced, err := app.DB.InsertReview(form.BookID, form.Username, form.Stars(), form.Review)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
 
-	// Send back to book page
-	http.Redirect(w, r, fmt.Sprintf("/book/%s", form.BookID), http.StatusSeeOther)
+	// Let the uploader know their book was reviewed
+	app.Notify(book.Uploader, models.NotifyReview, user.Username,
+		fmt.Sprintf("%s reviewed %s", user.Username, book.Title), fmt.Sprintf("/book/%s", book.VolumeID))
+
+	// New reviews go out to webhooks, edits don't
+	if !replaced {
+		review, err := app.DB.GetReviewByID(id)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		app.FireWebhook(models.HookReviewCreated, fmt.Sprintf("/book/%s", book.VolumeID), review)
+	}
+
+	flash := "Your review was added successfully!"
+	if replaced {
+		flash = "Your review was updated, the earlier version is in its history."
+	}
+
+	app.ReviewChanged(w, r, id, flash, fmt.Sprintf("/book/%s", form.BookID))
 }
 
 // ListAllBooks display a list off all books
 func (app *App) ListAllBooks(w http.ResponseWriter, r *http.Request) {
 
+	// Read the ordering and filters, ignoring anything unusable
+	params := r.URL.Query()
+	query := &models.CatalogQuery{Sort: params.Get("sort"), Limit: 1000}
+	if _, ok := models.CatalogSorts[query.Sort]; !ok {
+		query.Sort = "latest"
+	}
+	if rating, err := strconv.ParseFloat(params.Get("min_rating"), 64); err == nil && rating > 0 && rating <= 5 {
+		query.MinRating = rating
+	}
+	if reviews, err := strconv.Atoi(params.Get("min_reviews")); err == nil && reviews > 0 {
+		query.MinReviews = reviews
+	}
+
 	// Get the books
-	books, err := app.DB.LatestBooks(1000)
+	books, err := app.DB.CatalogBooks(*query)
 	if err != nil {
 		app.ServerError(w, err)
 		return
@@ -291,7 +416,8 @@ func (app *App) ListAllBooks(w http.ResponseWriter, r *http.Request) {
 
 	// Display page with all books
 	app.RenderHTML(w, r, "showbooks.page.html", &HTMLData{
-		Books: books,
+		Books:   books,
+		Catalog: query,
 	})
 }
 
@@ -313,6 +439,13 @@ func (app *App) EditBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check the user may edit this book
+	_, user := app.LoggedIn(r)
+	if !app.CanEditBook(user, book) {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
 	// Model the book
 	form := &forms.NewBook{
 		ID:             book.ID,
@@ -360,6 +493,24 @@ func (app *App) UpdateBook(w http.ResponseWriter, r *http.Request) {
 		ImageLink:      r.PostForm.Get("imagelink"),
 	}
 
+	// Get current book data
+	book, err := app.DB.GetBook(form.VolumeID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if book == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Check the user may edit this book
+	_, user := app.LoggedIn(r)
+	if !app.CanEditBook(user, book) {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
 	// Validate new book form
 	if !form.Valid() {
 		app.RenderHTML(w, r, "newbook.page.html", &HTMLData{Form: form})
@@ -368,6 +519,7 @@ func (app *App) UpdateBook(w http.ResponseWriter, r *http.Request) {
 
 	// Update the book with the new information
 	app.DB.UpdateBook(form)
+	app.FireBookWebhook(models.HookBookUpdated, form.VolumeID)
 
 	// Display the edited book page
 	http.Redirect(w, r, fmt.Sprintf("/book/%s", form.VolumeID), http.StatusSeeOther)
@@ -396,3 +548,55 @@ func (app *App) AddToCollection(w http.ResponseWriter, r *http.Request) {
 	// Display the added books page
 	http.Redirect(w, r, fmt.Sprintf("/book/%s", id), http.StatusSeeOther)
 }
+
+// DeleteBook remove a book from the library
+func (app *App) DeleteBook(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get requested book id
+	vars := mux.Vars(r)
+	id := vars["volumeid"]
+
+	// Get book
+	book, err := app.DB.GetBook(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if book == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Remove the book from the library
+	err = app.DB.DeleteBook(book.VolumeID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Then every stored format, the book is gone even if one is left behind
+	keys, err := app.FindObjects(app.BookBucket, book.VolumeID)
+	if err != nil {
+		log.Printf("Unable to list files of deleted book %s: %s", book.VolumeID, err.Error())
+	}
+	for _, key := range keys {
+		err = app.DeleteObject(app.BookBucket, key)
+		if err != nil {
+			log.Printf("Unable to delete file %s: %s", key, err.Error())
+		}
+	}
+
+	session.AddFlash(fmt.Sprintf("%s was deleted.", book.Title), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/book/all", http.StatusSeeOther)
+}
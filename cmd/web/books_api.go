@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 )
 
@@ -37,6 +38,7 @@ type DataResponse struct {
 	IndustryIdentifiers []ISBNResponse `json:"industryIdentifiers"`
 	Categories          []string       `json:"categories"`
 	ImageLinks          ImageResponse  `json:"imageLinks"`
+	Language            string         `json:"language"`
 }
 
 // RetailResponse structure for retailPrice json field
@@ -82,3 +84,75 @@ func GetBookInfo(volumeID, apiKey string) VolumeResponse {
 	// Return the data from the books.google api
 	return response
 }
+
+// SearchResponse structure for volume search json
+type SearchResponse struct {
+	Items []*VolumeResponse `json:"items"`
+}
+
+// ISBN best isbn for a volume, preferring isbn 13
+func (v *VolumeResponse) ISBN() string {
+	found := ""
+	for _, id := range v.Data.IndustryIdentifiers {
+		if id.Type == "ISBN_13" {
+			return id.Identifier
+		}
+		if id.Type == "ISBN_10" {
+			found = id.Identifier
+		}
+	}
+	return found
+}
+
+// SearchBooks look up volumes on books.google matching a query
+func SearchBooks(query, apiKey string) ([]*VolumeResponse, error) {
+
+	// Make books.google api call
+	target := fmt.Sprintf("https://www.googleapis.com/books/v1/volumes?q=%s&maxResults=10&key=%s", url.QueryEscape(query), apiKey)
+	httpResponse, err := http.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d from books api", httpResponse.StatusCode)
+	}
+
+	// Fill search response with json data from api
+	var response SearchResponse
+	err = json.NewDecoder(httpResponse.Body).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Items, nil
+}
+
+// LookupVolume retrive a single volume from books.google, reporting errors
+func LookupVolume(volumeID, apiKey string) (*VolumeResponse, error) {
+
+	// Make books.google api call
+	target := fmt.Sprintf("https://www.googleapis.com/books/v1/volumes/%s?key=%s", url.PathEscape(volumeID), apiKey)
+	httpResponse, err := http.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d from books api", httpResponse.StatusCode)
+	}
+
+	// Fill volume response with json data from api
+	response := &VolumeResponse{}
+	err = json.NewDecoder(httpResponse.Body).Decode(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
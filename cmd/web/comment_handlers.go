@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/markdown"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+	"gopkg.in/guregu/null.v4"
+)
+
+// CommentThread the comments shown under a book or request
+type CommentThread struct {
+	Target   string
+	TargetID string
+	Comments []*models.Comment
+}
+
+// LoadComments get the comments on a book or request as threads, flagging what the user can change
+func (app *App) LoadComments(target, targetid string, user *models.User) (*CommentThread, error) {
+
+	comments, err := app.DB.GetComments(target, targetid)
+	if err != nil {
+		return nil, err
+	}
+
+	moderator := app.Can(user, models.PermModerateComments)
+
+	// Hang replies off their parents
+	byID := make(map[int64]*models.Comment)
+	for _, c := range comments {
+		byID[int64(c.ID)] = c
+		c.Editable = !c.Deleted && c.Author == user.Username
+		c.Removable = !c.Deleted && (c.Editable || moderator)
+	}
+	thread := &CommentThread{Target: target, TargetID: targetid}
+	for _, c := range comments {
+		if parent, ok := byID[c.ParentID.Int64]; c.ParentID.Valid && ok {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			thread.Comments = append(thread.Comments, c)
+		}
+	}
+
+	return thread, nil
+}
+
+// commentLink the page a comment is shown on
+func commentLink(target, targetid string, id int) string {
+	return fmt.Sprintf("/%s/%s#comment-%d", target, targetid, id)
+}
+
+// NotifyMentions notify users @mentioned in a comment, skipping any already told
+func (app *App) NotifyMentions(author, body, link string, skip []string) {
+	for _, name := range markdown.Mentions(body) {
+		if name == author || containsString(skip, name) {
+			continue
+		}
+		mentioned, err := app.DB.GetUser(name)
+		if err != nil || mentioned.ID == 0 {
+			continue
+		}
+		app.Notify(mentioned.Username, models.NotifyMention, author, fmt.Sprintf("%s mentioned you in a comment", author), link)
+	}
+}
+
+// commentTargetExists check the book or request a comment is for
+func (app *App) commentTargetExists(target, targetid string) (bool, error) {
+	switch target {
+	case models.CommentOnBook:
+		book, err := app.DB.GetBook(targetid)
+		return book != nil, err
+	case models.CommentOnRequest:
+		id, err := strconv.Atoi(targetid)
+		if err != nil {
+			return false, nil
+		}
+		request, err := app.DB.GetRequest(id)
+		return request != nil, err
+	}
+	return false, nil
+}
+
+// CreateComment add a comment or reply to a book or request
+func (app *App) CreateComment(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Model the new comment on the form
+	parentID, _ := strconv.Atoi(r.PostForm.Get("parentid"))
+	form := &forms.NewComment{
+		Target:   r.PostForm.Get("target"),
+		TargetID: r.PostForm.Get("targetid"),
+		ParentID: parentID,
+		Author:   user.Username,
+		Body:     strings.TrimSpace(r.PostForm.Get("body")),
+	}
+	if !form.Valid() {
+		if form.Failures["Target"] != "" || form.Failures["TargetID"] != "" {
+			app.ClientError(w, http.StatusBadRequest)
+			return
+		}
+		session.AddFlash(form.Failures["Body"], "default")
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/%s/%s", form.Target, form.TargetID), http.StatusSeeOther)
+		return
+	}
+
+	// Make sure what we're commenting on exists
+	exists, err := app.commentTargetExists(form.Target, form.TargetID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if !exists {
+		app.NotFound(w)
+		return
+	}
+
+	// Replies must be to a comment in the same thread
+	parent := null.Int{}
+	if form.ParentID > 0 {
+		comment, err := app.DB.GetComment(form.ParentID)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if comment == nil || comment.Target != form.Target || comment.TargetID != form.TargetID {
+			app.ClientError(w, http.StatusBadRequest)
+			return
+		}
+		parent = null.IntFrom(int64(comment.ID))
+	}
+
+	id, err := app.DB.InsertComment(form.Target, form.TargetID, parent, form.Author, form.Body)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Let mentioned users know
+	link := commentLink(form.Target, form.TargetID, id)
+	app.NotifyMentions(user.Username, form.Body, link, nil)
+
+	// Send user back to their comment
+	http.Redirect(w, r, link, http.StatusSeeOther)
+}
+
+// EditComment display the edit form for a users own comment
+func (app *App) EditComment(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested comment id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	comment, err := app.DB.GetComment(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if comment == nil || comment.Deleted {
+		app.NotFound(w)
+		return
+	}
+
+	// Only the author can edit
+	_, user := app.LoggedIn(r)
+	if comment.Author != user.Username {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	app.RenderHTML(w, r, "editcomment.page.html", &HTMLData{
+		Form: &forms.NewComment{
+			ID:       comment.ID,
+			Target:   comment.Target,
+			TargetID: comment.TargetID,
+			Author:   comment.Author,
+			Body:     comment.Body,
+		},
+	})
+}
+
+// UpdateComment save changes to a users own comment
+func (app *App) UpdateComment(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested comment id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	// Parse the post data
+	err = r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	comment, err := app.DB.GetComment(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if comment == nil || comment.Deleted {
+		app.NotFound(w)
+		return
+	}
+
+	// Only the author can edit
+	_, user := app.LoggedIn(r)
+	if comment.Author != user.Username {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	form := &forms.NewComment{
+		ID:       comment.ID,
+		Target:   comment.Target,
+		TargetID: comment.TargetID,
+		Author:   comment.Author,
+		Body:     strings.TrimSpace(r.PostForm.Get("body")),
+	}
+	if !form.Valid() {
+		app.RenderHTML(w, r, "editcomment.page.html", &HTMLData{Form: form})
+		return
+	}
+
+	err = app.DB.UpdateComment(id, form.Body)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Only tell people who weren't mentioned before
+	link := commentLink(comment.Target, comment.TargetID, id)
+	app.NotifyMentions(user.Username, form.Body, link, markdown.Mentions(comment.Body))
+
+	http.Redirect(w, r, link, http.StatusSeeOther)
+}
+
+// DeleteComment remove a comment, for its author or a moderator
+func (app *App) DeleteComment(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get requested comment id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	comment, err := app.DB.GetComment(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if comment == nil {
+		app.NotFound(w)
+		return
+	}
+
+	_, user := app.LoggedIn(r)
+	if comment.Author != user.Username && !app.Can(user, models.PermModerateComments) {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.DeleteComment(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.AddFlash("Comment deleted.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/%s/%s", comment.Target, comment.TargetID), http.StatusSeeOther)
+}
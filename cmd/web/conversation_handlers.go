@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// ShowConversation display any conversation the user is in by its id
+func (app *App) ShowConversation(w http.ResponseWriter, r *http.Request) {
+
+	conversation := app.requestedConversation(w, r)
+	if conversation == nil {
+		return
+	}
+
+	// Direct conversations still reply to the other user
+	reciver := ""
+	if conversation.Direct && len(conversation.Others) > 0 {
+		reciver = conversation.Others[0]
+	}
+
+	app.ShowMessages(w, r, conversation.ID, &forms.NewMessage{Reciver: reciver})
+}
+
+// PostToConversation add a message to a conversation the user is in
+func (app *App) PostToConversation(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	conversation := app.requestedConversation(w, r)
+	if conversation == nil {
+		return
+	}
+
+	// Get sender
+	_, user := app.LoggedIn(r)
+
+	// Model the message, groups have no one reciver so the conversation stands in
+	form := &forms.NewMessage{
+		Sender:  user.Username,
+		Reciver: conversation.Title(),
+		Content: r.PostForm.Get("content"),
+	}
+	if conversation.Direct && len(conversation.Others) > 0 {
+		form.Reciver = conversation.Others[0]
+	}
+	valid := form.Valid()
+	if !conversation.Direct {
+		form.Reciver = ""
+	}
+	if valid && !app.MessageLimit.Allow(user.Username) {
+		form.Failures["Content"] = "You are sending messages too quickly, try again in a minute"
+		form.Limited = true
+		valid = false
+	}
+
+	var message *models.Message
+	if valid {
+		message, err = app.PostMessage(conversation.ID, user.Username, form.Content, nil)
+		if err == models.ErrBlocked {
+			form.Failures["Content"] = "You can't message this user"
+			valid = false
+		} else if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+	if !valid {
+		app.MessageFailed(w, r, conversation.ID, form)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusCreated, message)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/c/%d", conversation.ID), http.StatusSeeOther)
+}
+
+// NewGroup display the form for starting a group conversation
+func (app *App) NewGroup(w http.ResponseWriter, r *http.Request) {
+	app.RenderHTML(w, r, "newgroup.page.html", &HTMLData{
+		Form: &forms.NewGroup{},
+	})
+}
+
+// CreateGroup start a group conversation with the members asked for
+func (app *App) CreateGroup(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Model the group based on html form
+	form := &forms.NewGroup{
+		Name:    r.PostForm.Get("name"),
+		Creator: user.Username,
+		Members: r.PostForm.Get("members"),
+	}
+
+	// Everyone has to exist
+	valid := form.Valid()
+	members := form.Usernames()
+	for _, username := range members {
+		member, err := app.DB.GetUser(username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if member.ID == 0 {
+			form.Failures["Members"] = fmt.Sprintf("There is no user called %s", username)
+			valid = false
+		}
+	}
+	if !valid {
+		if WantsJSON(r) {
+			JSONResponse(w, http.StatusBadRequest, form.Failures)
+			return
+		}
+		app.RenderHTML(w, r, "newgroup.page.html", &HTMLData{Form: form})
+		return
+	}
+
+	id, err := app.DB.CreateGroup(form.Name, user.Username, members)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		conversation, err := app.DB.GetConversation(id, user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		JSONResponse(w, http.StatusCreated, conversation)
+		return
+	}
+
+	session.AddFlash(fmt.Sprintf("Started %s.", form.Name), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/c/%d", id), http.StatusSeeOther)
+}
+
+// AddParticipant bring another user into a group conversation
+func (app *App) AddParticipant(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	conversation := app.requestedConversation(w, r)
+	if conversation == nil {
+		return
+	}
+	if conversation.Direct {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Only real users can join
+	member, err := app.DB.GetUser(r.PostForm.Get("username"))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if member.ID == 0 {
+		app.ConversationChanged(w, r, conversation.ID, "There is no user by that name.")
+		return
+	}
+
+	err = app.DB.AddParticipant(conversation.ID, member.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.ConversationChanged(w, r, conversation.ID, fmt.Sprintf("%s was added.", member.Username))
+}
+
+// RemoveParticipant take a user out of a group conversation, anyone can leave and the creator can remove others
+func (app *App) RemoveParticipant(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	conversation := app.requestedConversation(w, r)
+	if conversation == nil {
+		return
+	}
+	if conversation.Direct {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	username := r.PostForm.Get("username")
+	if username == "" {
+		username = user.Username
+	}
+	if username != user.Username && conversation.CreatedBy != user.Username {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.RemoveParticipant(conversation.ID, username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Leavers go back to their own conversation list
+	if username == user.Username {
+		if WantsJSON(r) {
+			JSONResponse(w, http.StatusOK, "")
+			return
+		}
+
+		// Load session
+		session, _ := app.Sessions.Get(r, "session-name")
+
+		session.AddFlash(fmt.Sprintf("You left %s.", conversation.Title()), "default")
+
+		// Save session
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/messages/%s", user.Username), http.StatusSeeOther)
+		return
+	}
+
+	app.ConversationChanged(w, r, conversation.ID, fmt.Sprintf("%s was removed.", username))
+}
+
+// ConversationChanged answer a change to a conversation, with it as json for api clients or a flash and redirect
+func (app *App) ConversationChanged(w http.ResponseWriter, r *http.Request, id int, flash string) {
+
+	if WantsJSON(r) {
+		_, user := app.LoggedIn(r)
+		conversation, err := app.DB.GetConversation(id, user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		JSONResponse(w, http.StatusOK, conversation)
+		return
+	}
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	session.AddFlash(flash, "default")
+
+	// Save session
+	err := session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/c/%d", id), http.StatusSeeOther)
+}
+
+// ShareForm what the send to form needs to share a book or request
+type ShareForm struct {
+	Type          string
+	ID            string
+	Conversations []*models.Conversation
+}
+
+// ShareToConversation send a book or request as a message, to an existing conversation or directly to a user
+func (app *App) ShareToConversation(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get sender
+	_, user := app.LoggedIn(r)
+
+	// Make sure there is something to share
+	attachment, err := app.DB.GetAttachment(r.PostForm.Get("type"), r.PostForm.Get("id"))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if attachment == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Pick the conversation, a username starts or continues a direct one
+	id, _ := strconv.Atoi(r.PostForm.Get("conversation"))
+	if to := strings.TrimPrefix(strings.TrimSpace(r.PostForm.Get("to")), "@"); to != "" {
+		reciver, err := app.DB.GetUser(to)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if reciver.ID == 0 {
+			app.ShareFailed(w, r, attachment, fmt.Sprintf("There is no user called %s.", to))
+			return
+		}
+		if reciver.Username == user.Username {
+			app.ShareFailed(w, r, attachment, "You can't share with yourself.")
+			return
+		}
+		id, err = app.DB.DirectConversation(user.Username, reciver.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+	conversation, err := app.DB.GetConversation(id, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if conversation == nil {
+		app.ShareFailed(w, r, attachment, "Pick a conversation or a user to send to.")
+		return
+	}
+
+	// Notes with a share are optional but still have a limit
+	content := r.PostForm.Get("content")
+	if utf8.RuneCountInString(content) > forms.MessageLimit {
+		app.ShareFailed(w, r, attachment, fmt.Sprintf("Message cannot be longer than %d characters.", forms.MessageLimit))
+		return
+	}
+	if !app.MessageLimit.Allow(user.Username) {
+		app.ShareFailed(w, r, attachment, "You are sending messages too quickly, try again in a minute.")
+		return
+	}
+
+	message, err := app.PostMessage(conversation.ID, user.Username, content, attachment)
+	if err == models.ErrBlocked {
+		app.ShareFailed(w, r, attachment, "You can't message this user.")
+		return
+	} else if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusCreated, message)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/c/%d", conversation.ID), http.StatusSeeOther)
+}
+
+// ShareFailed send the user back to what they tried to share with the reason it didn't go
+func (app *App) ShareFailed(w http.ResponseWriter, r *http.Request, attachment *models.Attachment, flash string) {
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusBadRequest, map[string]string{"To": flash})
+		return
+	}
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	session.AddFlash(flash, "default")
+
+	// Save session
+	err := session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/%s/%s", attachment.Type, attachment.ID), http.StatusSeeOther)
+}
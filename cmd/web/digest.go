@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// digestBooks the most new books listed in a digest
+const digestBooks = 20
+
+// UnsubscribeToken sign a username so the link in an email can turn its mail off without logging in
+func (app *App) UnsubscribeToken(username string) string {
+	mac := hmac.New(sha256.New, app.UnsubscribeKey)
+	mac.Write([]byte("unsubscribe:" + username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// unsubscribeFooter the end of every notification email
+func (app *App) unsubscribeFooter(username string) string {
+	return fmt.Sprintf("--\nChange how often you get these: %s\nUnsubscribe: %s\n",
+		app.Link("/notifications"),
+		app.Link("/unsubscribe?user=%s&token=%s", url.QueryEscape(username), app.UnsubscribeToken(username)))
+}
+
+// EmailNotification email a notification straight away to users who asked for that
+func (app *App) EmailNotification(username, text, link string) {
+
+	preference, err := app.DB.GetEmailPreference(username)
+	if err != nil {
+		log.Printf("Unable to get email preference for %s: %s", username, err.Error())
+		return
+	}
+	if preference == nil || preference.Frequency != models.EmailImmediate || !preference.EmailVerified || preference.Email == "" {
+		return
+	}
+
+	body := fmt.Sprintf("%s\n%s\n\n%s", text, app.Link("%s", link), app.unsubscribeFooter(username))
+	app.SendMail(preference.Email, text, body)
+}
+
+// SendDigests periodically email the daily and weekly digests that are due
+func (app *App) SendDigests(interval time.Duration) {
+	for {
+		due, err := app.DB.DueDigests()
+		if err != nil {
+			log.Printf("Unable to find due digests: %s", err.Error())
+		}
+		for _, preference := range due {
+			err = app.SendDigest(preference)
+			if err != nil {
+				log.Printf("Unable to send digest to %s: %s", preference.Username, err.Error())
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// SendDigest email a user what happened since their last digest or visit, skipping it when there is nothing new
+func (app *App) SendDigest(preference *models.EmailPreference) error {
+
+	body, err := app.BuildDigest(preference.Username, preference.Since)
+	if err != nil {
+		return err
+	}
+
+	if body != "" {
+		subject := "Your daily library digest"
+		if preference.Frequency == models.EmailWeekly {
+			subject = "Your weekly library digest"
+		}
+		err = app.Mailer.Send(preference.Email, subject, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.DB.MarkDigestSent(preference.Username)
+}
+
+// BuildDigest write out the digest for a user, empty when nothing happened since
+func (app *App) BuildDigest(username string, since time.Time) (string, error) {
+
+	var sections []string
+
+	// New books
+	books, err := app.DB.LatestBooks(digestBooks)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, book := range books {
+		if !book.Created.After(since) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("- %s by %s\n  %s", book.Title, book.Authors, app.Link("/book/%s", book.VolumeID)))
+	}
+	if len(lines) > 0 {
+		sections = append(sections, "New books:\n"+strings.Join(lines, "\n"))
+	}
+
+	// Filled requests the user hasn't seen yet
+	notifications, err := app.DB.GetNotifications(username, notificationPageSize)
+	if err != nil {
+		return "", err
+	}
+	lines = nil
+	for _, n := range notifications {
+		if n.Read || n.Type != models.NotifyRequestFilled || !n.Created.After(since) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("- %s\n  %s", n.Text, app.Link("%s", n.Link)))
+	}
+	if len(lines) > 0 {
+		sections = append(sections, "Your requests:\n"+strings.Join(lines, "\n"))
+	}
+
+	// Unread messages
+	unread, err := app.DB.CountUnread(username)
+	if err != nil {
+		return "", err
+	}
+	if unread > 0 {
+		sections = append(sections, fmt.Sprintf("You have %d unread messages: %s", unread, app.Link("/messages/%s", username)))
+	}
+
+	// Nothing new, nothing to send
+	if len(sections) == 0 {
+		return "", nil
+	}
+
+	// Current announcements go along with anything else
+	user, err := app.DB.GetUser(username)
+	if err != nil {
+		return "", err
+	}
+	announcements, err := app.DB.ActiveAnnouncements(username, user.Role)
+	if err != nil {
+		return "", err
+	}
+	for _, announcement := range announcements {
+		sections = append(sections, fmt.Sprintf("Announcement from %s:\n%s", announcement.Author, announcement.Content))
+	}
+
+	return fmt.Sprintf("Here's what's new since %s.\n\n%s\n\n%s",
+		humanDate(since), strings.Join(sections, "\n\n"), app.unsubscribeFooter(username)), nil
+}
+
+// UpdateEmailFrequency change how often the user is emailed
+func (app *App) UpdateEmailFrequency(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	frequency := r.PostForm.Get("frequency")
+	if !containsString(models.EmailFrequencies, frequency) {
+		if WantsJSON(r) {
+			JSONResponse(w, http.StatusBadRequest, map[string]string{"Frequency": "Pick one of off, immediate, daily or weekly"})
+			return
+		}
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.SetEmailFrequency(user.Username, frequency)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, map[string]string{"frequency": frequency})
+		return
+	}
+
+	session.AddFlash("Email preferences saved.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// Unsubscribe ask to confirm turning off all email for the user in a signed link, no login needed
+func (app *App) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	app.RenderHTML(w, r, "unsubscribe.page.html", &HTMLData{
+		Form: r.URL.Query(),
+	})
+}
+
+// ConfirmUnsubscribe turn off all email for the user in a signed link, posted from the
+// confirmation page or by a mail client doing a one-click unsubscribe
+func (app *App) ConfirmUnsubscribe(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data, one-click unsubscribes keep the user and token in the url
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	username := r.Form.Get("user")
+	token := r.Form.Get("token")
+
+	if username == "" || !hmac.Equal([]byte(token), []byte(app.UnsubscribeToken(username))) {
+		session.AddFlash("That unsubscribe link is invalid.", "default")
+	} else {
+		err = app.DB.SetEmailFrequency(username, models.EmailOff)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		session.AddFlash("You won't get any more emails about notifications.", "default")
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"net/http"
 )
 
@@ -28,21 +27,7 @@ func (app *App) Home(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get announcements, if any
-	announcement, err := app.DB.GetAnnouncement()
-	if err != nil {
-		log.Printf("Unable to get announcements: %s", err.Error())
-	} else {
-		// Display home page with books and requests + announcements
-		app.RenderHTML(w, r, "home.page.html", &HTMLData{
-			Requests:     requests,
-			Books:        books,
-			Announcement: announcement,
-		})
-		return
-	}
-
-	// Display home page with books and requests
+	// Display home page with books and requests, announcements show on every page
 	app.RenderHTML(w, r, "home.page.html", &HTMLData{
 		Requests: requests,
 		Books:    books,
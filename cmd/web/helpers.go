@@ -2,19 +2,37 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
+// contextKey keys for values stored on a request context
+type contextKey string
+
+const (
+	contextKeyUser     contextKey = "user"
+	contextKeyAPIToken contextKey = "apitoken"
+	contextKeyScope    contextKey = "scope"
+)
+
 // LoggedIn get logged in status
 func (app *App) LoggedIn(r *http.Request) (bool, *models.User) {
 
+	// Users authenticated by a token are stored on the request
+	if user, ok := r.Context().Value(contextKeyUser).(*models.User); ok && user.ID != 0 {
+		return true, user
+	}
+
 	// Empty user struct
 	var user = &models.User{}
 
@@ -40,8 +58,117 @@ func (app *App) LoggedIn(r *http.Request) (bool, *models.User) {
 		return false, &models.User{}
 	}
 
+	// The account may have been deleted, or its name taken again, since the session started
+	current, err := app.DB.GetUser(user.Username)
+	if err != nil {
+		log.Printf("Unable to get user %s: %s", user.Username, err.Error())
+		return false, &models.User{}
+	}
+	if current.ID != user.ID {
+		return false, &models.User{}
+	}
+
 	// User is logged in
-	return true, user
+	return true, current
+}
+
+// Authenticate find the user behind a session, jwt or api token
+func (app *App) Authenticate(r *http.Request) (*http.Request, bool) {
+
+	// WebUI
+	if loggedIn, _ := app.LoggedIn(r); loggedIn {
+		return r, true
+	}
+
+	// Get token from header
+	token := GetTokenHeader(r)
+	if token == "" {
+		return r, false
+	}
+
+	// Personal access tokens
+	if strings.HasPrefix(token, APITokenPrefix) {
+		apiToken, err := app.DB.GetAPIToken(HashToken(token))
+		if err != nil || apiToken == nil {
+			return r, false
+		}
+
+		// Check expiry
+		if apiToken.Expires.Valid && apiToken.Expires.Time.Before(time.Now().UTC()) {
+			return r, false
+		}
+
+		// Tokens are only accepted where a route allows a scope they hold
+		scope, _ := r.Context().Value(contextKeyScope).(string)
+		if scope == "" || !apiToken.HasScope(scope) {
+			return r, false
+		}
+
+		user, err := app.DB.GetUser(apiToken.Username)
+		if err != nil || user.ID == 0 {
+			return r, false
+		}
+
+		// Last use is informational, don't fail the request over it
+		err = app.DB.TouchAPIToken(apiToken.ID)
+		if err != nil {
+			log.Printf("Unable to record use of api token %d: %s", apiToken.ID, err.Error())
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyUser, user)
+		ctx = context.WithValue(ctx, contextKeyAPIToken, apiToken)
+		return r.WithContext(ctx), true
+	}
+
+	// Try for a jwt
+	claims, err := app.VerifyJWT(token)
+	if err != nil {
+		return r, false
+	}
+
+	user, err := app.DB.GetUser(claims.Username)
+	if err != nil || user.ID == 0 {
+		return r, false
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), contextKeyUser, user)), true
+}
+
+// Can check if the role of a user grants a permission
+func (app *App) Can(user *models.User, permission string) bool {
+
+	// Anonymous users can do nothing
+	if user.ID == 0 {
+		return false
+	}
+
+	role, err := app.UserRole(user)
+	if err != nil {
+		log.Printf("Unable to get role of %s: %s", user.Username, err.Error())
+		return false
+	}
+
+	return role.Has(permission)
+}
+
+// UserRole load the current role of a user, the session may hold one that has since changed
+func (app *App) UserRole(user *models.User) (*models.Role, error) {
+
+	current, err := app.DB.GetUser(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Missing users get the empty role
+	return app.DB.GetRole(current.Role)
+}
+
+// CanEditBook check if a user may change a books metadata
+func (app *App) CanEditBook(user *models.User, book *models.Book) bool {
+	if app.Can(user, models.PermEditAnyBook) {
+		return true
+	}
+	return book.Uploader == user.Username && app.Can(user, models.PermEditOwnBook)
 }
 
 // ZipDirectory compress a directory on the disk
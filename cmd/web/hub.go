@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// Event something pushed to a users open pages
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// Event types
+const (
+	EventMessage = "message"
+	EventTyping  = "typing"
+	EventUnread  = "unread"
+	EventRead    = "read"
+	EventNotify  = "notification"
+)
+
+// TypingEvent tells a user someone is writing in one of their conversations
+type TypingEvent struct {
+	Conversation int    `json:"conversation"`
+	From         string `json:"from"`
+}
+
+// ReadEvent a read receipt, the participant has read the conversation up to the message
+type ReadEvent struct {
+	Conversation int    `json:"conversation"`
+	Username     string `json:"username"`
+	Message      int    `json:"message"`
+}
+
+// NotifyEvent a new notification and how many the user now has unread
+type NotifyEvent struct {
+	Notification *models.Notification `json:"notification"`
+	Unread       int                  `json:"unread"`
+}
+
+// UnreadEvent the number of messages a user has not read
+type UnreadEvent struct {
+	Count int `json:"count"`
+}
+
+// Hub fans events out to the connections of each user. The in-process hub only reaches clients
+// connected to this instance, one backed by Postgres LISTEN/NOTIFY can stand in when there are more.
+type Hub interface {
+	Subscribe(username string) (<-chan Event, func())
+	Publish(username string, event Event)
+}
+
+// eventBuffer how many events a slow connection can fall behind before it misses some
+const eventBuffer = 16
+
+// MemoryHub a hub for a single instance
+type MemoryHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+// NewMemoryHub create an empty in-process hub
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{subscribers: map[string]map[chan Event]struct{}{}}
+}
+
+// Subscribe listen for a users events until the returned func is called
+func (h *MemoryHub) Subscribe(username string) (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[username] == nil {
+		h.subscribers[username] = map[chan Event]struct{}{}
+	}
+	h.subscribers[username][ch] = struct{}{}
+	h.mu.Unlock()
+
+	// Drop the connection and tidy up after the last one
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[username][ch]; !ok {
+			return
+		}
+		delete(h.subscribers[username], ch)
+		if len(h.subscribers[username]) == 0 {
+			delete(h.subscribers, username)
+		}
+		close(ch)
+	}
+
+	return ch, cancel
+}
+
+// Publish send an event to every connection of a user, skipping any that are full
+func (h *MemoryHub) Publish(username string, event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[username] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	// "archive/zip"
-	// "crypto/rand"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	// "fmt"
-	// "io/ioutil"
-	"net/http"
-	// "os"
 	"log"
+	"net/http"
 	"strings"
 	"time"
 
@@ -19,6 +17,12 @@ import (
 	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
+// Lifetimes of issued tokens
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
 type TokenInfo struct {
 	Valid    bool  `json:"valid"`
 	TimeLeft int64 `json:"time_left"`
@@ -32,7 +36,55 @@ type CustomClaims struct {
 
 // UserToken is the return structure for a requested jwt
 type UserToken struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// ParseSigningKeys read a list of kid=secret pairs into a key set
+func ParseSigningKeys(keys, fallback string) (map[string][]byte, string) {
+
+	// Key set and the id of the key used for signing
+	keySet := make(map[string][]byte)
+	var active string
+
+	for _, pair := range strings.Split(keys, ",") {
+		split := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(split) != 2 || split[0] == "" || split[1] == "" {
+			continue
+		}
+
+		// First key listed signs new tokens
+		if active == "" {
+			active = split[0]
+		}
+		keySet[split[0]] = []byte(split[1])
+	}
+
+	// Fall back to the single legacy key
+	if active == "" {
+		active = "default"
+		keySet[active] = []byte(fallback)
+	}
+
+	return keySet, active
+}
+
+// HashToken hash an opaque token for storage
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateOpaqueToken generate a random url safe token
+func CreateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.New("Unable to generate token")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // SignJWT Return a signed JWT for a user
@@ -40,61 +92,126 @@ func (app *App) SignJWT(username, role string) (UserToken, error) {
 
 	var returnToken UserToken
 
+	// Unique id so the token can be revoked
+	jti, err := CreateUUID()
+	if err != nil {
+		return returnToken, err
+	}
+
 	// Create claims for user
+	now := time.Now().UTC()
 	claims := CustomClaims{
 		Username: username,
 		Role:     role,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().UTC().Unix() + 86400,
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
 			Issuer:    "louieslibrary",
 		},
 	}
 
-	// Generate token
+	// Generate token, tagged with the signing key
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = app.JWTKeyID
 
 	// Sign token
-	signedToken, err := token.SignedString(app.SecureString)
+	signedToken, err := token.SignedString(app.JWTKeys[app.JWTKeyID])
 	if err != nil {
 		return returnToken, err
 	}
 
 	returnToken.Token = signedToken
+	returnToken.ExpiresIn = int64(AccessTokenTTL.Seconds())
 
 	return returnToken, nil
 }
 
-// VerifyJWT Verify a JWT of a user
-func (app *App) VerifyJWT(userJwt string) (string, string, int64, error) {
+// IssueTokens return a signed JWT along with a new refresh token
+func (app *App) IssueTokens(username, role string) (UserToken, error) {
+
+	// Create refresh token
+	refresh, err := CreateOpaqueToken()
+	if err != nil {
+		return UserToken{}, err
+	}
+
+	return app.issueTokenPair(username, role, refresh)
+}
+
+// issueTokenPair sign a JWT and store the given refresh token, only the hash is kept
+func (app *App) issueTokenPair(username, role, refresh string) (UserToken, error) {
 
-	var username, role string
+	// Get signed JWT
+	token, err := app.SignJWT(username, role)
+	if err != nil {
+		return token, err
+	}
+
+	err = app.DB.InsertRefreshToken(username, HashToken(refresh), time.Now().UTC().Add(RefreshTokenTTL))
+	if err != nil {
+		return token, err
+	}
+
+	token.RefreshToken = refresh
+
+	return token, nil
+}
+
+// VerifyJWT Verify a JWT of a user
+func (app *App) VerifyJWT(userJwt string) (*CustomClaims, error) {
 
 	// Get claims from token
 	token, err := jwt.ParseWithClaims(
 		userJwt,
 		&CustomClaims{},
 		func(token *jwt.Token) (interface{}, error) {
-			return app.SecureString, nil
+
+			// Only accept the algorithm we sign with
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, errors.New("Unexpected signing method")
+			}
+
+			// Tokens without a key id were signed with the legacy key
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				kid = "default"
+			}
+
+			key, ok := app.JWTKeys[kid]
+			if !ok {
+				return nil, errors.New("Unknown signing key")
+			}
+
+			return key, nil
 		},
 	)
 	if err != nil {
-		return username, role, 0, err
+		return nil, err
 	}
 
 	// Parse the claims from the token
 	claims, ok := token.Claims.(*CustomClaims)
 	if !ok {
-		return username, role, 0, errors.New("Couldn't parse claims")
+		return nil, errors.New("Couldn't parse claims")
 	}
 
 	if claims.ExpiresAt < time.Now().UTC().Unix() {
-		return username, role, 0, errors.New("JWT is expired")
+		return nil, errors.New("JWT is expired")
 	}
 
-	username = claims.Username
-	role = claims.Role
+	// Check the denylist
+	if claims.Id != "" {
+		revoked, err := app.DB.JWTRevoked(claims.Id)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errors.New("JWT is revoked")
+		}
+	}
 
-	return username, role, (claims.ExpiresAt - time.Now().UTC().Unix()), nil
+	return claims, nil
 }
 
 // GetTokenHeader get jwt from request
@@ -110,10 +227,10 @@ func GetTokenHeader(r *http.Request) string {
 	if len(token) > 0 {
 
 		// Check for correct format
-		splits := strings.Split(token[0], " ")
-		if len(splits) > 0 {
+		splits := strings.Split(strings.TrimSpace(token[0]), " ")
+		if len(splits) > 1 {
 
-			return splits[1]
+			return splits[len(splits)-1]
 		}
 	}
 
@@ -134,7 +251,7 @@ func (app *App) ValidateToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify valitity of token
-	_, _, left, err := app.VerifyJWT(token)
+	claims, err := app.VerifyJWT(token)
 	if err != nil {
 		log.Println("Invalid token verify")
 		JSONResponse(w, 401, "")
@@ -142,7 +259,7 @@ func (app *App) ValidateToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Token valid, return time left
-	tokenInfo.TimeLeft = left
+	tokenInfo.TimeLeft = claims.ExpiresAt - time.Now().UTC().Unix()
 	tokenInfo.Valid = true
 	JSONResponse(w, 200, tokenInfo)
 	return
@@ -158,7 +275,7 @@ func (app *App) ValidateRequest(w http.ResponseWriter, r *http.Request) bool {
 	}
 
 	// Verify valitity of token
-	_, _, _, err := app.VerifyJWT(token)
+	_, err := app.VerifyJWT(token)
 	if err != nil {
 		return false
 	}
@@ -191,7 +308,7 @@ func (app *App) GetJWT(w http.ResponseWriter, r *http.Request) {
 	fail := &models.User{}
 	user, err := app.DB.AuthenticateUser(pair[0], pair[1])
 
-	if cmp.Equal(user, fail) {
+	if cmp.Equal(user, fail) || !user.EmailVerified {
 
 		// Invalid login attempt
 		w.Header().Set("Content-Type", "application/json")
@@ -200,12 +317,149 @@ func (app *App) GetJWT(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get signed JWT
+	// Get signed JWT and refresh token
+	token, err := app.IssueTokens(user.Username, user.Role)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	JSONResponse(w, 200, token)
+}
+
+// RefreshJWT trade a refresh token for a new token pair
+func (app *App) RefreshJWT(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	refresh := r.PostForm.Get("refresh_token")
+	if refresh == "" {
+		JSONResponse(w, 401, "")
+		return
+	}
+
+	// Look up who the token belongs to
+	stored, err := app.DB.GetRefreshToken(HashToken(refresh))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if stored == nil {
+		JSONResponse(w, 401, "")
+		return
+	}
+
+	// Get current role of the user
+	user, err := app.DB.GetUser(stored.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if user.ID == 0 {
+		JSONResponse(w, 401, "")
+		return
+	}
+
+	// Sign the new access token before the old refresh token is spent
 	token, err := app.SignJWT(user.Username, user.Role)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
+	next, err := CreateOpaqueToken()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Retire the old refresh token and store its replacement together
+	stored, rotated, err := app.DB.RotateRefreshToken(stored.TokenHash, HashToken(next), time.Now().UTC().Add(RefreshTokenTTL))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if !rotated {
+
+		// A rotated token being used again means it leaked, revoke its family but leave other logins alone
+		if stored != nil && stored.Revoked && stored.ReplacedBy.Valid {
+			log.Printf("Refresh token reuse detected for %s", stored.Username)
+			err = app.DB.RevokeRefreshFamily(stored.Family)
+			if err != nil {
+				app.ServerError(w, err)
+				return
+			}
+		}
+		JSONResponse(w, 401, "")
+		return
+	}
+
+	token.RefreshToken = next
 
 	JSONResponse(w, 200, token)
 }
+
+// RevokeJWT revoke the presented access token and optional refresh token
+func (app *App) RevokeJWT(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get token from header
+	token := GetTokenHeader(r)
+	if token == "" {
+		JSONResponse(w, 401, "")
+		return
+	}
+
+	// Only a valid token can revoke
+	claims, err := app.VerifyJWT(token)
+	if err != nil {
+		JSONResponse(w, 401, "")
+		return
+	}
+
+	// Deny the access token until it would expire anyway
+	err = app.DB.RevokeJWT(claims.Id, time.Unix(claims.ExpiresAt, 0).UTC())
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Revoke the refresh token if it belongs to the same user
+	if refresh := r.PostForm.Get("refresh_token"); refresh != "" {
+		stored, err := app.DB.GetRefreshToken(HashToken(refresh))
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if stored != nil && stored.Username == claims.Username {
+			err = app.DB.RevokeRefreshToken(stored.TokenHash)
+			if err != nil {
+				app.ServerError(w, err)
+				return
+			}
+		}
+	}
+
+	JSONResponse(w, 200, TokenInfo{Valid: false})
+}
+
+// PruneTokens periodically clear expired tokens from the db
+func (app *App) PruneTokens(interval time.Duration) {
+	for {
+		err := app.DB.PruneRevokedTokens()
+		if err != nil {
+			log.Printf("Unable to prune tokens: %s", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
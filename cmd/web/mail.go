@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer send email through an smtp relay
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send deliver a message through the relay
+func (m *SMTPMailer) Send(to, subject, body string) error {
+
+	// Authenticate only when credentials are configured
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// Addresses with line breaks would smuggle in headers of their own
+	if err := checkAddresses(m.From, to); err != nil {
+		return err
+	}
+
+	// Headers and body
+	msg := strings.Join(append(mailHeaders(m.From, to, subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	), "\r\n")
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
+
+// ErrMailAddress an address that would break the message headers
+var ErrMailAddress = errors.New("mail: address contains a line break")
+
+// checkAddresses refuse addresses that contain line breaks
+func checkAddresses(addresses ...string) error {
+	for _, address := range addresses {
+		if strings.ContainsAny(address, "\r\n") {
+			return ErrMailAddress
+		}
+	}
+	return nil
+}
+
+// headerLineBreaks characters that would let a value start a new header
+var headerLineBreaks = strings.NewReplacer("\r", "", "\n", "")
+
+// headerValue strip line breaks from a header value
+func headerValue(value string) string {
+	return headerLineBreaks.Replace(value)
+}
+
+// mailHeaders the address, subject and date headers of a message, safe from header injection
+func mailHeaders(from, to, subject string) []string {
+	return []string{
+		"From: " + headerValue(from),
+		"To: " + headerValue(to),
+		"Subject: " + mime.QEncoding.Encode("utf-8", headerValue(subject)),
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z),
+	}
+}
+
+// LogMailer write email to the log when no relay is configured
+type LogMailer struct{}
+
+// Send log the message
+func (m *LogMailer) Send(to, subject, body string) error {
+	log.Printf("Mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// FileMailer write each email to its own file in a directory, for trying out mail locally
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send write the message out
+func (m *FileMailer) Send(to, subject, body string) error {
+
+	err := checkAddresses(m.From, to)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.Join(append(mailHeaders(m.From, to, subject), "", body), "\n")
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(to))
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), []byte(msg), 0644)
+}
+
+// NewMailer pick a mailer based on configuration, a directory wins over a relay
+func NewMailer(addr, username, password, from, dir string) Mailer {
+	if dir != "" {
+		return &FileMailer{Dir: dir, From: from}
+	}
+	if addr == "" {
+		return &LogMailer{}
+	}
+	return &SMTPMailer{Addr: addr, Username: username, Password: password, From: from}
+}
+
+// How queued mail is sent
+const (
+	mailQueueSize = 1000
+	mailWorkers   = 4
+)
+
+// QueuedMail a message waiting to be sent
+type QueuedMail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// SendMail queue an email to be sent in the background, dropping it when the queue is full
+func (app *App) SendMail(to, subject, body string) {
+	select {
+	case app.MailQueue <- &QueuedMail{To: to, Subject: subject, Body: body}:
+	default:
+		log.Printf("Mail queue full, dropping mail to %s", to)
+	}
+}
+
+// SendQueuedMail send queued mail as it comes in, run a few of these to send in parallel
+func (app *App) SendQueuedMail() {
+	for mail := range app.MailQueue {
+		err := app.Mailer.Send(mail.To, mail.Subject, mail.Body)
+		if err != nil {
+			log.Printf("Unable to send mail to %s: %s", mail.To, err.Error())
+		}
+	}
+}
+
+// Link build an absolute link to a page on the site
+func (app *App) Link(format string, a ...interface{}) string {
+	return strings.TrimSuffix(app.BaseURL, "/") + fmt.Sprintf(format, a...)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailerHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &FileMailer{Dir: dir, From: "library@example.com"}
+
+	// Line breaks in an address are refused outright
+	err = m.Send("bob@example.com\r\nBcc: eve@example.com", "Hi", "body")
+	if err != ErrMailAddress {
+		t.Fatalf("expected an address error, got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(files) != 0 {
+		t.Fatalf("expected no message, got %v", files)
+	}
+
+	// Line breaks in the subject are flattened
+	err = m.Send("bob@example.com", "Hi\r\nBcc: eve@example.com", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one message, got %v %v", files, err)
+	}
+	raw, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Injected lines must stay inside the header they were sent in
+	headers := strings.SplitN(string(raw), "\n\n", 2)[0]
+	for _, line := range strings.Split(headers, "\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Fatalf("header injected: %q", headers)
+		}
+	}
+	if !strings.Contains(headers, "To: bob@example.com\n") {
+		t.Fatalf("unexpected headers %q", headers)
+	}
+}
+
+func TestMailHeadersEncodeSubject(t *testing.T) {
+	headers := mailHeaders("a@example.com", "b@example.com", "Café news")
+	if headers[2] != "Subject: =?utf-8?q?Caf=C3=A9_news?=" {
+		t.Fatalf("unexpected subject header %q", headers[2])
+	}
+
+	headers = mailHeaders("a@example.com", "b@example.com", "Plain subject")
+	if headers[2] != "Subject: Plain subject" {
+		t.Fatalf("unexpected subject header %q", headers[2])
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -30,12 +31,36 @@ func main() {
 	dsn := flag.String("dsn", "postgres://", "Postgres DSN")
 	storageServer := flag.String("storage_server", "http://", "s3 storage endpoint")
 	bookBucket := flag.String("book_bucket", "library", "bucket for book storage")
+	avatarBucket := flag.String("avatar_bucket", "avatars", "bucket for user avatars")
+	exportBucket := flag.String("export_bucket", "exports", "bucket for user data exports")
 	bookAPIKey := flag.String("book_api_key", "", "api key for google books api")
 	storageKey := flag.String("storage_key", "key", "s3 access key")
 	storageSecret := flag.String("storage_secret", "secret", "s3 access secret")
 	tlsCert := flag.String("tls-cert", "./tls/cert.pem", "Path to TLS certificate")
 	tlsKey := flag.String("tls-key", "./tls/key.pem", "Path to TLS key")
 	jwtKey := flag.String("jwt-key", "supersecure", "JWT secure string")
+	jwtKeys := flag.String("jwt-keys", "", "JWT signing keys as kid=secret pairs, comma separated, first signs new tokens")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer url, enables single sign-on")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client id")
+	oidcClientSecret := flag.String("oidc-client-secret", "", "OpenID Connect client secret")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "OpenID Connect callback url, ending in /user/oidc/callback")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "Id token claim listing group membership")
+	oidcWriterGroups := flag.String("oidc-writer-groups", "", "Groups mapped to the writer role, comma separated")
+	oidcAllowGroups := flag.String("oidc-allow-groups", "", "Groups allowed to sign up without an invite, comma separated")
+	oidcProvision := flag.Bool("oidc-provision", true, "Create users on their first single sign-on")
+	baseURL := flag.String("base-url", "https://library.rileysnyder.org", "Public url of the site, used in emailed links")
+	smtpAddr := flag.String("smtp-addr", "", "SMTP relay host:port, email is logged when empty")
+	smtpUser := flag.String("smtp-user", "", "SMTP username")
+	smtpPass := flag.String("smtp-pass", "", "SMTP password")
+	mailFrom := flag.String("mail-from", "library@rileysnyder.org", "Sender address for email")
+	mailDir := flag.String("mail-dir", "", "Write email to files in this directory instead of sending it, for local testing")
+	unsubscribeKey := flag.String("unsubscribe-key", "", "Secret for signing unsubscribe links, defaults to the JWT key")
+	digestInterval := flag.Duration("digest-interval", time.Hour, "How often to check for digest emails that are due")
+	webhookInterval := flag.Duration("webhook-interval", time.Minute, "How often to check for webhook deliveries to retry")
+	storeRequestIP := flag.Bool("store-request-ip", false, "Keep the client address a request was made from")
+	claimTimeout := flag.Duration("claim-timeout", 7*24*time.Hour, "How long a claimed request is held before it reopens")
+	messageRate := flag.Int("message-rate", 20, "Messages a user can send a minute")
+	messageBurst := flag.Int("message-burst", 10, "Messages a user can send at once before the rate applies")
 
 	flag.Parse()
 
@@ -46,6 +71,12 @@ func main() {
 	// s3 storage connection
 	storage := ConnectStorage(*storageServer, *storageKey, *storageSecret)
 
+	// JWT signing keys
+	keys, keyID := ParseSigningKeys(*jwtKeys, *jwtKey)
+	if *unsubscribeKey == "" {
+		*unsubscribeKey = *jwtKey
+	}
+
 	// Initalize session manager
 	sessionStore = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
 
@@ -55,17 +86,56 @@ func main() {
 
 	// Application instance
 	app := &App{
-		HTMLDir:      *htmlDir,
-		StaticDir:    *staticDir,
-		YoutubeDir:   *youtubeDir,
-		DB:           &models.DB{db},
-		Storage:      storage,
-		BookBucket:   *bookBucket,
-		BookAPIKey:   *bookAPIKey,
-		Sessions:     sessionStore,
-		SecureString: []byte(*jwtKey),
+		HTMLDir:        *htmlDir,
+		StaticDir:      *staticDir,
+		YoutubeDir:     *youtubeDir,
+		DB:             &models.DB{DB: db},
+		Storage:        storage,
+		BookBucket:     *bookBucket,
+		AvatarBucket:   *avatarBucket,
+		ExportBucket:   *exportBucket,
+		BookAPIKey:     *bookAPIKey,
+		Sessions:       sessionStore,
+		JWTKeys:        keys,
+		JWTKeyID:       keyID,
+		Mailer:         NewMailer(*smtpAddr, *smtpUser, *smtpPass, *mailFrom, *mailDir),
+		MailQueue:      make(chan *QueuedMail, mailQueueSize),
+		Hub:            NewMemoryHub(),
+		MessageLimit:   NewRateLimiter(*messageRate, *messageBurst),
+		UnsubscribeKey: []byte(*unsubscribeKey),
+		WebhookWake:    make(chan struct{}, 1),
+		AnnounceWake:   make(chan struct{}, 1),
+		BaseURL:        *baseURL,
+		ClaimTimeout:   *claimTimeout,
+		StoreRequestIP: *storeRequestIP,
+		OIDC: NewOIDCProvider(*oidcIssuer, *oidcClientID, *oidcClientSecret, *oidcRedirectURL,
+			*oidcGroupsClaim, *oidcWriterGroups, *oidcAllowGroups, *oidcProvision),
 	}
 
+	// Send mail in the background
+	for i := 0; i < mailWorkers; i++ {
+		go app.SendQueuedMail()
+	}
+
+	// Clear out expired tokens
+	go app.PruneTokens(time.Hour)
+
+	// Reopen requests with expired claims
+	go app.ReleaseClaims(time.Hour)
+
+	// Forget idle message senders
+	go app.PruneLimits(10 * time.Minute)
+
+	// Email daily and weekly digests
+	go app.SendDigests(*digestInterval)
+
+	// Announce scheduled announcements as they start
+	go app.PublishAnnouncements(time.Minute)
+
+	// Send webhooks and clear out old deliveries
+	go app.DeliverWebhooks(*webhookInterval)
+	go app.PruneWebhookDeliveries(24 * time.Hour)
+
 	//Start server, quit on failure
 	log.Printf("Starting server on %s", *addr)
 	if *env == "test" {
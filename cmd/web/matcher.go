@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/fuzzy"
+	"github.com/rssnyder/louieslibrary/pkg/isbn"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// RequestMatch an open request a book might satisfy
+type RequestMatch struct {
+	Request *models.Request
+	Exact   bool
+	Score   int
+}
+
+// MatchRequests compare a book against open requests, best matches first
+func (app *App) MatchRequests(book *models.Book) ([]*RequestMatch, error) {
+
+	open, err := app.DB.OpenRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	// Isbns of the book in one form
+	bookISBNs := isbn.Extract(book.ISBN10 + " " + book.ISBN13)
+
+	// Authors are stored like [First Last Other Author]
+	authors := fuzzy.Normalize(strings.Trim(book.Authors, "[]"))
+
+	matches := []*RequestMatch{}
+	for _, request := range open {
+
+		// The pinned edition or any shared isbn is a sure thing
+		if (request.VolumeID != "" && request.VolumeID == book.VolumeID) || shared(bookISBNs, isbn.Extract(request.Title+" "+request.ISBN)) {
+			matches = append(matches, &RequestMatch{Request: request, Exact: true, Score: 100})
+			continue
+		}
+
+		// Otherwise score on the title, with a bump when an author is named
+		score := fuzzy.Similarity(book.Title, request.Title)
+		if fuzzy.Match(book.Title, request.Title) && score < fuzzy.Threshold {
+			score = fuzzy.Threshold
+		}
+		if score < fuzzy.Threshold {
+			continue
+		}
+		wanted := fuzzy.Normalize(request.Title + " " + request.Author)
+		for _, name := range strings.Fields(authors) {
+			if len(name) > 2 && strings.Contains(wanted, name) {
+				score += 0.1
+				break
+			}
+		}
+		if score > 0.99 {
+			score = 0.99
+		}
+
+		matches = append(matches, &RequestMatch{Request: request, Score: int(score * 100)})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+
+	return matches, nil
+}
+
+// shared check if two lists have an item in common
+func shared(a, b []string) bool {
+	for _, item := range a {
+		if containsString(b, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchNewBook fill exact matches for a new book, returns the candidates left to confirm
+func (app *App) MatchNewBook(volumeID, actor string) (filled []int, candidates []*RequestMatch, err error) {
+
+	book, err := app.DB.GetBook(volumeID)
+	if err != nil || book == nil {
+		return nil, nil, err
+	}
+
+	matches, err := app.MatchRequests(book)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, match := range matches {
+		if !match.Exact {
+			candidates = append(candidates, match)
+			continue
+		}
+
+		err = app.FulfilRequest(match.Request.ID, actor, book.VolumeID, "Matched by isbn on upload.")
+		if err == models.ErrRequestTransition || err == models.ErrRequestClaimed {
+
+			// Someone else is on it, let the uploader decide
+			candidates = append(candidates, match)
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		filled = append(filled, match.Request.ID)
+	}
+
+	return filled, candidates, nil
+}
+
+// ShowMatches list the open requests a book might fill
+func (app *App) ShowMatches(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get requested book id
+	vars := mux.Vars(r)
+	id := vars["volumeid"]
+
+	book, err := app.DB.GetBook(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if book == nil {
+		app.NotFound(w)
+		return
+	}
+
+	matches, err := app.MatchRequests(book)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Get the previous flash
+	flash := ""
+	if flashes := session.Flashes("default"); len(flashes) > 0 {
+		flash = fmt.Sprintf("%v", flashes[0])
+
+		// Save session
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	app.RenderHTML(w, r, "matches.page.html", &HTMLData{
+		Book:    book,
+		Matches: matches,
+		Flash:   flash,
+	})
+}
@@ -1,14 +1,105 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
-// Messages shows a conversation
+// eventHeartbeat how often an idle event stream is poked to keep proxies from closing it
+const eventHeartbeat = 30 * time.Second
+
+// messagePageSize how many messages of a conversation are shown at once
+const messagePageSize = 50
+
+// PostMessage save a message, and anything attached to it, to a conversation and push it to everyone in it
+func (app *App) PostMessage(conversationid int, sender, content string, attachment *models.Attachment) (*models.Message, error) {
+
+	message, err := app.DB.InsertMessage(conversationid, sender, content, attachment)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation, err := app.DB.GetConversation(conversationid, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	// People who blocked the sender don't see it, people who muted them aren't notified
+	blockers, err := app.DB.FilteredBy(sender, models.FilterBlock)
+	if err != nil {
+		return nil, err
+	}
+	muters, err := app.DB.FilteredBy(sender, models.FilterMute)
+	if err != nil {
+		return nil, err
+	}
+
+	text := fmt.Sprintf("%s sent you a message", sender)
+	if !conversation.Direct {
+		text = fmt.Sprintf("%s wrote in %s", sender, conversation.Title())
+	}
+	link := fmt.Sprintf("/messages/c/%d", conversationid)
+
+	for _, p := range conversation.Participants {
+		if blockers[p.Username] {
+			continue
+		}
+		app.Hub.Publish(p.Username, Event{Type: EventMessage, Data: message})
+		if p.Username != sender {
+			app.PublishUnread(p.Username)
+			if !muters[p.Username] {
+				app.Notify(p.Username, models.NotifyMessage, sender, text, link)
+			}
+		}
+	}
+
+	return message, nil
+}
+
+// ReadConversation mark a conversation read up to a message and tell the others in it
+func (app *App) ReadConversation(conversation *models.Conversation, username string, messageid int) error {
+
+	err := app.DB.MarkRead(conversation.ID, username, messageid)
+	if err != nil {
+		return err
+	}
+
+	// Reading the conversation covers its notification too
+	err = app.DB.MarkLinkRead(username, fmt.Sprintf("/messages/c/%d", conversation.ID))
+	if err != nil {
+		return err
+	}
+
+	receipt := Event{Type: EventRead, Data: ReadEvent{Conversation: conversation.ID, Username: username, Message: messageid}}
+	for _, p := range conversation.Participants {
+		app.Hub.Publish(p.Username, receipt)
+	}
+	app.PublishUnread(username)
+
+	return nil
+}
+
+// PublishUnread push a users unread message count to their open pages
+func (app *App) PublishUnread(username string) {
+
+	count, err := app.DB.CountUnread(username)
+	if err != nil {
+		log.Printf("Unable to count unread messages for %s: %s", username, err)
+		return
+	}
+
+	app.Hub.Publish(username, Event{Type: EventUnread, Data: UnreadEvent{Count: count}})
+}
+
+// Messages shows the direct conversation with a user, or just the list of them when a user opens their own
 func (app *App) Messages(w http.ResponseWriter, r *http.Request) {
 
 	// Get requested conversation user
@@ -18,57 +109,94 @@ func (app *App) Messages(w http.ResponseWriter, r *http.Request) {
 	// Get user
 	_, user := app.LoggedIn(r)
 
-	messages, err := app.DB.GetConversation(user.Username, reciver)
+	// Find the conversation with them, if there is one yet
+	id := 0
+	if reciver != user.Username {
+		var err error
+		id, err = app.DB.FindDirectConversation(user.Username, reciver)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	app.ShowMessages(w, r, id, &forms.NewMessage{Reciver: reciver})
+}
+
+// ShowMessages render the conversation list alongside a conversation, 0 for none yet, with the reply form.
+// Direct conversations name the reciver in the form, group ones leave it empty.
+func (app *App) ShowMessages(w http.ResponseWriter, r *http.Request, id int, form *forms.NewMessage) {
+
+	// Get user
+	_, user := app.LoggedIn(r)
+
+	// Get existing conversations
+	conversations, err := app.DB.GetConversations(user.Username)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
 
-	// Get user from db
-	displayUser, err := app.DB.GetUser(reciver)
-	if err != nil {
-		app.NotFound(w)
+	data := &HTMLData{
+		Conversations: conversations,
+		Form:          form,
+	}
+
+	if id != 0 {
+		data.Conversation, data.Page, err = app.LoadConversation(r, id, user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, ConversationDetail{Conversation: data.Conversation, Page: data.Page})
 		return
 	}
 
-	// Get existing threads
-	threads, err := app.DB.GetThreads(user.Username)
+	app.RenderHTML(w, r, "messages.page.html", data)
+}
 
-	// Get unread messages
-	unread, err := app.DB.GetUnopened(user.Username)
+// ConversationDetail a conversation with a page of its messages
+type ConversationDetail struct {
+	Conversation *models.Conversation `json:"conversation"`
+	Page         *models.MessagePage  `json:"page"`
+}
 
-	// Flag threads with unread messages
-	// for _, closed := range unread {
-	// 	for _, thread := range threads {
-	// 		if closed.Sender == thread.Sender {
-	// 			thread.Read = false
-	// 			break
-	// 		} else {
-	// 			thread.Read = true
-	// 		}
-	// 	}
-	// }
+// LoadConversation get a conversation and the page of messages asked for with ?before=,
+// opening the newest page counts as reading it
+func (app *App) LoadConversation(r *http.Request, id int, username string) (*models.Conversation, *models.MessagePage, error) {
 
-	for _, thread := range threads {
-		for _, closed := range unread {
-			if closed.Sender == thread.Sender {
-				thread.Read = true
-				break
-			}
-		}
+	conversation, err := app.DB.GetConversation(id, username)
+	if err != nil || conversation == nil {
+		return nil, nil, err
 	}
 
-	// Model the new message form based on html form
-	form := &forms.NewMessage{
-		Reciver: reciver,
+	before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+	if before < 0 {
+		before = 0
+	}
+	page, err := app.DB.GetMessages(id, username, before, messagePageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Read receipt for the newest message shown
+	if before == 0 && len(page.Messages) > 0 {
+		latest := page.Messages[len(page.Messages)-1].ID
+		err = app.ReadConversation(conversation, username, latest)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range conversation.Participants {
+			if p.Username == username && p.LastRead < latest {
+				p.LastRead = latest
+			}
+		}
 	}
 
-	app.RenderHTML(w, r, "messages.page.html", &HTMLData{
-		Messages:    messages,
-		DisplayUser: displayUser,
-		Threads:     threads,
-		Form:        form,
-	})
+	return conversation, page, nil
 }
 
 // CreateMessage create a new message in the db
@@ -94,16 +222,63 @@ func (app *App) CreateMessage(w http.ResponseWriter, r *http.Request) {
 		Content: r.PostForm.Get("content"),
 	}
 
-	// Validate form
-	// if !form.Valid() {
-	// 	app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{Form: form})
-	// 	return
-	// }
+	// Validate form, only real users can be messaged
+	valid := form.Valid()
+	if valid {
+		reciver, err := app.DB.GetUser(form.Reciver)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if reciver.ID == 0 {
+			form.Failures["Reciver"] = fmt.Sprintf("There is no user called %s", form.Reciver)
+			valid = false
+		}
+	}
+
+	// Blocked users can't start a conversation either
+	if valid {
+		blocked, err := app.DB.Blocked(form.Sender, form.Reciver)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if blocked {
+			form.Failures["Content"] = "You can't message this user"
+			valid = false
+		}
+	}
+	if valid && !app.MessageLimit.Allow(user.Username) {
+		form.Failures["Content"] = "You are sending messages too quickly, try again in a minute"
+		form.Limited = true
+		valid = false
+	}
 
-	// Insert the new request
-	err = app.DB.InsertMessage(form.Sender, form.Reciver, form.Content)
-	if err != nil {
-		app.ServerError(w, err)
+	// Find the conversation and add the message
+	var message *models.Message
+	var id int
+	if valid {
+		id, err = app.DB.DirectConversation(form.Sender, form.Reciver)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		message, err = app.PostMessage(id, form.Sender, form.Content, nil)
+		if err == models.ErrBlocked {
+			form.Failures["Content"] = "You can't message this user"
+			valid = false
+		} else if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+	if !valid {
+		app.MessageFailed(w, r, id, form)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusCreated, message)
 		return
 	}
 
@@ -117,3 +292,283 @@ func (app *App) CreateMessage(w http.ResponseWriter, r *http.Request) {
 	/// Send user to the newly added request
 	http.Redirect(w, r, fmt.Sprintf("/messages/%s", form.Reciver), http.StatusSeeOther)
 }
+
+// requestedConversation load the conversation named in the url, by id or by the other user of a direct one,
+// writing the error response when the current user isn't in one
+func (app *App) requestedConversation(w http.ResponseWriter, r *http.Request) *models.Conversation {
+
+	vars := mux.Vars(r)
+	_, user := app.LoggedIn(r)
+
+	// Direct conversations are found by who they are with
+	var id int
+	var err error
+	if reciver, ok := vars["reciver"]; ok {
+		id, err = app.DB.FindDirectConversation(user.Username, reciver)
+	} else {
+		id, err = strconv.Atoi(vars["id"])
+		if err != nil {
+			app.NotFound(w)
+			return nil
+		}
+	}
+	if err != nil {
+		app.ServerError(w, err)
+		return nil
+	}
+
+	conversation, err := app.DB.GetConversation(id, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return nil
+	}
+	if conversation == nil {
+		app.NotFound(w)
+		return nil
+	}
+
+	return conversation
+}
+
+// MessageFailed show the conversation again with why the message wasn't sent
+func (app *App) MessageFailed(w http.ResponseWriter, r *http.Request, id int, form *forms.NewMessage) {
+
+	if WantsJSON(r) {
+		status := http.StatusBadRequest
+		if form.Limited {
+			status = http.StatusTooManyRequests
+		}
+		JSONResponse(w, status, form.Failures)
+		return
+	}
+
+	app.ShowMessages(w, r, id, form)
+}
+
+// MarkRead record a read receipt for a conversation up to a message
+func (app *App) MarkRead(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get user
+	_, user := app.LoggedIn(r)
+
+	messageid, err := strconv.Atoi(r.PostForm.Get("message"))
+	if err != nil || messageid < 1 {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	conversation := app.requestedConversation(w, r)
+	if conversation == nil {
+		return
+	}
+
+	err = app.ReadConversation(conversation, user.Username, messageid)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Typing tell the others in a conversation the user is writing
+func (app *App) Typing(w http.ResponseWriter, r *http.Request) {
+
+	conversation := app.requestedConversation(w, r)
+	if conversation == nil {
+		return
+	}
+
+	// Get user
+	_, user := app.LoggedIn(r)
+
+	// People who blocked the user don't see them typing
+	blockers, err := app.DB.FilteredBy(user.Username, models.FilterBlock)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	typing := Event{Type: EventTyping, Data: TypingEvent{Conversation: conversation.ID, From: user.Username}}
+	for _, username := range conversation.Others {
+		if blockers[username] {
+			continue
+		}
+		app.Hub.Publish(username, typing)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Events stream the users live events as server-sent events until they leave
+func (app *App) Events(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.ServerError(w, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	// Get user
+	_, user := app.LoggedIn(r)
+
+	events, cancel := app.Hub.Subscribe(user.Username)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Start with where things stand
+	count, err := app.DB.CountUnread(user.Username)
+	if err != nil {
+		log.Printf("Unable to count unread messages for %s: %s", user.Username, err)
+	} else {
+		writeEvent(w, Event{Type: EventUnread, Data: UnreadEvent{Count: count}})
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent write one event in the server-sent events format
+func writeEvent(w http.ResponseWriter, event Event) {
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		log.Printf("Unable to encode %s event: %s", event.Type, err)
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// DeleteMessage remove a message from the users own view of a conversation
+func (app *App) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested message id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	// Get user
+	_, user := app.LoggedIn(r)
+
+	conversationid, err := app.DB.DeleteMessage(id, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if conversationid == 0 {
+		app.NotFound(w)
+		return
+	}
+
+	// It no longer counts as unread either
+	app.PublishUnread(user.Username)
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, "")
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/messages/c/%d", conversationid), http.StatusSeeOther)
+}
+
+// FilterUser block or mute another user, or lift it, depending on the filter in the url
+func (app *App) FilterUser(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get requested user and filter
+	vars := mux.Vars(r)
+	kind := vars["filter"]
+	if kind != models.FilterBlock && kind != models.FilterMute {
+		app.NotFound(w)
+		return
+	}
+
+	// Get user
+	_, user := app.LoggedIn(r)
+
+	target, err := app.DB.GetUser(vars["username"])
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if target.ID == 0 || target.Username == user.Username {
+		app.NotFound(w)
+		return
+	}
+
+	on := r.PostForm.Get("on") != "0"
+	err = app.DB.SetFilter(user.Username, target.Username, kind, on)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Counts change with who is filtered
+	app.PublishUnread(user.Username)
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, "")
+		return
+	}
+
+	flashes := map[string]string{
+		models.FilterBlock: "%s is blocked.",
+		models.FilterMute:  "%s is muted.",
+	}
+	if !on {
+		flashes = map[string]string{
+			models.FilterBlock: "%s is no longer blocked.",
+			models.FilterMute:  "%s is no longer muted.",
+		}
+	}
+	session.AddFlash(fmt.Sprintf(flashes[kind], target.Username), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/user/%s", target.Username), http.StatusSeeOther)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 )
@@ -30,33 +31,30 @@ func SecureHeaders(next http.Handler) http.Handler {
 func (app *App) RequireLogin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		// WebUI
-		loggedIn, _ := app.LoggedIn(r)
-		if !loggedIn {
-
-			// Try for a jwt
-			if app.ValidateRequest(w, r) {
-				next.ServeHTTP(w, r)
-			} else {
-				http.Redirect(w, r, "/user/login", 302)
-				return
-			}
+		// Session, jwt or api token
+		r, ok := app.Authenticate(r)
+		if !ok {
+			http.Redirect(w, r, "/user/login", 302)
+			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-// RequireWriter redirect users without writer role
-func (app *App) RequireWriter(next http.Handler) http.Handler {
+// RequirePermission redirect users whose role lacks a permission
+func (app *App) RequirePermission(permission string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		loggedIn, user := app.LoggedIn(r)
-		if !loggedIn {
+
+		// Session, jwt or api token
+		r, ok := app.Authenticate(r)
+		if !ok {
 			http.Redirect(w, r, "/user/login", 302)
 			return
 		}
 
-		if user.Role != "writer" {
+		_, user := app.LoggedIn(r)
+		if !app.Can(user, permission) {
 			http.Redirect(w, r, "/", 302)
 			return
 		}
@@ -64,3 +62,11 @@ func (app *App) RequireWriter(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// AllowToken let api tokens holding a scope through to a route
+func (app *App) AllowToken(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextKeyScope, scope)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// notificationPageSize how many notifications are listed at once
+const notificationPageSize = 100
+
+// Notify tell a user about something another user did and push it to their open pages
+func (app *App) Notify(username, kind, actor, text, link string) {
+
+	// Nobody needs telling about their own actions
+	if username == actor {
+		return
+	}
+
+	id, fresh, err := app.DB.InsertNotification(&models.Notification{
+		Username: username,
+		Type:     kind,
+		Actor:    actor,
+		Text:     text,
+		Link:     link,
+	})
+	if err != nil {
+		log.Printf("Unable to notify %s of %s: %s", username, kind, err.Error())
+		return
+	}
+
+	// Turned off
+	if id == 0 {
+		return
+	}
+
+	app.PublishNotification(username, id)
+
+	// Only new notifications are emailed, not updates to one still unread
+	if fresh {
+		app.EmailNotification(username, text, link)
+	}
+}
+
+// NotifyAll tell everyone about something, or everyone with one of the roles, used for announcements
+func (app *App) NotifyAll(kind, actor, text, link string, roles []string) {
+
+	usernames, err := app.DB.NotifyAll(kind, actor, text, link, roles)
+	if err != nil {
+		log.Printf("Unable to notify users of %s: %s", kind, err.Error())
+		return
+	}
+
+	for _, username := range usernames {
+		app.Hub.Publish(username, Event{Type: EventNotify, Data: NotifyEvent{
+			Notification: &models.Notification{Username: username, Type: kind, Actor: actor, Text: text, Link: link},
+			Unread:       app.unreadNotifications(username),
+		}})
+		app.EmailNotification(username, text, link)
+	}
+}
+
+// PublishNotification push a saved notification to a users open pages
+func (app *App) PublishNotification(username string, id int) {
+
+	notification, err := app.DB.GetNotification(id, username)
+	if err != nil || notification == nil {
+		return
+	}
+
+	app.Hub.Publish(username, Event{Type: EventNotify, Data: NotifyEvent{
+		Notification: notification,
+		Unread:       app.unreadNotifications(username),
+	}})
+}
+
+// unreadNotifications count for the bell, 0 if it can't be counted
+func (app *App) unreadNotifications(username string) int {
+
+	count, err := app.DB.CountUnreadNotifications(username)
+	if err != nil {
+		log.Printf("Unable to count notifications for %s: %s", username, err.Error())
+		return 0
+	}
+
+	return count
+}
+
+// ShowNotifications display a users notifications and their preferences
+func (app *App) ShowNotifications(w http.ResponseWriter, r *http.Request) {
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	notifications, err := app.DB.GetNotifications(user.Username, notificationPageSize)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, notifications)
+		return
+	}
+
+	preferences, err := app.DB.GetNotificationPreferences(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	email, err := app.DB.GetEmailPreference(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.RenderHTML(w, r, "notifications.page.html", &HTMLData{
+		Notifications: notifications,
+		Preferences:   preferences,
+		Frequency:     email.Frequency,
+	})
+}
+
+// OpenNotification mark a notification read and go to what it is about
+func (app *App) OpenNotification(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested notification
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	notification, err := app.DB.GetNotification(id, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if notification == nil {
+		app.NotFound(w)
+		return
+	}
+
+	err = app.DB.MarkNotificationsRead(user.Username, id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, notification.Link, http.StatusSeeOther)
+}
+
+// ReadNotifications mark one notification read, or all of them when no id is given
+func (app *App) ReadNotifications(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	id, _ := strconv.Atoi(r.PostForm.Get("id"))
+	err = app.DB.MarkNotificationsRead(user.Username, id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, map[string]int{"unread": app.unreadNotifications(user.Username)})
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// UpdateNotificationPreferences save which types of notification the user gets, a checkbox per type
+func (app *App) UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Unchecked boxes aren't sent, so every type is set
+	preferences := map[string]bool{}
+	for _, kind := range models.NotificationTypes {
+		preferences[kind] = r.PostForm.Get(kind) != ""
+	}
+
+	err = app.DB.SetNotificationPreferences(user.Username, preferences)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, preferences)
+		return
+	}
+
+	session.AddFlash("Notification preferences saved.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
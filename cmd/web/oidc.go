@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+)
+
+// OIDCDiscovery structure for the provider discovery document
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCKey structure for a single json web key
+type OIDCKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDCTokenResponse structure for the token endpoint response
+type OIDCTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+// OIDCIdentity the validated claims of an id token
+type OIDCIdentity struct {
+	Issuer        string
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+}
+
+// OIDCProvider an openid connect identity provider
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	GroupsClaim  string
+	WriterGroups []string
+	AllowGroups  []string
+	Provision    bool
+
+	client    *http.Client
+	mu        sync.Mutex
+	discovery *OIDCDiscovery
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time
+}
+
+// KeyRefreshInterval minimum time between key set fetches for unknown key ids
+var KeyRefreshInterval = time.Minute
+
+// usernameStrip characters not allowed in provisioned usernames
+var usernameStrip = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// NewOIDCProvider configure a provider, nil if sso is disabled
+func NewOIDCProvider(issuer, clientID, clientSecret, redirectURL, groupsClaim, writerGroups, allowGroups string, provision bool) *OIDCProvider {
+
+	// SSO is optional
+	if issuer == "" || clientID == "" {
+		return nil
+	}
+
+	return &OIDCProvider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		GroupsClaim:  groupsClaim,
+		WriterGroups: SplitList(writerGroups),
+		AllowGroups:  SplitList(allowGroups),
+		Provision:    provision,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON fetch a url and decode the json response
+func (p *OIDCProvider) getJSON(target string, output interface{}) error {
+
+	resp, err := p.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d from %s", resp.StatusCode, target)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+// Discover fetch and cache the discovery document
+func (p *OIDCProvider) Discover() (*OIDCDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	discovery := &OIDCDiscovery{}
+	err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	// The document must describe the issuer we were configured with
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("Discovery issuer %s does not match %s", discovery.Issuer, p.Issuer)
+	}
+
+	p.discovery = discovery
+
+	return discovery, nil
+}
+
+// refreshKeys load the signing keys of the provider
+func (p *OIDCProvider) refreshKeys(jwksURI string) error {
+
+	var set struct {
+		Keys []OIDCKey `json:"keys"`
+	}
+	err := p.getJSON(jwksURI, &set)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+
+		// Decode modulus and exponent
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			continue
+		}
+
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	return nil
+}
+
+// signingKey find a provider key, refetching the key set for unknown ids
+func (p *OIDCProvider) signingKey(kid, jwksURI string) (*rsa.PublicKey, error) {
+
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	if ok {
+		p.mu.Unlock()
+		return key, nil
+	}
+
+	// Provider may have rotated its keys, but forged key ids must not hammer it
+	if !p.fetched.IsZero() && time.Since(p.fetched) < KeyRefreshInterval {
+		p.mu.Unlock()
+		return nil, errors.New("Unknown id token signing key")
+	}
+	p.fetched = time.Now()
+	p.mu.Unlock()
+
+	err := p.refreshKeys(jwksURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A key set with one key does not need a key id
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, errors.New("Unknown id token signing key")
+	}
+
+	return key, nil
+}
+
+// AuthURL build the authorization request for the provider
+func (p *OIDCProvider) AuthURL(state, nonce, verifier string) (string, error) {
+
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	// PKCE challenge for the verifier
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", "openid profile email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	return discovery.AuthorizationEndpoint + "?" + params.Encode(), nil
+}
+
+// Exchange trade an authorization code for a validated identity
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (*OIDCIdentity, error) {
+
+	discovery, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	// Token request
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := &OIDCTokenResponse{}
+	err = json.Unmarshal(body, tokens)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("Token exchange failed: %d %s", resp.StatusCode, tokens.Error)
+	}
+
+	return p.VerifyIDToken(tokens.IDToken, nonce, discovery.JWKSURI)
+}
+
+// VerifyIDToken check the signature and claims of an id token
+func (p *OIDCProvider) VerifyIDToken(idToken, nonce, jwksURI string) (*OIDCIdentity, error) {
+
+	// Signature and time based claims
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.New("Unexpected id token signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(kid, jwksURI)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("Couldn't parse id token claims")
+	}
+
+	// Expiry is required
+	if !claims.VerifyExpiresAt(time.Now().UTC().Unix(), true) {
+		return nil, errors.New("Id token is expired")
+	}
+
+	// Issued by our provider
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.Issuer {
+		return nil, errors.New("Id token issuer mismatch")
+	}
+
+	// Issued for us
+	if !containsString(claimStrings(claims["aud"]), p.ClientID) {
+		return nil, errors.New("Id token audience mismatch")
+	}
+
+	// Issued for this login attempt
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return nil, errors.New("Id token nonce mismatch")
+	}
+
+	identity := &OIDCIdentity{
+		Issuer: p.Issuer,
+		Groups: claimStrings(claims[p.GroupsClaim]),
+	}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	if identity.Subject == "" {
+		return nil, errors.New("Id token missing subject")
+	}
+
+	// Pick a username for provisioning
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username = strings.Split(identity.Email, "@")[0]
+	}
+	identity.Username = usernameStrip.ReplaceAllString(username, "")
+
+	return identity, nil
+}
+
+// Role map provider groups onto a library role
+func (p *OIDCProvider) Role(identity *OIDCIdentity) string {
+	for _, group := range identity.Groups {
+		if containsString(p.WriterGroups, group) {
+			return "writer"
+		}
+	}
+	return "reader"
+}
+
+// Permits check if a new identity may be provisioned, given whether its invite is valid
+func (p *OIDCProvider) Permits(identity *OIDCIdentity, inviteValid bool) bool {
+	if !p.Provision || identity.Username == "" || identity.Email == "" || forms.ReservedUsername(identity.Username) {
+		return false
+	}
+	return inviteValid || p.Allowed(identity)
+}
+
+// Allowed check if group membership permits provisioning without an invite
+func (p *OIDCProvider) Allowed(identity *OIDCIdentity) bool {
+	for _, group := range identity.Groups {
+		if containsString(p.AllowGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings read a claim that may be a string or a list of strings
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var output []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				output = append(output, s)
+			}
+		}
+		return output
+	}
+	return nil
+}
+
+// containsString check if a slice holds a string
+func containsString(slice []string, s string) bool {
+	for _, ele := range slice {
+		if ele == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitList split a comma separated flag into its values
+func SplitList(list string) []string {
+	var output []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			output = append(output, item)
+		}
+	}
+	return output
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// OIDCLogin send the user to the identity provider
+func (app *App) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+
+	// SSO is optional
+	if app.OIDC == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Values tying the callback to this attempt
+	state, err := CreateOpaqueToken()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	nonce, err := CreateOpaqueToken()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	verifier, err := CreateOpaqueToken()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Build the provider url
+	target, err := app.OIDC.AuthURL(state, nonce, verifier)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Values["oidc_invite"] = r.URL.Query().Get("invitecode")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// OIDCCallback complete a login with the identity provider
+func (app *App) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+
+	// SSO is optional
+	if app.OIDC == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Pull the values for this attempt, they are single use
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	invite, _ := session.Values["oidc_invite"].(string)
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+	delete(session.Values, "oidc_invite")
+
+	query := r.URL.Query()
+	if state == "" || query.Get("state") != state || query.Get("code") == "" {
+		log.Printf("SSO callback rejected: %s", query.Get("error"))
+		app.loginFailed(w, r, "Single sign-on failed.")
+		return
+	}
+
+	// Exchange the code and validate the id token
+	identity, err := app.OIDC.Exchange(query.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("SSO exchange failed: %s", err.Error())
+		app.loginFailed(w, r, "Single sign-on failed.")
+		return
+	}
+
+	// Find the linked user
+	user, err := app.DB.GetUserByIdentity(identity.Issuer, identity.Subject)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Provision the user on first login
+	if user.ID == 0 {
+		user, err = app.provisionOIDCUser(identity, invite)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if user == nil {
+			app.loginFailed(w, r, "Your account could not be created, an invite code and an email address are required.")
+			return
+		}
+	}
+
+	// Email must be confirmed first, as for password logins, unless the provider vouches for it
+	if !user.EmailVerified {
+		if !identity.EmailVerified || identity.Email == "" || !strings.EqualFold(identity.Email, user.Email) {
+			app.loginFailed(w, r, "Please confirm your email address first, use the link we sent you.")
+			return
+		}
+		err = app.DB.MarkEmailVerified(user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		user.EmailVerified = true
+	}
+
+	// Keep reader and writer roles in step with the provider groups
+	if len(app.OIDC.WriterGroups) > 0 && (user.Role == "reader" || user.Role == "writer") {
+		role := app.OIDC.Role(identity)
+		if role != user.Role {
+			_, err = app.DB.SetUserRole(user.Username, role)
+			if err != nil {
+				app.ServerError(w, err)
+				return
+			}
+			user.Role = role
+		}
+	}
+
+	// Remember the sign in, it stands in for a password when deleting the account
+	session.Values["sso_user"] = user.Username
+	session.Values["sso_at"] = time.Now().UTC().Unix()
+
+	app.StartSession(w, r, user)
+}
+
+// provisionOIDCUser create a user for a new identity, nil if not permitted
+func (app *App) provisionOIDCUser(identity *OIDCIdentity, invite string) (*models.User, error) {
+
+	// Group membership or a valid invite is needed
+	inviteValid := false
+	if invite != "" && !app.OIDC.Allowed(identity) {
+		var err error
+		inviteValid, err = app.DB.ValidateInvite(invite)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !app.OIDC.Permits(identity, inviteValid) {
+		return nil, nil
+	}
+
+	// Never link to an existing local account by name
+	existing, err := app.DB.GetUser(identity.Username)
+	if err != nil {
+		return nil, err
+	}
+	if existing.ID != 0 {
+		log.Printf("SSO username %s already taken", identity.Username)
+		return nil, nil
+	}
+
+	// Local password is never used
+	password, err := CreateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Group members don't use up an invite
+	if app.OIDC.Allowed(identity) {
+		invite = ""
+	}
+
+	// Create, link, verify and apply the mapped role together
+	claimed, err := app.DB.InsertIdentityUser(identity.Username, identity.Email, password, invite,
+		app.OIDC.Role(identity), identity.EmailVerified, identity.Issuer, identity.Subject)
+	if err != nil || !claimed {
+		return nil, err
+	}
+
+	// Trust the address if the provider has verified it, otherwise confirm it
+	if !identity.EmailVerified {
+		err = app.SendVerification(identity.Username, identity.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return app.DB.GetUserByIdentity(identity.Issuer, identity.Subject)
+}
+
+// loginFailed send a user back to the login page with a message
+func (app *App) loginFailed(w http.ResponseWriter, r *http.Request, message string) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	session.AddFlash(message, "default")
+
+	// Save session
+	err := session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Redirect to login page
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockProvider a minimal openid connect provider
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu         sync.Mutex
+	challenges map[string]string
+	claims     jwt.MapClaims
+	kid        string
+	jwksHits   int
+}
+
+// newMockProvider start a provider serving discovery, keys and tokens
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{key: key, challenges: make(map[string]string), kid: "k1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.jwksHits++
+		m.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string][]OIDCKey{"keys": {{
+			Kid: "k1",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		// PKCE, the verifier must hash to the challenge sent for this code
+		m.mu.Lock()
+		challenge := m.challenges[r.PostForm.Get("code")]
+		m.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if challenge == "" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(OIDCTokenResponse{Error: "invalid_grant"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(OIDCTokenResponse{AccessToken: "access", IDToken: m.sign(t)})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+// authorize record the challenge of an authorization url against a code
+func (m *mockProvider) authorize(t *testing.T, target, code string) url.Values {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+
+	m.mu.Lock()
+	m.challenges[code] = query.Get("code_challenge")
+	m.mu.Unlock()
+
+	return query
+}
+
+// sign issue an id token with the current claims
+func (m *mockProvider) sign(t *testing.T) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, m.claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// validClaims claims the provider would issue for a login attempt
+func (m *mockProvider) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                m.URL,
+		"aud":                "library",
+		"sub":                "user-1",
+		"nonce":              nonce,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"email":              "louie@example.com",
+		"email_verified":     true,
+		"preferred_username": "louie!",
+		"groups":             []string{"staff", "editors"},
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.Close()
+
+	tests := []struct {
+		name     string
+		verifier string
+		mutate   func(claims jwt.MapClaims)
+		wantErr  bool
+	}{
+		{name: "valid", verifier: "verifier"},
+		{name: "wrong verifier", verifier: "other", wantErr: true},
+		{name: "wrong nonce", verifier: "verifier", mutate: func(c jwt.MapClaims) { c["nonce"] = "replayed" }, wantErr: true},
+		{name: "missing nonce", verifier: "verifier", mutate: func(c jwt.MapClaims) { delete(c, "nonce") }, wantErr: true},
+		{name: "wrong audience", verifier: "verifier", mutate: func(c jwt.MapClaims) { c["aud"] = "someone-else" }, wantErr: true},
+		{name: "audience list", verifier: "verifier", mutate: func(c jwt.MapClaims) { c["aud"] = []string{"other", "library"} }},
+		{name: "wrong issuer", verifier: "verifier", mutate: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "expired", verifier: "verifier", mutate: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: true},
+		{name: "missing subject", verifier: "verifier", mutate: func(c jwt.MapClaims) { delete(c, "sub") }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewOIDCProvider(m.URL, "library", "secret", "http://library/sso/callback", "groups", "editors", "staff", true)
+
+			target, err := p.AuthURL("state", "nonce", "verifier")
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := m.authorize(t, target, "code")
+			if query.Get("code_challenge_method") != "S256" || query.Get("nonce") != "nonce" {
+				t.Fatalf("authorization url missing pkce or nonce: %s", target)
+			}
+
+			claims := m.validClaims("nonce")
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+			m.mu.Lock()
+			m.claims = claims
+			m.mu.Unlock()
+
+			identity, err := p.Exchange("code", tt.verifier, "nonce")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got identity %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Subject != "user-1" || identity.Username != "louie" || !identity.EmailVerified {
+				t.Fatalf("unexpected identity %+v", identity)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryIssuer(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.Close()
+
+	// Configured issuer differs from the one the document claims
+	p := NewOIDCProvider(m.URL+"/tenant", "library", "", "", "groups", "", "", true)
+	if _, err := p.Discover(); err == nil {
+		t.Fatal("expected discovery to reject a mismatched issuer")
+	}
+}
+
+func TestOIDCKeyRefreshLimited(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.Close()
+
+	p := NewOIDCProvider(m.URL, "library", "", "", "groups", "", "", true)
+	jwksURI := m.URL + "/jwks"
+
+	if _, err := p.signingKey("k1", jwksURI); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forged key ids must not each trigger a fetch
+	for i := 0; i < 5; i++ {
+		if _, err := p.signingKey("forged", jwksURI); err == nil {
+			t.Fatal("expected an unknown key error")
+		}
+	}
+	if m.jwksHits != 1 {
+		t.Fatalf("expected 1 key set fetch, got %d", m.jwksHits)
+	}
+
+	// Known keys keep working while refreshes are held back
+	if _, err := p.signingKey("k1", jwksURI); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the interval has passed a rotated key can be picked up
+	p.fetched = time.Now().Add(-KeyRefreshInterval)
+	if _, err := p.signingKey("forged", jwksURI); err == nil {
+		t.Fatal("expected an unknown key error")
+	}
+	if m.jwksHits != 2 {
+		t.Fatalf("expected 2 key set fetches, got %d", m.jwksHits)
+	}
+}
+
+func TestOIDCProvisioning(t *testing.T) {
+	p := NewOIDCProvider("https://sso.example.com", "library", "", "", "groups", "editors", "staff", true)
+
+	tests := []struct {
+		name        string
+		identity    *OIDCIdentity
+		inviteValid bool
+		provision   bool
+		permits     bool
+		role        string
+	}{
+		{name: "allowed group", identity: &OIDCIdentity{Username: "a", Email: "a@example.com", Groups: []string{"staff"}}, provision: true, permits: true, role: "reader"},
+		{name: "writer group", identity: &OIDCIdentity{Username: "a", Email: "a@example.com", Groups: []string{"staff", "editors"}}, provision: true, permits: true, role: "writer"},
+		{name: "valid invite", identity: &OIDCIdentity{Username: "a", Email: "a@example.com"}, inviteValid: true, provision: true, permits: true, role: "reader"},
+		{name: "no group or invite", identity: &OIDCIdentity{Username: "a", Email: "a@example.com", Groups: []string{"guests"}}, provision: true, role: "reader"},
+		{name: "reserved username", identity: &OIDCIdentity{Username: "deleted-4", Email: "a@example.com", Groups: []string{"staff"}}, provision: true, role: "reader"},
+		{name: "no email", identity: &OIDCIdentity{Username: "a", Groups: []string{"staff"}}, inviteValid: true, provision: true, role: "reader"},
+		{name: "no username", identity: &OIDCIdentity{Email: "a@example.com", Groups: []string{"staff"}}, inviteValid: true, provision: true, role: "reader"},
+		{name: "provisioning off", identity: &OIDCIdentity{Username: "a", Email: "a@example.com", Groups: []string{"staff"}}, inviteValid: true, role: "reader"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.Provision = tt.provision
+			if got := p.Permits(tt.identity, tt.inviteValid); got != tt.permits {
+				t.Fatalf("Permits() = %v, want %v", got, tt.permits)
+			}
+			if got := p.Role(tt.identity); got != tt.role {
+				t.Fatalf("Role() = %s, want %s", got, tt.role)
+			}
+		})
+	}
+}
+
+func TestClaimStrings(t *testing.T) {
+	if got := claimStrings("one"); len(got) != 1 || got[0] != "one" {
+		t.Fatalf("unexpected %v", got)
+	}
+	if got := claimStrings([]interface{}{"one", 2, "three"}); strings.Join(got, ",") != "one,three" {
+		t.Fatalf("unexpected %v", got)
+	}
+	if got := claimStrings(nil); got != nil {
+		t.Fatalf("unexpected %v", got)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// EmailVerificationTTL how long an email confirmation link works
+const EmailVerificationTTL = 48 * time.Hour
+
+// SendVerification email a confirmation link for an address
+func (app *App) SendVerification(username, email string) error {
+
+	// Create token, only the hash is kept
+	token, err := CreateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	err = app.DB.InsertEmailVerification(username, email, HashToken(token), time.Now().UTC().Add(EmailVerificationTTL))
+	if err != nil {
+		return err
+	}
+
+	app.SendMail(email, "Confirm your email for Louie's Library",
+		fmt.Sprintf("Hi %s,\n\nConfirm this email address for your Louie's Library account:\n%s\n\nThe link works for 48 hours.\n",
+			username, app.Link("/user/verify?token=%s", token)))
+
+	return nil
+}
+
+// ConfirmEmail use an emailed link to verify an address
+func (app *App) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	username, err := app.DB.ConfirmEmail(HashToken(r.URL.Query().Get("token")))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if username == "" {
+		session.AddFlash("That confirmation link is invalid or has expired.", "default")
+	} else {
+		session.AddFlash("Your email address is confirmed!", "default")
+	}
+
+	// Keep a logged in session up to date
+	loggedIn, user := app.LoggedIn(r)
+	if loggedIn && user.Username == username {
+		err = app.RefreshSessionUser(r)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// ResendVerification email a new confirmation link for an unverified user
+func (app *App) ResendVerification(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get user from db
+	user, err := app.DB.GetUser(r.PostForm.Get("username"))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Only unverified users get a new link
+	if user.ID != 0 && !user.EmailVerified && user.Email != "" {
+		err = app.SendVerification(user.Username, user.Email)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	// Same answer either way so usernames are not revealed
+	app.loginFailed(w, r, "If that account needs confirming, a new link is on its way.")
+}
+
+// RefreshSessionUser reload the user stored in the session
+func (app *App) RefreshSessionUser(r *http.Request) error {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	current, ok := session.Values["user"].(*models.User)
+	if !ok || current.ID == 0 {
+		return nil
+	}
+
+	user, err := app.DB.GetUser(current.Username)
+	if err != nil {
+		return err
+	}
+	session.Values["user"] = user
+
+	return nil
+}
+
+// EditProfile display the profile form for the current user
+func (app *App) EditProfile(w http.ResponseWriter, r *http.Request) {
+
+	// Get current user
+	_, current := app.LoggedIn(r)
+
+	// Get fresh data from the db
+	user, err := app.DB.GetUser(current.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.RenderHTML(w, r, "editprofile.page.html", &HTMLData{
+		DisplayUser: user,
+		Formats:     forms.Formats,
+		Form: &forms.Profile{
+			Username:        user.Username,
+			DisplayName:     user.DisplayName,
+			Bio:             user.Bio,
+			Email:           user.Email,
+			PreferredFormat: user.PreferredFormat,
+		},
+	})
+}
+
+// UpdateProfile save the profile of the current user
+func (app *App) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Limit the whole request to 2mb, anything past it fails to parse
+	r.Body = http.MaxBytesReader(w, r.Body, 2<<20)
+	err := r.ParseMultipartForm(2 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, current := app.LoggedIn(r)
+	user, err := app.DB.GetUser(current.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Model the profile on the html form
+	form := &forms.Profile{
+		Username:        user.Username,
+		DisplayName:     strings.TrimSpace(r.PostForm.Get("displayname")),
+		Bio:             strings.TrimSpace(r.PostForm.Get("bio")),
+		Email:           strings.TrimSpace(r.PostForm.Get("email")),
+		PreferredFormat: r.PostForm.Get("preferredformat"),
+	}
+
+	// Validate the profile form
+	if !form.Valid() {
+		app.RenderHTML(w, r, "editprofile.page.html", &HTMLData{
+			DisplayUser: user,
+			Formats:     forms.Formats,
+			Form:        form,
+		})
+		return
+	}
+
+	err = app.DB.UpdateProfile(user.Username, form.DisplayName, form.Bio, form.PreferredFormat)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Optional new avatar
+	file, _, err := r.FormFile("avatar")
+	if err == nil {
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		// Only accept images
+		if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+			form.Failures["Avatar"] = "Avatar must be an image"
+			app.RenderHTML(w, r, "editprofile.page.html", &HTMLData{
+				DisplayUser: user,
+				Formats:     forms.Formats,
+				Form:        form,
+			})
+			return
+		}
+
+		err = app.UploadBytes(app.AvatarBucket, user.Username, data)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		err = app.DB.SetAvatar(user.Username, user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	// A new email address needs confirming before it is used
+	if form.Email != user.Email {
+		err = app.SendVerification(user.Username, form.Email)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		session.AddFlash(fmt.Sprintf("Profile saved. Check %s for a link to confirm your new address.", form.Email), "default")
+	} else {
+		session.AddFlash("Profile saved.", "default")
+	}
+
+	// Keep the session up to date
+	err = app.RefreshSessionUser(r)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+}
+
+// ShowAvatar send a users avatar image
+func (app *App) ShowAvatar(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested user
+	vars := mux.Vars(r)
+
+	user, err := app.DB.GetUser(vars["username"])
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if user.ID == 0 || user.Avatar == "" {
+		app.NotFound(w)
+		return
+	}
+
+	data, err := app.DownloadBytes(app.AvatarBucket, user.Avatar)
+	if err != nil {
+		app.NotFound(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(data)
+}
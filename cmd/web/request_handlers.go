@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/fuzzy"
+	"github.com/rssnyder/louieslibrary/pkg/isbn"
+	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
 // ShowRequest display a single request
@@ -38,6 +43,36 @@ func (app *App) ShowRequest(w http.ResponseWriter, r *http.Request) {
 	// Trim space on a found book id
 	request.BookID = strings.TrimSpace(request.BookID)
 
+	// Get the users who want this
+	request.Voters, err = app.DB.GetRequestVoters(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	_, user := app.LoggedIn(r)
+	request.Voted = containsString(request.Voters, user.Username)
+
+	// Get the history of the request
+	request.Events, err = app.DB.GetRequestEvents(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Get the discussion
+	thread, err := app.LoadComments(models.CommentOnRequest, strconv.Itoa(id), user)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Get conversations to send it to
+	conversations, err := app.DB.GetConversations(user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
 	// Get the previous flash
 	if flashes := session.Flashes("default"); len(flashes) > 0 {
 
@@ -50,15 +85,21 @@ func (app *App) ShowRequest(w http.ResponseWriter, r *http.Request) {
 
 		// Render page with flash
 		app.RenderHTML(w, r, "showrequest.page.html", &HTMLData{
-			Request: request,
-			Flash:   fmt.Sprintf("%v", flashes[0]),
+			Request:       request,
+			Reasons:       models.RejectReasons,
+			Thread:        thread,
+			Conversations: conversations,
+			Flash:         fmt.Sprintf("%v", flashes[0]),
 		})
 	} else {
 
 		// Render page without flash
 		app.RenderHTML(w, r, "showrequest.page.html", &HTMLData{
-			Request: request,
-			Flash:   "",
+			Request:       request,
+			Reasons:       models.RejectReasons,
+			Thread:        thread,
+			Conversations: conversations,
+			Flash:         "",
 		})
 	}
 }
@@ -66,7 +107,8 @@ func (app *App) ShowRequest(w http.ResponseWriter, r *http.Request) {
 // NewRequest display the new request form
 func (app *App) NewRequest(w http.ResponseWriter, r *http.Request) {
 	app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{
-		Form: &forms.NewRequest{},
+		Form:    &forms.NewRequest{},
+		Formats: forms.Formats,
 	})
 }
 
@@ -90,20 +132,105 @@ func (app *App) CreateRequest(w http.ResponseWriter, r *http.Request) {
 	form := &forms.NewRequest{
 		Requester: user.Username,
 		Title:     r.PostForm.Get("title"),
+		Author:    strings.TrimSpace(r.PostForm.Get("author")),
+		ISBN:      strings.TrimSpace(r.PostForm.Get("isbn")),
+		Format:    r.PostForm.Get("format"),
+		Edition:   strings.TrimSpace(r.PostForm.Get("edition")),
+		Language:  strings.TrimSpace(r.PostForm.Get("language")),
+		Notes:     strings.TrimSpace(r.PostForm.Get("notes")),
+		VolumeID:  strings.TrimSpace(r.PostForm.Get("volumeid")),
+	}
+
+	// Search for editions to pin instead of saving
+	if r.PostForm.Get("lookup") != "" {
+		query := strings.TrimSpace(form.Title + " " + form.Author)
+		if form.ISBN != "" {
+			query = "isbn:" + isbn.Normalize(form.ISBN)
+		}
+		form.Failures = make(map[string]string)
+		if query == "" {
+			form.Failures["Title"] = "Enter a title, author or ISBN to look up"
+			app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{Form: form, Formats: forms.Formats})
+			return
+		}
+		volumes, err := SearchBooks(query, app.BookAPIKey)
+		if err != nil {
+			log.Printf("Book lookup failed: %s", err.Error())
+			form.Failures["VolumeID"] = "The book lookup isn't working right now, fill in the details yourself"
+		} else if len(volumes) == 0 {
+			form.Failures["VolumeID"] = "No editions found, fill in the details yourself"
+		}
+		app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{Form: form, Formats: forms.Formats, Volumes: volumes})
+		return
+	}
+
+	// Fill in the gaps from a pinned edition
+	if form.VolumeID != "" {
+		volume, err := LookupVolume(form.VolumeID, app.BookAPIKey)
+		if err != nil {
+			log.Printf("Book lookup failed: %s", err.Error())
+		} else if volume == nil {
+			form.VolumeID = ""
+		} else {
+			if strings.TrimSpace(form.Title) == "" {
+				form.Title = volume.Data.Title
+			}
+			if form.Author == "" {
+				form.Author = strings.Join(volume.Data.Authors, ", ")
+			}
+			if form.ISBN == "" {
+				form.ISBN = volume.ISBN()
+			}
+			if form.Edition == "" {
+				form.Edition = strings.TrimSpace(volume.Data.Publisher + " " + volume.Data.PublishedDate)
+			}
+			if form.Language == "" {
+				form.Language = volume.Data.Language
+			}
+		}
 	}
 
 	// Validate form
 	if !form.Valid() {
-		app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{Form: form})
+		app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{Form: form, Formats: forms.Formats})
 		return
 	}
 
+	// Point out open requests for the same thing so the user can vote instead
+	if r.PostForm.Get("anyway") == "" {
+		similar, err := app.SimilarRequests(form.Title)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		if len(similar) > 0 {
+			app.RenderHTML(w, r, "newrequest.page.html", &HTMLData{
+				Form:     form,
+				Requests: similar,
+				Formats:  forms.Formats,
+			})
+			return
+		}
+	}
+
+	// Only keep where the request came from when configured to
+	source := ""
+	if app.StoreRequestIP {
+		source = r.RemoteAddr
+	}
+
 	// Insert the new request
-	id, err := app.DB.InsertRequest(form.Requester, form.Title, r.RemoteAddr)
+	id, err := app.DB.InsertRequest(form, source)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	request, err := app.DB.GetRequest(id)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
+	app.FireWebhook(models.HookRequestCreated, fmt.Sprintf("/request/%d", id), request)
 
 	session.AddFlash("Your request was saved successfully!", "default")
 
@@ -120,13 +247,42 @@ func (app *App) CreateRequest(w http.ResponseWriter, r *http.Request) {
 
 // FillRequest tie a request to an existing book
 func (app *App) FillRequest(w http.ResponseWriter, r *http.Request) {
+	app.ChangeRequest(w, r, models.RequestFulfilled, "Request filled!")
+}
+
+// ClaimRequest mark a request as being worked on by the current user
+func (app *App) ClaimRequest(w http.ResponseWriter, r *http.Request) {
+	app.ChangeRequest(w, r, models.RequestClaimed, "Request claimed, it's yours for now.")
+}
+
+// UnclaimRequest give up a claim on a request
+func (app *App) UnclaimRequest(w http.ResponseWriter, r *http.Request) {
+	app.ChangeRequest(w, r, models.RequestOpen, "Request released.", models.RequestClaimed)
+}
+
+// RejectRequest turn down a request with a reason
+func (app *App) RejectRequest(w http.ResponseWriter, r *http.Request) {
+	app.ChangeRequest(w, r, models.RequestRejected, "Request rejected.")
+}
+
+// ReopenRequest put a closed request back in the queue, for its requester or fillers
+func (app *App) ReopenRequest(w http.ResponseWriter, r *http.Request) {
+	app.ChangeRequest(w, r, models.RequestOpen, "Request reopened.", models.RequestFulfilled, models.RequestRejected)
+}
+
+// ChangeRequest move a request to a new state from a posted form, optionally only from the given states
+func (app *App) ChangeRequest(w http.ResponseWriter, r *http.Request, to, done string, from ...string) {
 
 	// Load session
 	session, _ := app.Sessions.Get(r, "session-name")
 
-	// Get requested snippet id
+	// Get requested request id
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
 
 	// Parse the post data
 	err = r.ParseForm()
@@ -135,14 +291,69 @@ func (app *App) FillRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert the new request
-	reply := app.DB.FillRequest(id, r.PostForm.Get("bookid"))
-	if reply == "" {
+	request, err := app.DB.GetRequest(id)
+	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
+	if request == nil {
+		app.NotFound(w)
+		return
+	}
 
-	session.AddFlash("Request filled!", "default")
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Requesters can reopen their own requests, everything else needs the fill permission
+	if !app.Can(user, models.PermFillRequest) && !(to == models.RequestOpen && request.Requester == user.Username && request.Status != models.RequestClaimed) {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	change := models.RequestChange{
+		Actor:        user.Username,
+		To:           to,
+		BookID:       strings.TrimSpace(r.PostForm.Get("bookid")),
+		Reason:       r.PostForm.Get("reason"),
+		Note:         strings.TrimSpace(r.PostForm.Get("note")),
+		ClaimExpires: time.Now().UTC().Add(app.ClaimTimeout),
+	}
+
+	// Check the details the new state needs
+	flash := done
+	switch {
+	case len(from) > 0 && !containsString(from, request.Status):
+		flash = models.ErrRequestTransition.Error()
+	case to == models.RequestFulfilled && change.BookID == "":
+		flash = "A book id is needed to fill a request."
+	case to == models.RequestRejected && !containsString(models.RejectReasons, change.Reason):
+		flash = "Pick a reason for rejecting the request."
+	default:
+
+		// Make sure the book being linked exists
+		if to == models.RequestFulfilled {
+			book, err := app.DB.GetBook(change.BookID)
+			if err != nil {
+				app.ServerError(w, err)
+				return
+			}
+			if book == nil {
+				flash = fmt.Sprintf("There's no book with the id %s.", change.BookID)
+				break
+			}
+			err = app.FulfilRequest(id, user.Username, book.VolumeID, change.Note)
+		} else {
+			err = app.DB.TransitionRequest(id, change)
+		}
+		if err == models.ErrRequestTransition || err == models.ErrRequestClaimed {
+			flash = err.Error()
+		} else if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
+	session.AddFlash(flash, "default")
 
 	// Save session
 	err = session.Save(r, w)
@@ -155,11 +366,57 @@ func (app *App) FillRequest(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/request/%d", id), http.StatusSeeOther)
 }
 
+// FulfilRequest link a request to a book and let the requester know
+func (app *App) FulfilRequest(id int, actor, volumeID, note string) error {
+
+	err := app.DB.TransitionRequest(id, models.RequestChange{
+		Actor:  actor,
+		To:     models.RequestFulfilled,
+		BookID: volumeID,
+		Note:   note,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := app.DB.GetRequest(id)
+	if err != nil {
+		return err
+	}
+
+	// Let the requester know unless they filled it themselves
+	text := fmt.Sprintf("Your request #%d \"%s\" was filled", id, request.Title)
+	app.Notify(request.Requester, models.NotifyRequestFilled, actor, text, fmt.Sprintf("/book/%s", volumeID))
+
+	app.FireWebhook(models.HookRequestFilled, fmt.Sprintf("/request/%d", id), request)
+
+	return nil
+}
+
+// ReleaseClaims periodically reopen requests whose claim has run out
+func (app *App) ReleaseClaims(interval time.Duration) {
+	for {
+		err := app.DB.ReleaseExpiredClaims()
+		if err != nil {
+			log.Printf("Unable to release request claims: %s", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
+
 // ListAllRequests displays all the requests
 func (app *App) ListAllRequests(w http.ResponseWriter, r *http.Request) {
 
-	// Get the requests from the db
-	requests, err := app.DB.LatestRequests(1000)
+	// Get the requests from the db, most wanted first unless asked otherwise
+	sort := r.URL.Query().Get("sort")
+	var requests models.Requests
+	var err error
+	if sort == "latest" {
+		requests, err = app.DB.LatestRequests(1000)
+	} else {
+		sort = "demand"
+		requests, err = app.DB.RequestsByDemand(1000)
+	}
 	if err != nil {
 		app.ServerError(w, err)
 		return
@@ -168,5 +425,75 @@ func (app *App) ListAllRequests(w http.ResponseWriter, r *http.Request) {
 	// Display all requests
 	app.RenderHTML(w, r, "showrequests.page.html", &HTMLData{
 		Requests: requests,
+		Sort:     sort,
 	})
 }
+
+// VoteRequest toggle the current users vote on a request
+func (app *App) VoteRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get requested request id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return
+	}
+
+	// Make sure the request exists
+	request, err := app.DB.GetRequest(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if request == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	voted, err := app.DB.VoteRequest(id, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if voted {
+		session.AddFlash("You want this too!", "default")
+	} else {
+		session.AddFlash("Your vote was removed.", "default")
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Send user back to the request
+	http.Redirect(w, r, fmt.Sprintf("/request/%d", id), http.StatusSeeOther)
+}
+
+// SimilarRequests find open requests whose title looks like the given one
+func (app *App) SimilarRequests(title string) (models.Requests, error) {
+
+	open, err := app.DB.OpenRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	similar := models.Requests{}
+	for _, request := range open {
+		if fuzzy.Match(title, request.Title) {
+			similar = append(similar, request)
+		}
+	}
+
+	return similar, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// ReviewDetail a review along with its earlier versions
+type ReviewDetail struct {
+	Review *models.Review       `json:"review"`
+	Edits  []*models.ReviewEdit `json:"edits"`
+}
+
+// ReviewChanged answer a review change, with the review as json for api clients or a flash and redirect
+func (app *App) ReviewChanged(w http.ResponseWriter, r *http.Request, id int, flash, next string) {
+
+	if WantsJSON(r) {
+		review, err := app.DB.GetReviewByID(id)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		JSONResponse(w, http.StatusOK, review)
+		return
+	}
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	session.AddFlash(flash, "default")
+
+	// Save session
+	err := session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// requestedReview load the review named in the url, writing the error response when there isn't one
+func (app *App) requestedReview(w http.ResponseWriter, r *http.Request) *models.Review {
+
+	// Get requested review id
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil || id < 1 {
+		app.NotFound(w)
+		return nil
+	}
+
+	review, err := app.DB.GetReviewByID(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return nil
+	}
+	if review == nil {
+		app.NotFound(w)
+		return nil
+	}
+
+	// Hidden reviews are only seen by their author and moderators
+	_, user := app.LoggedIn(r)
+	if review.Hidden && review.Username != user.Username && !app.Can(user, models.PermModerateReviews) {
+		app.NotFound(w)
+		return nil
+	}
+
+	return review
+}
+
+// MarkHelpful flag the reviews of a book the user voted helpful
+func (app *App) MarkHelpful(reviews models.Reviews, bookid string, user *models.User) error {
+
+	votes, err := app.DB.HelpfulVotes(bookid, user.Username)
+	if err != nil {
+		return err
+	}
+	for _, review := range reviews {
+		review.Voted = votes[review.ID]
+	}
+
+	return nil
+}
+
+// ListReviews send the reviews of a book as json
+func (app *App) ListReviews(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested book id
+	vars := mux.Vars(r)
+	id := vars["volumeid"]
+
+	book, err := app.DB.GetBook(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if book == nil {
+		app.NotFound(w)
+		return
+	}
+
+	// Moderators see hidden reviews too
+	_, user := app.LoggedIn(r)
+	reviews, err := app.DB.LatestReviews(id, 1000, app.Can(user, models.PermModerateReviews), r.URL.Query().Get("sort"))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Mark the ones the user found helpful
+	err = app.MarkHelpful(reviews, id, user)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	JSONResponse(w, http.StatusOK, reviews)
+}
+
+// ShowReview display a review with its history, and the edit form for its author
+func (app *App) ShowReview(w http.ResponseWriter, r *http.Request) {
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	edits, err := app.DB.GetReviewEdits(review.ID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, ReviewDetail{Review: review, Edits: edits})
+		return
+	}
+
+	app.RenderHTML(w, r, "showreview.page.html", &HTMLData{
+		Review: &ReviewDetail{Review: review, Edits: edits},
+		Form: &forms.NewReview{
+			ID:       review.ID,
+			BookID:   review.BookID,
+			Username: review.Username,
+			Rating:   strconv.Itoa(review.Rating),
+			Review:   review.Review,
+		},
+	})
+}
+
+// UpdateReview save changes to a users own review
+func (app *App) UpdateReview(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	// Only the author can edit
+	_, user := app.LoggedIn(r)
+	if review.Username != user.Username {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	form := &forms.NewReview{
+		ID:       review.ID,
+		BookID:   review.BookID,
+		Username: review.Username,
+		Rating:   r.PostForm.Get("rating"),
+		Review:   r.PostForm.Get("review"),
+	}
+	if !form.Valid() {
+		if WantsJSON(r) {
+			JSONResponse(w, http.StatusBadRequest, form.Failures)
+			return
+		}
+		edits, err := app.DB.GetReviewEdits(review.ID)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		app.RenderHTML(w, r, "showreview.page.html", &HTMLData{
+			Review: &ReviewDetail{Review: review, Edits: edits},
+			Form:   form,
+		})
+		return
+	}
+
+	err = app.DB.UpdateReview(review.ID, form.Stars(), form.Review)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.ReviewChanged(w, r, review.ID, "Your review was updated.", fmt.Sprintf("/book/%s", review.BookID))
+}
+
+// DeleteReview remove a users own review
+func (app *App) DeleteReview(w http.ResponseWriter, r *http.Request) {
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	// Only the author can delete
+	_, user := app.LoggedIn(r)
+	if review.Username != user.Username {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	err := app.DB.DeleteReview(review.ID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, "")
+		return
+	}
+
+	app.ReviewChanged(w, r, review.ID, "Your review was deleted.", fmt.Sprintf("/book/%s", review.BookID))
+}
+
+// HideReview hide or unhide a review from everyone but its author
+func (app *App) HideReview(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	hidden := r.PostForm.Get("hidden") != "0"
+	err = app.DB.HideReview(review.ID, hidden)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	flash := "Review hidden."
+	if !hidden {
+		flash = "Review shown again."
+	}
+
+	app.ReviewChanged(w, r, review.ID, flash, fmt.Sprintf("/book/%s", review.BookID))
+}
+
+// HelpfulReview toggle the current users helpful vote on a review
+func (app *App) HelpfulReview(w http.ResponseWriter, r *http.Request) {
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Authors can't vote up their own review
+	if review.Username == user.Username {
+		app.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	voted, err := app.DB.VoteReview(review.ID, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	flash := "Thanks, you found this review helpful."
+	if !voted {
+		flash = "Your helpful vote was removed."
+	}
+
+	app.ReviewChanged(w, r, review.ID, flash, fmt.Sprintf("/book/%s", review.BookID))
+}
+
+// ReportReview send a review to the moderation queue
+func (app *App) ReportReview(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	form := &forms.ReviewReport{
+		ReviewID: review.ID,
+		Reporter: user.Username,
+		Reason:   r.PostForm.Get("reason"),
+		Note:     r.PostForm.Get("note"),
+	}
+
+	var flash string
+	if !form.Valid() {
+		if WantsJSON(r) {
+			JSONResponse(w, http.StatusBadRequest, form.Failures)
+			return
+		}
+		flash = form.Failures["Reason"]
+		if flash == "" {
+			flash = form.Failures["Note"]
+		}
+	} else {
+		added, err := app.DB.ReportReview(review.ID, form.Reporter, form.Reason, form.Note)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		flash = "Thanks, a moderator will take a look."
+		if !added {
+			flash = "You already reported this review."
+		}
+	}
+
+	app.ReviewChanged(w, r, review.ID, flash, fmt.Sprintf("/book/%s", review.BookID))
+}
+
+// ReviewQueue list the reported reviews waiting on a moderator
+func (app *App) ReviewQueue(w http.ResponseWriter, r *http.Request) {
+
+	reports, err := app.DB.OpenReports()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, reports)
+		return
+	}
+
+	app.RenderHTML(w, r, "reviewqueue.page.html", &HTMLData{
+		Reports: reports,
+	})
+}
+
+// ResolveReports deal with the reports on a review by dismissing them, hiding the review or deleting it
+func (app *App) ResolveReports(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	review := app.requestedReview(w, r)
+	if review == nil {
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Act on the review, deleting it takes its reports along
+	action := r.PostForm.Get("action")
+	switch action {
+	case "dismiss":
+		err = app.DB.ResolveReports(review.ID, user.Username, action)
+	case "hide":
+		err = app.DB.HideReview(review.ID, true)
+		if err == nil {
+			err = app.DB.ResolveReports(review.ID, user.Username, action)
+		}
+	case "delete":
+		err = app.DB.DeleteReview(review.ID)
+	default:
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if WantsJSON(r) {
+		JSONResponse(w, http.StatusOK, "")
+		return
+	}
+
+	session.AddFlash(fmt.Sprintf("Reports on the review by %s resolved (%s).", review.Username, action), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reviews", http.StatusSeeOther)
+}
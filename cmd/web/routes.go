@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
 // Routes define the site routes
@@ -17,33 +18,96 @@ func (app *App) Routes() *mux.Router {
 	r.Handle("/about", app.RequireLogin(http.HandlerFunc(app.About))).Methods("GET")
 
 	// Requests
-	r.Handle("/request/all", app.RequireLogin(http.HandlerFunc(app.ListAllRequests))).Methods("GET")
+	r.Handle("/request/all", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ListAllRequests)))).Methods("GET")
 	r.Handle("/request/new", app.RequireLogin(http.HandlerFunc(app.NewRequest))).Methods("GET")
-	r.Handle("/request/new", app.RequireLogin(http.HandlerFunc(app.CreateRequest))).Methods("POST")
-	r.Handle("/request/{id}", app.RequireLogin(http.HandlerFunc(app.ShowRequest))).Methods("GET")
-	r.Handle("/request/{id}/fill", app.RequireWriter(http.HandlerFunc(app.FillRequest))).Methods("POST")
+	r.Handle("/request/new", app.AllowToken(models.ScopeManageRequests, app.RequireLogin(http.HandlerFunc(app.CreateRequest)))).Methods("POST")
+	r.Handle("/request/{id}", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ShowRequest)))).Methods("GET")
+	r.Handle("/request/{id}/vote", app.AllowToken(models.ScopeManageRequests, app.RequireLogin(http.HandlerFunc(app.VoteRequest)))).Methods("POST")
+	r.Handle("/request/{id}/fill", app.AllowToken(models.ScopeManageRequests, app.RequirePermission(models.PermFillRequest, http.HandlerFunc(app.FillRequest)))).Methods("POST")
+	r.Handle("/request/{id}/claim", app.AllowToken(models.ScopeManageRequests, app.RequirePermission(models.PermFillRequest, http.HandlerFunc(app.ClaimRequest)))).Methods("POST")
+	r.Handle("/request/{id}/unclaim", app.AllowToken(models.ScopeManageRequests, app.RequirePermission(models.PermFillRequest, http.HandlerFunc(app.UnclaimRequest)))).Methods("POST")
+	r.Handle("/request/{id}/reject", app.AllowToken(models.ScopeManageRequests, app.RequirePermission(models.PermFillRequest, http.HandlerFunc(app.RejectRequest)))).Methods("POST")
+	r.Handle("/request/{id}/reopen", app.AllowToken(models.ScopeManageRequests, app.RequireLogin(http.HandlerFunc(app.ReopenRequest)))).Methods("POST")
+
+	// Comments
+	r.Handle("/comment/new", app.RequireLogin(http.HandlerFunc(app.CreateComment))).Methods("POST")
+	r.Handle("/comment/{id}/edit", app.RequireLogin(http.HandlerFunc(app.EditComment))).Methods("GET")
+	r.Handle("/comment/{id}/edit", app.RequireLogin(http.HandlerFunc(app.UpdateComment))).Methods("POST")
+	r.Handle("/comment/{id}/delete", app.RequireLogin(http.HandlerFunc(app.DeleteComment))).Methods("POST")
 
 	// Books
-	r.Handle("/book/all", app.RequireLogin(http.HandlerFunc(app.ListAllBooks))).Methods("GET")
-	r.Handle("/book/review", app.RequireLogin(http.HandlerFunc(app.CreateReview))).Methods("POST")
+	r.Handle("/book/all", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ListAllBooks)))).Methods("GET")
+	r.Handle("/book/review", app.AllowToken(models.ScopeReviews, app.RequireLogin(http.HandlerFunc(app.CreateReview)))).Methods("POST")
+	r.Handle("/book/review/{id}", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ShowReview)))).Methods("GET")
+	r.Handle("/book/review/{id}/edit", app.AllowToken(models.ScopeReviews, app.RequireLogin(http.HandlerFunc(app.UpdateReview)))).Methods("POST")
+	r.Handle("/book/review/{id}/delete", app.AllowToken(models.ScopeReviews, app.RequireLogin(http.HandlerFunc(app.DeleteReview)))).Methods("POST")
+	r.Handle("/book/review/{id}/hide", app.AllowToken(models.ScopeReviews, app.RequirePermission(models.PermModerateReviews, http.HandlerFunc(app.HideReview)))).Methods("POST")
+	r.Handle("/book/review/{id}/helpful", app.AllowToken(models.ScopeReviews, app.RequireLogin(http.HandlerFunc(app.HelpfulReview)))).Methods("POST")
+	r.Handle("/book/review/{id}/report", app.AllowToken(models.ScopeReviews, app.RequireLogin(http.HandlerFunc(app.ReportReview)))).Methods("POST")
+	r.Handle("/book/{volumeid}/reviews", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ListReviews)))).Methods("GET")
 	r.Handle("/book/edit", app.RequireLogin(http.HandlerFunc(app.UpdateBook))).Methods("POST")
 	r.Handle("/book/edit/{volumeid}", app.RequireLogin(http.HandlerFunc(app.EditBook))).Methods("GET")
 	r.Handle("/book/collect/{volumeid}", app.RequireLogin(http.HandlerFunc(app.AddToCollection))).Methods("POST")
-	r.Handle("/book/{volumeid}", app.RequireLogin(http.HandlerFunc(app.ShowBook))).Methods("GET")
-	r.Handle("/book/{volumeid}", app.RequireLogin(http.HandlerFunc(app.DownloadBook))).Methods("POST")
-	r.Handle("/write/book", app.RequireWriter(http.HandlerFunc(app.NewBook))).Methods("GET")
-	r.Handle("/write/book", app.RequireWriter(http.HandlerFunc(app.CreateBook))).Methods("POST")
+	r.Handle("/book/{volumeid}", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ShowBook)))).Methods("GET")
+	r.Handle("/book/{volumeid}", app.AllowToken(models.ScopeDownload, app.RequireLogin(http.HandlerFunc(app.DownloadBook)))).Methods("POST")
+	r.Handle("/book/delete/{volumeid}", app.RequirePermission(models.PermDeleteBook, http.HandlerFunc(app.DeleteBook))).Methods("POST")
+	r.Handle("/book/matches/{volumeid}", app.RequirePermission(models.PermFillRequest, http.HandlerFunc(app.ShowMatches))).Methods("GET")
+	r.Handle("/write/book", app.RequirePermission(models.PermUpload, http.HandlerFunc(app.NewBook))).Methods("GET")
+	r.Handle("/write/book", app.AllowToken(models.ScopeUpload, app.RequirePermission(models.PermUpload, http.HandlerFunc(app.CreateBook)))).Methods("POST")
 
 	// Messages
-	r.Handle("/messages/{reciver}", app.RequireLogin(http.HandlerFunc(app.Messages))).Methods("GET")
-	r.Handle("/messages/{reciver}", app.RequireLogin(http.HandlerFunc(app.CreateMessage))).Methods("POST")
+	r.Handle("/notifications", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.ShowNotifications)))).Methods("GET")
+	r.Handle("/notifications/read", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.ReadNotifications)))).Methods("POST")
+	r.Handle("/notifications/preferences", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.UpdateNotificationPreferences)))).Methods("POST")
+	r.Handle("/notifications/email", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.UpdateEmailFrequency)))).Methods("POST")
+	r.HandleFunc("/unsubscribe", app.Unsubscribe).Methods("GET")
+	r.HandleFunc("/unsubscribe", app.ConfirmUnsubscribe).Methods("POST")
+	r.Handle("/notifications/{id:[0-9]+}", app.RequireLogin(http.HandlerFunc(app.OpenNotification))).Methods("GET")
+	r.Handle("/messages/share", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.ShareToConversation)))).Methods("POST")
+	r.Handle("/messages/group/new", app.RequireLogin(http.HandlerFunc(app.NewGroup))).Methods("GET")
+	r.Handle("/messages/group/new", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.CreateGroup)))).Methods("POST")
+	r.Handle("/messages/c/{id:[0-9]+}", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.ShowConversation)))).Methods("GET")
+	r.Handle("/messages/c/{id:[0-9]+}", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.PostToConversation)))).Methods("POST")
+	r.Handle("/messages/c/{id:[0-9]+}/read", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.MarkRead)))).Methods("POST")
+	r.Handle("/messages/c/{id:[0-9]+}/typing", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.Typing)))).Methods("POST")
+	r.Handle("/messages/c/{id:[0-9]+}/participants", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.AddParticipant)))).Methods("POST")
+	r.Handle("/messages/c/{id:[0-9]+}/participants/remove", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.RemoveParticipant)))).Methods("POST")
+	r.Handle("/messages/m/{id:[0-9]+}/delete", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.DeleteMessage)))).Methods("POST")
+	r.Handle("/messages/{reciver}", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.Messages)))).Methods("GET")
+	r.Handle("/messages/{reciver}", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.CreateMessage)))).Methods("POST")
+	r.Handle("/messages/{reciver}/read", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.MarkRead)))).Methods("POST")
+	r.Handle("/messages/{reciver}/typing", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.Typing)))).Methods("POST")
+	r.Handle("/events", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.Events)))).Methods("GET")
 
 	// Announcements
-	r.Handle("/announcement/new", app.RequireWriter(http.HandlerFunc(app.NewAnnouncement))).Methods("GET")
-	r.Handle("/announcement/new", app.RequireWriter(http.HandlerFunc(app.CreateAnnouncement))).Methods("POST")
+	r.Handle("/announcement/new", app.RequirePermission(models.PermPostAnnouncement, http.HandlerFunc(app.NewAnnouncement))).Methods("GET")
+	r.Handle("/announcement/new", app.RequirePermission(models.PermPostAnnouncement, http.HandlerFunc(app.CreateAnnouncement))).Methods("POST")
+	r.Handle("/announcement/{id:[0-9]+}/edit", app.RequirePermission(models.PermPostAnnouncement, http.HandlerFunc(app.EditAnnouncement))).Methods("GET")
+	r.Handle("/announcement/{id:[0-9]+}/edit", app.RequirePermission(models.PermPostAnnouncement, http.HandlerFunc(app.UpdateAnnouncement))).Methods("POST")
+	r.Handle("/announcement/{id:[0-9]+}/delete", app.RequirePermission(models.PermPostAnnouncement, http.HandlerFunc(app.DeleteAnnouncement))).Methods("POST")
+	r.Handle("/announcement/{id:[0-9]+}/dismiss", app.RequireLogin(http.HandlerFunc(app.DismissAnnouncement))).Methods("POST")
+	r.Handle("/announcements", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ShowAnnouncements)))).Methods("GET")
+
+	// Admin
+	r.Handle("/admin/roles", app.RequirePermission(models.PermManageUsers, http.HandlerFunc(app.ShowRoles))).Methods("GET")
+	r.Handle("/admin/roles", app.RequirePermission(models.PermManageUsers, http.HandlerFunc(app.UpdateRole))).Methods("POST")
+	r.Handle("/admin/roles/new", app.RequirePermission(models.PermManageUsers, http.HandlerFunc(app.CreateRole))).Methods("POST")
+	r.Handle("/admin/reviews", app.AllowToken(models.ScopeReviews, app.RequirePermission(models.PermModerateReviews, http.HandlerFunc(app.ReviewQueue)))).Methods("GET")
+	r.Handle("/admin/reviews/{id}", app.AllowToken(models.ScopeReviews, app.RequirePermission(models.PermModerateReviews, http.HandlerFunc(app.ResolveReports)))).Methods("POST")
+	r.Handle("/admin/webhooks", app.RequirePermission(models.PermManageWebhooks, http.HandlerFunc(app.ShowWebhooks))).Methods("GET")
+	r.Handle("/admin/webhooks", app.RequirePermission(models.PermManageWebhooks, http.HandlerFunc(app.CreateWebhook))).Methods("POST")
+	r.Handle("/admin/webhooks/{id:[0-9]+}", app.RequirePermission(models.PermManageWebhooks, http.HandlerFunc(app.ShowWebhook))).Methods("GET")
+	r.Handle("/admin/webhooks/{id:[0-9]+}", app.RequirePermission(models.PermManageWebhooks, http.HandlerFunc(app.UpdateWebhook))).Methods("POST")
+	r.Handle("/admin/webhooks/{id:[0-9]+}/delete", app.RequirePermission(models.PermManageWebhooks, http.HandlerFunc(app.DeleteWebhook))).Methods("POST")
+	r.Handle("/admin/webhooks/deliveries/{id:[0-9]+}/redeliver", app.RequirePermission(models.PermManageWebhooks, http.HandlerFunc(app.RedeliverWebhook))).Methods("POST")
+	r.Handle("/admin/invites", app.RequirePermission(models.PermManageUsers, http.HandlerFunc(app.ShowInviteTree))).Methods("GET")
+	r.Handle("/admin/invites/prune", app.RequirePermission(models.PermManageUsers, http.HandlerFunc(app.PruneInvites))).Methods("POST")
+	r.Handle("/admin/users/role", app.RequirePermission(models.PermManageUsers, http.HandlerFunc(app.AssignRole))).Methods("POST")
 
 	r.Handle("/token/get", http.HandlerFunc(app.GetJWT)).Methods("GET")
 	r.Handle("/token/validate", http.HandlerFunc(app.ValidateToken)).Methods("GET")
+	r.Handle("/token/refresh", http.HandlerFunc(app.RefreshJWT)).Methods("POST")
+	r.Handle("/token/revoke", http.HandlerFunc(app.RevokeJWT)).Methods("POST")
 
 	// Youtube
 	r.Handle("/youtube/playlist", app.RequireLogin(http.HandlerFunc(app.NewPlaylist))).Methods("GET")
@@ -54,9 +118,23 @@ func (app *App) Routes() *mux.Router {
 	r.HandleFunc("/user/signup", app.CreateUser).Methods("POST")
 	r.HandleFunc("/user/login", app.LoginUser).Methods("GET")
 	r.HandleFunc("/user/login", app.VerifyUser).Methods("POST")
+	r.HandleFunc("/user/oidc/login", app.OIDCLogin).Methods("GET")
+	r.HandleFunc("/user/oidc/callback", app.OIDCCallback).Methods("GET")
+	r.HandleFunc("/user/verify", app.ConfirmEmail).Methods("GET")
+	r.HandleFunc("/user/verify/resend", app.ResendVerification).Methods("POST")
 	r.HandleFunc("/user/logout", app.LogoutUser).Methods("GET")
 	r.Handle("/user/invite/create", app.RequireLogin(http.HandlerFunc(app.CreateInviteCode))).Methods("POST")
-	r.Handle("/user/{username}", app.RequireLogin(http.HandlerFunc(app.ShowUser))).Methods("GET")
+	r.Handle("/user/invite/{code}/revoke", app.RequireLogin(http.HandlerFunc(app.RevokeInviteCode))).Methods("POST")
+	r.Handle("/user/token/create", app.RequireLogin(http.HandlerFunc(app.CreateAPIToken))).Methods("POST")
+	r.Handle("/user/token/{id}/delete", app.RequireLogin(http.HandlerFunc(app.DeleteAPIToken))).Methods("POST")
+	r.Handle("/user/profile", app.RequireLogin(http.HandlerFunc(app.EditProfile))).Methods("GET")
+	r.Handle("/user/profile", app.RequireLogin(http.HandlerFunc(app.UpdateProfile))).Methods("POST")
+	r.Handle("/user/export", app.RequireLogin(http.HandlerFunc(app.CreateDataExport))).Methods("POST")
+	r.Handle("/user/export/{id}", app.RequireLogin(http.HandlerFunc(app.DownloadDataExport))).Methods("GET")
+	r.Handle("/user/delete", app.RequireLogin(http.HandlerFunc(app.DeleteAccount))).Methods("POST")
+	r.Handle("/user/{username}/avatar", app.RequireLogin(http.HandlerFunc(app.ShowAvatar))).Methods("GET")
+	r.Handle("/user/{username}/{filter:block|mute}", app.AllowToken(models.ScopeMessages, app.RequireLogin(http.HandlerFunc(app.FilterUser)))).Methods("POST")
+	r.Handle("/user/{username}", app.AllowToken(models.ScopeReadCatalog, app.RequireLogin(http.HandlerFunc(app.ShowUser)))).Methods("GET")
 
 	// Hosting static files
 
@@ -134,23 +134,71 @@ func (app *App) FindObject(bucket, key string) (string, error) {
 
 	var mismatch string
 
+	keys, err := app.FindObjects(bucket, key)
+	if err != nil || len(keys) == 0 {
+		return mismatch, err
+	}
+
+	return keys[0], nil
+}
+
+// FindObjects get every object with the name, in any format
+func (app *App) FindObjects(bucket, key string) ([]string, error) {
+
+	var found []string
+
 	// Connection to s3 server
 	storageConnection := s3.New(app.Storage)
 
-	// Upload a new object
-	resp, err := storageConnection.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	// List the objects sharing the name
+	resp, err := storageConnection.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	})
 	if err != nil {
-		return mismatch, err
+		return found, err
 	}
 
 	for _, item := range resp.Contents {
 		id := strings.Split(*item.Key, ".")[0]
 		if id == key {
-			log.Printf("Found key %s", id)
-			return *item.Key, nil
+			log.Printf("Found key %s", *item.Key)
+			found = append(found, *item.Key)
 		}
 	}
 
 	// Return no error
-	return mismatch, nil
+	return found, nil
+}
+
+// PreferredObject pick the object in a format, or the first one
+func PreferredObject(keys []string, format string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	for _, key := range keys {
+		if format != "" && strings.HasSuffix(key, "."+format) {
+			return key
+		}
+	}
+	return keys[0]
+}
+
+// DeleteObject remove an object from a bucket
+func (app *App) DeleteObject(bucket, key string) error {
+
+	// Connection to s3 server
+	storageConnection := s3.New(app.Storage)
+
+	// Delete the object
+	_, err := storageConnection.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Return no error
+	return nil
 }
@@ -4,13 +4,24 @@ import (
 	"fmt"
 	// "encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/gorilla/mux"
 	"github.com/rssnyder/louieslibrary/pkg/forms"
 	"github.com/rssnyder/louieslibrary/pkg/models"
+	"gopkg.in/guregu/null.v4"
 )
 
+// UserProfile is the json structure for a user page
+type UserProfile struct {
+	User       *models.User     `json:"user"`
+	Reviews    []*models.Review `json:"reviews"`
+	Collection []*models.Book   `json:"collection"`
+}
+
 // UserLogin holds login data
 type UserLogin struct {
 	Username string `json:"username"`
@@ -20,7 +31,9 @@ type UserLogin struct {
 // SignupUser display the signup form
 func (app *App) SignupUser(w http.ResponseWriter, r *http.Request) {
 	app.RenderHTML(w, r, "signup.page.html", &HTMLData{
-		Form: &forms.NewUser{},
+		Form: &forms.NewUser{
+			InviteCode: r.URL.Query().Get("invitecode"),
+		},
 	})
 }
 
@@ -40,7 +53,7 @@ func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
 	// Model the new user based on html form
 	form := &forms.NewUser{
 		Username:   r.PostForm.Get("username"),
-		Email:      r.PostForm.Get("email"),
+		Email:      strings.TrimSpace(r.PostForm.Get("email")),
 		InviteCode: r.PostForm.Get("invitecode"),
 		Password:   r.PostForm.Get("password"),
 	}
@@ -51,13 +64,13 @@ func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate request
-	used, err := app.DB.ValidateInvite(form.InviteCode)
+	// Insert the new user, using up the invite
+	valid, err := app.DB.InsertUser(form.Username, form.Email, form.Password, form.InviteCode)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
-	if used {
+	if !valid {
 		// Save failure message
 		session.AddFlash("Invalid invite code.", "default")
 
@@ -72,21 +85,14 @@ func (app *App) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert the new user
-	err = app.DB.InsertUser(form.Username, form.Email, form.Password)
-	if err != nil {
-		app.ServerError(w, err)
-		return
-	}
-
-	// Fill invite
-	err = app.DB.FillInvite(form.Username, form.InviteCode)
+	// Confirm the email address before first login
+	err = app.SendVerification(form.Username, form.Email)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
 
-	session.AddFlash("Your account was created successfully! Please login.", "default")
+	session.AddFlash("Your account was created successfully! Check your email for a link to confirm your address, then login.", "default")
 
 	// Save session
 	err = session.Save(r, w)
@@ -132,9 +138,6 @@ func (app *App) LoginUser(w http.ResponseWriter, r *http.Request) {
 // VerifyUser authenticates a user
 func (app *App) VerifyUser(w http.ResponseWriter, r *http.Request) {
 
-	// Load session
-	session, _ := app.Sessions.Get(r, "session-name")
-
 	// Parse the post data
 	err := r.ParseForm()
 	if err != nil {
@@ -165,25 +168,24 @@ func (app *App) VerifyUser(w http.ResponseWriter, r *http.Request) {
 	user, err = app.DB.AuthenticateUser(userLogin.Username, userLogin.Password)
 
 	if cmp.Equal(user, fail) {
+		app.loginFailed(w, r, "Invalid Login")
+		return
+	}
 
-		session.AddFlash("Invalid Login", "default")
+	// Email must be confirmed first
+	if !user.EmailVerified {
+		app.loginFailed(w, r, "Please confirm your email address first, use the link we sent you.")
+		return
+	}
 
-		// Save session
-		err = session.Save(r, w)
-		if err != nil {
-			app.ServerError(w, err)
-			return
-		}
+	app.StartSession(w, r, user)
+}
 
-		// Redirect to login page
-		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+// StartSession log a user in and send them to the homepage
+func (app *App) StartSession(w http.ResponseWriter, r *http.Request, user *models.User) {
 
-		// Invalid login attempt
-		// w.Header().Set("Content-Type", "application/json")
-		// w.WriteHeader(http.StatusOK)
-		// json.NewEncoder(w).Encode("{'error':'yes'}")
-		// return
-	}
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
 
 	// Get signed JWT
 	token, err := app.SignJWT(user.Username, user.Role)
@@ -215,6 +217,8 @@ func (app *App) LogoutUser(w http.ResponseWriter, r *http.Request) {
 
 	// Set user session to empty user
 	session.Values["user"] = &models.User{}
+	delete(session.Values, "sso_user")
+	delete(session.Values, "sso_at")
 
 	// Save session
 	err := session.Save(r, w)
@@ -265,9 +269,43 @@ func (app *App) ShowUser(w http.ResponseWriter, r *http.Request) {
 	// Get current user
 	_, currentUser := app.LoggedIn(r)
 
+	// Email is only shown to its owner
+	if username != currentUser.Username {
+		user.Email = ""
+	}
+
+	// Who the viewer has blocked and muted
+	blocked, err := app.DB.GetFilters(currentUser.Username, models.FilterBlock)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	muted, err := app.DB.GetFilters(currentUser.Username, models.FilterMute)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	// Api clients get the profile as json
+	if WantsJSON(r) {
+		JSONResponse(w, 200, UserProfile{
+			User:       user,
+			Reviews:    reviews,
+			Collection: collection,
+		})
+		return
+	}
+
 	// If a user is viewing their own page
 	if username == currentUser.Username {
 
+		// Get remaining invites
+		allowance, err := app.InviteAllowance(currentUser)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
 		// Get current invites from db
 		invites, err := app.DB.GetInvites(username)
 		if err != nil {
@@ -275,12 +313,40 @@ func (app *App) ShowUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Display user page with invites
+		// Get api tokens
+		tokens, err := app.DB.GetAPITokens(username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		// Get data exports
+		exports, err := app.DB.GetDataExports(username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		// Linked accounts confirm deletion by signing in again
+		linked, err := app.DB.HasIdentity(username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+
+		// Display user page with invites and tokens
 		app.RenderHTML(w, r, "showuser.page.html", &HTMLData{
 			DisplayUser: user,
+			Linked:      linked,
 			Invites:     invites,
+			InvitesLeft: allowance,
+			APITokens:   tokens,
+			DataExports: exports,
+			Scopes:      models.Scopes,
 			Reviews:     reviews,
 			Books:       collection,
+			Blocked:     blocked,
+			Muted:       muted,
 		})
 	} else {
 
@@ -289,6 +355,8 @@ func (app *App) ShowUser(w http.ResponseWriter, r *http.Request) {
 			DisplayUser: user,
 			Reviews:     reviews,
 			Books:       collection,
+			Blocked:     blocked,
+			Muted:       muted,
 		})
 	}
 }
@@ -296,10 +364,57 @@ func (app *App) ShowUser(w http.ResponseWriter, r *http.Request) {
 // CreateInviteCode generate an invite code for new users
 func (app *App) CreateInviteCode(w http.ResponseWriter, r *http.Request) {
 
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
 	// Get user info
 	user := &models.User{}
 	_, user = app.LoggedIn(r)
 
+	// Check the quota of the users role
+	allowed, err := app.InviteAllowance(user)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if allowed == 0 {
+		session.AddFlash("You have no invites left, more become available over time.", "default")
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+		return
+	}
+
+	// Invites expire after a number of days
+	days, err := strconv.Atoi(r.PostForm.Get("expires"))
+	if err != nil || days < 1 || days > 30 {
+		days = 7
+	}
+	expires := null.TimeFrom(time.Now().UTC().AddDate(0, 0, days))
+
+	// Optional address to send the invite to
+	email := null.NewString(strings.TrimSpace(r.PostForm.Get("email")), strings.TrimSpace(r.PostForm.Get("email")) != "")
+	if email.Valid && !forms.ValidEmail(email.String) {
+		session.AddFlash("That email address does not look right.", "default")
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+		return
+	}
+
 	// Generate invite code
 	code, err := CreateUUID()
 	if err != nil {
@@ -308,12 +423,71 @@ func (app *App) CreateInviteCode(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create a new invite
-	err = app.DB.CreateInvite(user.Username, code)
+	err = app.DB.CreateInvite(user.Username, code, email, expires)
 	if err != nil {
 		app.ServerError(w, err)
 		return
 	}
 
+	// Send the invite link
+	if email.Valid {
+		app.SendMail(email.String, fmt.Sprintf("%s invited you to Louie's Library", user.Username),
+			fmt.Sprintf("%s has invited you to join Louie's Library.\n\nSign up here before %s:\n%s\n",
+				user.Username, humanDate(expires.Time), app.Link("/user/signup?invitecode=%s", code)))
+		session.AddFlash(fmt.Sprintf("Invite sent to %s.", email.String), "default")
+		err = session.Save(r, w)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+	}
+
 	// Show user their page to display the new invite code
 	http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
 }
+
+// RevokeInviteCode revoke one of the current users unused invites
+func (app *App) RevokeInviteCode(w http.ResponseWriter, r *http.Request) {
+
+	// Get requested invite code
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	// Get user info
+	_, user := app.LoggedIn(r)
+
+	err := app.DB.RevokeInvite(code, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/user/%s", user.Username), http.StatusSeeOther)
+}
+
+// InviteAllowance how many more invites a user may create right now, -1 for unlimited
+func (app *App) InviteAllowance(user *models.User) (int, error) {
+
+	role, err := app.UserRole(user)
+	if err != nil {
+		return 0, err
+	}
+
+	// Negative quotas are unlimited
+	if role.InviteQuota < 0 {
+		return -1, nil
+	}
+
+	// Quota replenishes as invites age out of the period
+	since := time.Now().UTC().AddDate(0, 0, -role.InvitePeriod)
+	used, err := app.DB.CountInvitesSince(user.Username, since)
+	if err != nil {
+		return 0, err
+	}
+
+	if used >= role.InviteQuota {
+		return 0, nil
+	}
+
+	return role.InviteQuota - used, nil
+}
@@ -7,27 +7,121 @@ import (
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/markdown"
 	"github.com/rssnyder/louieslibrary/pkg/models"
 )
 
 // HTMLData models the page data
 type HTMLData struct {
-	Request      *models.Request
-	Requests     []*models.Request
-	User         *models.User
-	DisplayUser  *models.User
-	Book         *models.Book
-	Announcement *models.Announcement
-	Books        []*models.Book
-	Reviews      []*models.Review
-	Invites      []*models.Invite
-	Messages     []*models.Message
-	Threads      []*models.Message
-	Path         string
-	Form         interface{}
-	Flash        string
+	Request       *models.Request
+	Requests      []*models.Request
+	User          *models.User
+	DisplayUser   *models.User
+	Book          *models.Book
+	Announcement  *models.Announcement
+	Announcements []*models.Announcement
+	Banners       []*models.Announcement
+	Books         []*models.Book
+	Reviews       []*models.Review
+	Invites       []*models.Invite
+	InvitesLeft   int
+	InviteTree    []*InviteNode
+	Roles         []*models.Role
+	Users         []*models.User
+	Permissions   []string
+	Granted       *models.Role
+	APITokens     []*models.APIToken
+	DataExports   []*models.DataExport
+	Scopes        []string
+	Formats       []string
+	Messages      []*models.Message
+	Conversation  *models.Conversation
+	Conversations []*models.Conversation
+	Page          *models.MessagePage
+	Blocked       []string
+	Notifications []*models.Notification
+	Preferences   map[string]bool
+	Frequency     string
+	Webhooks      []*models.Webhook
+	Webhook       *models.Webhook
+	Deliveries    []*models.WebhookDelivery
+	Muted         []string
+	Path          string
+	Sort          string
+	Catalog       *models.CatalogQuery
+	Reasons       []string
+	Reports       []*models.ReviewReport
+	Matches       []*RequestMatch
+	Volumes       []*VolumeResponse
+	Thread        *CommentThread
+	Review        *ReviewDetail
+	SSO           bool
+	Linked        bool
+	Unread        int
+	Bell          int
+	Form          interface{}
+	Flash         string
+}
+
+// Share the send to form for a book or request
+func (data *HTMLData) Share(kind, id string) *ShareForm {
+	return &ShareForm{Type: kind, ID: id, Conversations: data.Conversations}
+}
+
+// Blocks check if the current user has blocked someone
+func (data *HTMLData) Blocks(username string) bool {
+	return containsString(data.Blocked, username)
+}
+
+// Mutes check if the current user has muted someone
+func (data *HTMLData) Mutes(username string) bool {
+	return containsString(data.Muted, username)
+}
+
+// NotificationTypes every type of notification, for the preferences form
+func (data *HTMLData) NotificationTypes() []string {
+	return models.NotificationTypes
+}
+
+// EmailFrequencies every option for how often notifications are emailed
+func (data *HTMLData) EmailFrequencies() []string {
+	return models.EmailFrequencies
+}
+
+// WebhookEvents every event a webhook can listen for
+func (data *HTMLData) WebhookEvents() []string {
+	return models.WebhookEvents
+}
+
+// Listens check if the webhook in the form is listening for an event
+func (data *HTMLData) Listens(event string) bool {
+	form, ok := data.Form.(*forms.NewWebhook)
+	return ok && containsString(form.Events, event)
+}
+
+// Severities how loud an announcement can be
+func (data *HTMLData) Severities() []string {
+	return forms.Severities
+}
+
+// Targets check if the announcement in the form is shown to a role
+func (data *HTMLData) Targets(role string) bool {
+	form, ok := data.Form.(*forms.NewAnnouncement)
+	return ok && containsString(form.Roles, role)
+}
+
+// NotificationLabel describe a type of notification
+func (data *HTMLData) NotificationLabel(kind string) string {
+	return models.NotificationLabels[kind]
+}
+
+// Can check if the current user holds a permission
+func (data *HTMLData) Can(permission string) bool {
+	return data.Granted != nil && data.Granted.Has(permission)
 }
 
 // humanDate
@@ -36,6 +130,11 @@ func humanDate(t time.Time) string {
 	return t.Format("02 Jan 2006 at 15:04")
 }
 
+// renderMarkdown format user text as html, it is escaped before any markup is added
+func renderMarkdown(text string) template.HTML {
+	return template.HTML(markdown.Render(text))
+}
+
 // RenderHTML display the current page based on htmldata
 func (app *App) RenderHTML(w http.ResponseWriter, r *http.Request, page string, data *HTMLData) {
 
@@ -50,26 +149,73 @@ func (app *App) RenderHTML(w http.ResponseWriter, r *http.Request, page string,
 	// Add the current path to the data
 	data.Path = r.URL.Path
 
+	// Offer single sign-on when configured
+	data.SSO = app.OIDC != nil
+
 	// Check logged in status
 	user := &models.User{}
 	_, user = app.LoggedIn(r)
 	data.User = user
 
-	// Get unread messages
-	unread, err := app.DB.GetUnopened(user.Username)
-	if len(unread) != 0 {
-		session.AddFlash("You have new messages!", "default")
+	// Permissions of the current user
+	data.Granted = &models.Role{Name: user.Role}
+	if user.ID != 0 {
+		granted, err := app.UserRole(user)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		data.Granted = granted
+	}
+
+	// Count unread messages and notifications for the badges, kept current by /events
+	if user.ID != 0 {
+		unread, err := app.DB.CountUnread(user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		data.Unread = unread
+
+		bell, err := app.DB.CountUnreadNotifications(user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		data.Bell = bell
+
+		// Announcement banners for this user
+		banners, err := app.DB.ActiveAnnouncements(user.Username, user.Role)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		data.Banners = banners
+
+		// Remember the visit so digests only cover what is new
+		err = app.DB.TouchUser(user.Username)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
 	}
 
-	// Render the base template with target page
+	// Render the base template with target page and shared partials
 	files := []string{
 		filepath.Join(app.HTMLDir, "base.html"),
 		filepath.Join(app.HTMLDir, page),
 	}
+	partials, err := filepath.Glob(filepath.Join(app.HTMLDir, "*.partial.html"))
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	files = append(files, partials...)
 
 	// Map for custome template functions
 	fm := template.FuncMap{
 		"humanDate": humanDate,
+		"markdown":  renderMarkdown,
 	}
 
 	// Pull the html files together
@@ -103,6 +249,11 @@ func (app *App) RenderHTML(w http.ResponseWriter, r *http.Request, page string,
 	buf.WriteTo(w)
 }
 
+// WantsJSON check if a client asked for a json response
+func WantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || r.URL.Query().Get("format") == "json"
+}
+
 // JSONResponse sends a response in json format
 func JSONResponse(w http.ResponseWriter, code int, output interface{}) {
 
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/models"
+)
+
+// webhookDeliveryPage how many deliveries are shown for a webhook
+const webhookDeliveryPage = 100
+
+// ShowWebhooks list the webhooks with the form for adding one
+func (app *App) ShowWebhooks(w http.ResponseWriter, r *http.Request) {
+
+	hooks, err := app.DB.GetWebhooks()
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.RenderHTML(w, r, "webhooks.page.html", &HTMLData{
+		Webhooks: hooks,
+		Form:     &forms.NewWebhook{Active: true},
+	})
+}
+
+// webhookForm model a webhook on the posted form, keeping only known events
+func webhookForm(r *http.Request) *forms.NewWebhook {
+
+	form := &forms.NewWebhook{
+		URL:    strings.TrimSpace(r.PostForm.Get("url")),
+		Secret: r.PostForm.Get("secret"),
+		Active: r.PostForm.Get("active") != "",
+	}
+	for _, event := range models.WebhookEvents {
+		if r.PostForm.Get(event) != "" {
+			form.Events = append(form.Events, event)
+		}
+	}
+
+	return form
+}
+
+// CreateWebhook add a webhook, generating a secret when none is given
+func (app *App) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// Get current user
+	_, user := app.LoggedIn(r)
+
+	// Validate form
+	form := webhookForm(r)
+	if !form.Valid() {
+		hooks, err := app.DB.GetWebhooks()
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		app.RenderHTML(w, r, "webhooks.page.html", &HTMLData{Webhooks: hooks, Form: form})
+		return
+	}
+
+	flash := "Webhook added."
+	if form.Secret == "" {
+		form.Secret, err = CreateOpaqueToken()
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		flash = fmt.Sprintf("Webhook added, sign checks with the secret %s", form.Secret)
+	}
+
+	_, err = app.DB.InsertWebhook(form.URL, form.Secret, form.Events, user.Username)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.AddFlash(flash, "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// requestedWebhook load the webhook in the url, writing the error response when there isn't one
+func (app *App) requestedWebhook(w http.ResponseWriter, r *http.Request) *models.Webhook {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		app.NotFound(w)
+		return nil
+	}
+
+	hook, err := app.DB.GetWebhook(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return nil
+	}
+	if hook == nil {
+		app.NotFound(w)
+		return nil
+	}
+
+	return hook
+}
+
+// ShowWebhook show a webhook with its latest deliveries
+func (app *App) ShowWebhook(w http.ResponseWriter, r *http.Request) {
+
+	hook := app.requestedWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	deliveries, err := app.DB.GetDeliveries(hook.ID, webhookDeliveryPage)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	app.RenderHTML(w, r, "webhooks.page.html", &HTMLData{
+		Webhook:    hook,
+		Deliveries: deliveries,
+		Form: &forms.NewWebhook{
+			URL:    hook.URL,
+			Events: hook.Events,
+			Active: hook.Active,
+		},
+	})
+}
+
+// UpdateWebhook change where a webhook points, what it listens for and if it is on
+func (app *App) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Parse the post data
+	err := r.ParseForm()
+	if err != nil {
+		app.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	hook := app.requestedWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	// Validate form
+	form := webhookForm(r)
+	if !form.Valid() {
+		deliveries, err := app.DB.GetDeliveries(hook.ID, webhookDeliveryPage)
+		if err != nil {
+			app.ServerError(w, err)
+			return
+		}
+		app.RenderHTML(w, r, "webhooks.page.html", &HTMLData{Webhook: hook, Deliveries: deliveries, Form: form})
+		return
+	}
+
+	err = app.DB.UpdateWebhook(hook.ID, form.URL, form.Events, form.Active)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.AddFlash("Webhook saved.", "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", hook.ID), http.StatusSeeOther)
+}
+
+// DeleteWebhook remove a webhook and its delivery log
+func (app *App) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	hook := app.requestedWebhook(w, r)
+	if hook == nil {
+		return
+	}
+
+	err := app.DB.DeleteWebhook(hook.ID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	session.AddFlash(fmt.Sprintf("Webhook to %s deleted.", hook.URL), "default")
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// RedeliverWebhook send a delivery again, as a new delivery with the same payload
+func (app *App) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+
+	// Load session
+	session, _ := app.Sessions.Get(r, "session-name")
+
+	// Get requested delivery
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		app.NotFound(w)
+		return
+	}
+
+	delivery, err := app.DB.GetDelivery(id)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+	if delivery == nil {
+		app.NotFound(w)
+		return
+	}
+
+	newid, err := app.DB.Redeliver(delivery.ID)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	if newid == 0 {
+		session.AddFlash("Turn the webhook on before sending its deliveries again.", "default")
+	} else {
+
+		// Send it now rather than on the next check
+		select {
+		case app.WebhookWake <- struct{}{}:
+		default:
+		}
+
+		session.AddFlash(fmt.Sprintf("Delivery %d queued again.", delivery.ID), "default")
+	}
+
+	// Save session
+	err = session.Save(r, w)
+	if err != nil {
+		app.ServerError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", delivery.WebhookID), http.StatusSeeOther)
+}
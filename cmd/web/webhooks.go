@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rssnyder/louieslibrary/pkg/models"
+	"gopkg.in/guregu/null.v4"
+)
+
+// How webhooks are delivered
+const (
+	webhookAttempts   = 6
+	webhookBackoff    = 30 * time.Second
+	webhookBatch      = 50
+	webhookKeep       = 30 * 24 * time.Hour
+	webhookLease      = 5 * time.Minute
+	webhookErrorLimit = 500
+)
+
+// webhookClient gives up on slow receivers so one can't hold up the rest
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookPayload the body posted to a webhook
+type WebhookPayload struct {
+	Event   string      `json:"event"`
+	URL     string      `json:"url"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+// SignPayload the signature sent with a delivery, receivers compute the same over the raw body to check it came from us
+func SignPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// FireWebhook queue an event for the webhooks listening for it, link is the page it is about
+func (app *App) FireWebhook(event, link string, data interface{}) {
+
+	body, err := json.Marshal(WebhookPayload{
+		Event:   event,
+		URL:     app.Link("%s", link),
+		Created: time.Now().UTC(),
+		Data:    data,
+	})
+	if err != nil {
+		log.Printf("Unable to encode %s webhook: %s", event, err.Error())
+		return
+	}
+
+	queued, err := app.DB.QueueDeliveries(event, string(body))
+	if err != nil {
+		log.Printf("Unable to queue %s webhook: %s", event, err.Error())
+		return
+	}
+
+	// Wake the worker rather than wait for its next look
+	if queued > 0 {
+		select {
+		case app.WebhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// FireBookWebhook queue a book event with the book as it is now
+func (app *App) FireBookWebhook(event, volumeID string) {
+
+	book, err := app.DB.GetBook(volumeID)
+	if err != nil || book == nil {
+		log.Printf("Unable to load book %s for %s webhook: %v", volumeID, event, err)
+		return
+	}
+
+	app.FireWebhook(event, fmt.Sprintf("/book/%s", volumeID), book)
+}
+
+// DeliverWebhooks send queued deliveries as they come in, checking at least every interval for retries
+func (app *App) DeliverWebhooks(interval time.Duration) {
+	for {
+		due, err := app.DB.DueDeliveries(webhookBatch, webhookLease)
+		if err != nil {
+			log.Printf("Unable to find webhook deliveries: %s", err.Error())
+		}
+		for _, delivery := range due {
+			app.Deliver(delivery)
+		}
+
+		// A full batch likely means there is more waiting
+		if len(due) == webhookBatch {
+			continue
+		}
+		select {
+		case <-app.WebhookWake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Deliver make one attempt at a delivery and record how it went, backing off between retries
+func (app *App) Deliver(delivery *models.WebhookDelivery) {
+
+	code, err := app.post(delivery)
+
+	status := models.DeliverySucceeded
+	errText := ""
+	var next null.Time
+	if err != nil {
+		errText = err.Error()
+		if len(errText) > webhookErrorLimit {
+			errText = errText[:webhookErrorLimit]
+		}
+
+		// Wait twice as long after each failure until we run out of attempts
+		status = models.DeliveryPending
+		next = null.TimeFrom(time.Now().UTC().Add(webhookBackoff << uint(delivery.Attempts)))
+		if delivery.Attempts+1 >= webhookAttempts {
+			status = models.DeliveryFailed
+			next = null.Time{}
+		}
+		log.Printf("Webhook delivery %d to %s failed: %s", delivery.ID, delivery.URL, errText)
+	}
+
+	err = app.DB.RecordAttempt(delivery.ID, status, code, errText, next)
+	if err != nil {
+		log.Printf("Unable to record webhook delivery %d: %s", delivery.ID, err.Error())
+	}
+}
+
+// post send a delivery, anything but a 2xx response is an error
+func (app *App) post(delivery *models.WebhookDelivery) (null.Int, error) {
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return null.Int{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "louieslibrary-webhooks")
+	req.Header.Set("X-Library-Event", delivery.Event)
+	req.Header.Set("X-Library-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Library-Signature", SignPayload(delivery.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return null.Int{}, err
+	}
+	defer resp.Body.Close()
+
+	// Read a little so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	code := null.IntFrom(int64(resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return code, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+
+	return code, nil
+}
+
+// PruneWebhookDeliveries periodically forget old finished deliveries
+func (app *App) PruneWebhookDeliveries(interval time.Duration) {
+	for {
+		err := app.DB.PruneDeliveries(time.Now().UTC().Add(-webhookKeep))
+		if err != nil {
+			log.Printf("Unable to prune webhook deliveries: %s", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
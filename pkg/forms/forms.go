@@ -1,15 +1,30 @@
 package forms
 
 import (
+	"fmt"
 	"log"
+	"net/mail"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 	"unicode/utf8"
+
+	"github.com/rssnyder/louieslibrary/pkg/isbn"
 )
 
 // NewRequest model the request structure
 type NewRequest struct {
 	Requester string
 	Title     string
+	Author    string
+	ISBN      string
+	Format    string
+	Edition   string
+	Language  string
+	Notes     string
+	VolumeID  string
 	Failures  map[string]string
 }
 
@@ -32,9 +47,60 @@ func (f *NewRequest) Valid() bool {
 		log.Printf("Request submitted with title missing")
 	}
 
+	// Check the isbn checksum when given
+	if strings.TrimSpace(f.ISBN) != "" && !isbn.Valid(f.ISBN) {
+		f.Failures["ISBN"] = "ISBN is not valid, check the digits"
+		log.Printf("Request submitted with invalid isbn")
+	}
+
+	// Check format is one we store
+	if f.Format != "" {
+		known := false
+		for _, format := range Formats {
+			if f.Format == format {
+				known = true
+			}
+		}
+		if !known {
+			f.Failures["Format"] = "Format is not supported"
+			log.Printf("Request submitted with unknown format")
+		}
+	}
+
+	// Check the short fields stay short
+	for field, value := range map[string]string{"Author": f.Author, "Edition": f.Edition, "Language": f.Language} {
+		if utf8.RuneCountInString(value) > 200 {
+			f.Failures[field] = fmt.Sprintf("%s cannot be longer than 200 characters", field)
+			log.Printf("Request submitted with %s over limit", strings.ToLower(field))
+		}
+	}
+
+	// Check notes length
+	if utf8.RuneCountInString(f.Notes) > 2000 {
+		f.Failures["Notes"] = "Notes cannot be longer than 2000 characters"
+		log.Printf("Request submitted with notes over limit")
+	}
+
 	return len(f.Failures) == 0
 }
 
+// DeletedUserPrefix start of the placeholder names deleted users are replaced by
+const DeletedUserPrefix = "deleted-"
+
+// ReservedUsername check if a username could clash with a deleted user placeholder
+func ReservedUsername(username string) bool {
+	return strings.HasPrefix(strings.ToLower(username), DeletedUserPrefix)
+}
+
+// ValidEmail check an email is a single bare address, no display name or line breaks
+func ValidEmail(email string) bool {
+	if utf8.RuneCountInString(email) > 254 {
+		return false
+	}
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
 // NewUser model the base user structure
 type NewUser struct {
 	Username   string
@@ -55,12 +121,18 @@ func (f *NewUser) Valid() bool {
 	} else if utf8.RuneCountInString(f.Username) > 60 {
 		f.Failures["Username"] = "Username cannot be longer than 60 characters"
 		log.Printf("User submitted with username over limit")
+	} else if ReservedUsername(f.Username) {
+		f.Failures["Username"] = "Username cannot start with " + DeletedUserPrefix
+		log.Printf("User submitted with reserved username")
 	}
 
 	// Check for non-empty email
 	if strings.TrimSpace(f.Email) == "" {
 		f.Failures["Email"] = "Email is required"
 		log.Printf("User submitted with email missing")
+	} else if !ValidEmail(f.Email) {
+		f.Failures["Email"] = "Email is not valid"
+		log.Printf("User submitted with invalid email")
 	}
 
 	// Check for non-empty invite code
@@ -84,6 +156,61 @@ func (f *NewUser) Valid() bool {
 	return len(f.Failures) == 0
 }
 
+// Formats book file formats a user can prefer
+var Formats = []string{"mobi", "epub", "azw3", "pdf"}
+
+// Profile model the editable user profile
+type Profile struct {
+	Username        string
+	DisplayName     string
+	Bio             string
+	Email           string
+	PreferredFormat string
+	Failures        map[string]string
+}
+
+// Valid make sure profile has sensible attributes
+func (f *Profile) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check DisplayName length
+	if utf8.RuneCountInString(f.DisplayName) > 60 {
+		f.Failures["DisplayName"] = "Display name cannot be longer than 60 characters"
+		log.Printf("Profile submitted with display name over limit")
+	}
+
+	// Check Bio length
+	if utf8.RuneCountInString(f.Bio) > 1000 {
+		f.Failures["Bio"] = "Bio cannot be longer than 1000 characters"
+		log.Printf("Profile submitted with bio over limit")
+	}
+
+	// Check for non-empty email
+	if strings.TrimSpace(f.Email) == "" {
+		f.Failures["Email"] = "Email is required"
+		log.Printf("Profile submitted with email missing")
+	} else if !ValidEmail(f.Email) {
+		f.Failures["Email"] = "Email is not valid"
+		log.Printf("Profile submitted with invalid email")
+	}
+
+	// Check PreferredFormat is known
+	if f.PreferredFormat != "" {
+		known := false
+		for _, format := range Formats {
+			if f.PreferredFormat == format {
+				known = true
+			}
+		}
+		if !known {
+			f.Failures["PreferredFormat"] = "Unknown format"
+			log.Printf("Profile submitted with unknown format")
+		}
+	}
+
+	return len(f.Failures) == 0
+}
+
 // NewBook model the book structure
 type NewBook struct {
 	ID             string
@@ -102,6 +229,7 @@ type NewBook struct {
 	ISBN10         string
 	ISBN13         string
 	ImageLink      string
+	RequestID      int
 	Failures       map[string]string
 }
 
@@ -250,8 +378,8 @@ func (f *NewReview) Valid() bool {
 	if strings.TrimSpace(f.Rating) == "" {
 		f.Failures["Rating"] = "Rating is required"
 		log.Printf("Review submitted missing rating")
-	} else if utf8.RuneCountInString(f.Rating) > 1 {
-		f.Failures["Rating"] = "Rating cannot be longer than 1 character"
+	} else if stars, err := strconv.Atoi(f.Rating); err != nil || stars < 1 || stars > 5 {
+		f.Failures["Rating"] = "Rating must be from 1 to 5 stars"
 		log.Printf("Review submitted with invalid rating")
 	}
 
@@ -263,17 +391,269 @@ func (f *NewReview) Valid() bool {
 	return len(f.Failures) == 0
 }
 
+// Stars the rating as a number, only meaningful once the form is valid
+func (f *NewReview) Stars() int {
+	stars, _ := strconv.Atoi(f.Rating)
+	return stars
+}
+
 // NewMessage model the base message structure
 type NewMessage struct {
 	Sender   string
 	Reciver  string
 	Content  string
+	Limited  bool
 	Failures map[string]string
 }
 
-// NewAnnouncement model the base announcement structure
+// MessageLimit the longest message that can be sent
+const MessageLimit = 2000
+
+// Valid make sure message has something to say and someone else to say it to
+func (f *NewMessage) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check for a reciver other than the sender
+	if strings.TrimSpace(f.Reciver) == "" {
+		f.Failures["Reciver"] = "Reciver is required"
+		log.Printf("Message submitted missing reciver")
+	} else if f.Reciver == f.Sender {
+		f.Failures["Reciver"] = "You can't message yourself"
+		log.Printf("Message submitted to its sender")
+	}
+
+	// Check for non-empty content
+	if strings.TrimSpace(f.Content) == "" {
+		f.Failures["Content"] = "Message is required"
+		log.Printf("Message submitted missing content")
+	} else if utf8.RuneCountInString(f.Content) > MessageLimit {
+		f.Failures["Content"] = fmt.Sprintf("Message cannot be longer than %d characters", MessageLimit)
+		log.Printf("Message submitted with content over limit")
+	}
+	return len(f.Failures) == 0
+}
+
+// NewGroup model a group conversation
+type NewGroup struct {
+	Name     string
+	Creator  string
+	Members  string
+	Failures map[string]string
+}
+
+// Usernames the members asked for, without blanks, repeats or the creator
+func (f *NewGroup) Usernames() []string {
+	usernames := []string{}
+	seen := map[string]bool{f.Creator: true}
+	for _, username := range strings.FieldsFunc(f.Members, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		username = strings.TrimPrefix(username, "@")
+		if username == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// Valid make sure group has a name and someone to talk to
+func (f *NewGroup) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check for non-empty name
+	if strings.TrimSpace(f.Name) == "" {
+		f.Failures["Name"] = "Name is required"
+		log.Printf("Group submitted missing name")
+	} else if utf8.RuneCountInString(f.Name) > 100 {
+		f.Failures["Name"] = "Name cannot be longer than 100 characters"
+		log.Printf("Group submitted with name over limit")
+	}
+
+	// Check for members
+	if len(f.Usernames()) == 0 {
+		f.Failures["Members"] = "Add at least one other member"
+		log.Printf("Group submitted without members")
+	}
+	return len(f.Failures) == 0
+}
+
+// NewAnnouncement model the base announcement structure, times are utc from a datetime-local input
 type NewAnnouncement struct {
 	Author   string
 	Content  string
+	Severity string
+	Roles    []string
+	Starts   string
+	Ends     string
+	Failures map[string]string
+}
+
+// Severities how loud an announcement is, quietest first
+var Severities = []string{"info", "warning", "critical"}
+
+// AnnouncementTime the layout of announcement start and end times
+const AnnouncementTime = "2006-01-02T15:04"
+
+// StartTime when the announcement starts showing, now when left blank
+func (f *NewAnnouncement) StartTime() time.Time {
+	starts, err := time.Parse(AnnouncementTime, strings.TrimSpace(f.Starts))
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return starts
+}
+
+// EndTime when the announcement stops showing, false when it shows until removed
+func (f *NewAnnouncement) EndTime() (time.Time, bool) {
+	ends, err := time.Parse(AnnouncementTime, strings.TrimSpace(f.Ends))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ends, true
+}
+
+// Valid make sure announcement has something to say and a sensible schedule
+func (f *NewAnnouncement) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check for non-empty content
+	if strings.TrimSpace(f.Content) == "" {
+		f.Failures["Content"] = "Content is required"
+		log.Printf("Announcement submitted missing content")
+	} else if utf8.RuneCountInString(f.Content) > 1000 {
+		f.Failures["Content"] = "Content cannot be longer than 1000 characters"
+		log.Printf("Announcement submitted with content over limit")
+	}
+
+	// Check for a known severity
+	known := false
+	for _, severity := range Severities {
+		if f.Severity == severity {
+			known = true
+		}
+	}
+	if !known {
+		f.Failures["Severity"] = "Pick a severity"
+		log.Printf("Announcement submitted with unknown severity")
+	}
+
+	// Check the times parse and end after the start
+	if strings.TrimSpace(f.Starts) != "" {
+		if _, err := time.Parse(AnnouncementTime, strings.TrimSpace(f.Starts)); err != nil {
+			f.Failures["Starts"] = "Start must be a date and time"
+			log.Printf("Announcement submitted with bad start")
+		}
+	}
+	if strings.TrimSpace(f.Ends) != "" {
+		ends, ok := f.EndTime()
+		if !ok {
+			f.Failures["Ends"] = "End must be a date and time"
+			log.Printf("Announcement submitted with bad end")
+		} else if !ends.After(f.StartTime()) {
+			f.Failures["Ends"] = "End must be after the start"
+			log.Printf("Announcement submitted ending before it starts")
+		}
+	}
+	return len(f.Failures) == 0
+}
+
+// NewComment model the comment structure
+type NewComment struct {
+	ID       int
+	Target   string
+	TargetID string
+	ParentID int
+	Author   string
+	Body     string
 	Failures map[string]string
-}
\ No newline at end of file
+}
+
+// Valid make sure comment has nessesary attributes
+func (f *NewComment) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check for a book or request to attach to
+	if f.Target != "book" && f.Target != "request" {
+		f.Failures["Target"] = "Comments go on a book or request"
+		log.Printf("Comment submitted with unknown target")
+	}
+	if strings.TrimSpace(f.TargetID) == "" {
+		f.Failures["TargetID"] = "TargetID is required"
+		log.Printf("Comment submitted missing target id")
+	}
+
+	// Check for non-empty body
+	if strings.TrimSpace(f.Body) == "" {
+		f.Failures["Body"] = "Comment is required"
+		log.Printf("Comment submitted missing body")
+	} else if utf8.RuneCountInString(f.Body) > 5000 {
+		f.Failures["Body"] = "Comment cannot be longer than 5000 characters"
+		log.Printf("Comment submitted with body over limit")
+	}
+
+	return len(f.Failures) == 0
+}
+
+// ReportReasons why a review can be reported
+var ReportReasons = []string{"spam", "abusive", "spoilers", "off-topic", "other"}
+
+// ReviewReport describe a report of a review
+type ReviewReport struct {
+	ReviewID int
+	Reporter string
+	Reason   string
+	Note     string
+	Failures map[string]string
+}
+
+// Valid make sure report has a known reason
+func (f *ReviewReport) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check for a known reason
+	known := false
+	for _, reason := range ReportReasons {
+		if f.Reason == reason {
+			known = true
+		}
+	}
+	if !known {
+		f.Failures["Reason"] = "Pick a reason for the report"
+		log.Printf("Report submitted with unknown reason")
+	}
+
+	// Check the note is short
+	if utf8.RuneCountInString(f.Note) > 500 {
+		f.Failures["Note"] = "Note cannot be longer than 500 characters"
+		log.Printf("Report submitted with note over limit")
+	}
+	return len(f.Failures) == 0
+}
+
+// NewWebhook model a webhook
+type NewWebhook struct {
+	URL      string
+	Secret   string
+	Events   []string
+	Active   bool
+	Failures map[string]string
+}
+
+// Valid make sure webhook has somewhere to send to and something to send
+func (f *NewWebhook) Valid() bool {
+	f.Failures = make(map[string]string)
+
+	// Check for an absolute http url
+	u, err := url.Parse(strings.TrimSpace(f.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		f.Failures["URL"] = "URL must start with http:// or https://"
+		log.Printf("Webhook submitted with bad url")
+	}
+
+	// Check for at least one event
+	if len(f.Events) == 0 {
+		f.Failures["Events"] = "Pick at least one event"
+		log.Printf("Webhook submitted without events")
+	}
+	return len(f.Failures) == 0
+}
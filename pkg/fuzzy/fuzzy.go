@@ -0,0 +1,97 @@
+package fuzzy
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Threshold similarity above which two titles are treated as the same
+const Threshold = 0.6
+
+// Shortest title that counts as a match when found inside another
+const minContained = 5
+
+// Words too common to tell titles apart
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "by": true, "of": true, "the": true,
+}
+
+// Normalize lower case a title and strip punctuation and filler words
+func Normalize(s string) string {
+
+	// Replace anything that isnt a letter or number with a space
+	cleaned := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, s)
+
+	// Drop filler words
+	words := []string{}
+	for _, word := range strings.Fields(cleaned) {
+		if !stopWords[word] {
+			words = append(words, word)
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// bigrams split a string into its overlapping letter pairs
+func bigrams(s string) map[string]int {
+	pairs := make(map[string]int)
+	runes := []rune(s)
+	for i := 0; i < len(runes)-1; i++ {
+		pairs[string(runes[i:i+2])]++
+	}
+	return pairs
+}
+
+// Similarity score two strings from 0 to 1 by their shared letter pairs
+func Similarity(a, b string) float64 {
+	a, b = Normalize(a), Normalize(b)
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+
+	// Count the pairs the two have in common
+	left, right := bigrams(a), bigrams(b)
+	total, shared := 0, 0
+	for pair, n := range left {
+		total += n
+		if m, ok := right[pair]; ok {
+			if m < n {
+				shared += m
+			} else {
+				shared += n
+			}
+		}
+	}
+	for _, m := range right {
+		total += m
+	}
+	if total == 0 {
+		return 0
+	}
+
+	return 2 * float64(shared) / float64(total)
+}
+
+// Match check if two titles are similar enough to be the same thing
+func Match(a, b string) bool {
+
+	// One title containing the other is a match, eg. a title with the author added
+	na, nb := Normalize(a), Normalize(b)
+	if len(na) > len(nb) {
+		na, nb = nb, na
+	}
+	if len(na) >= minContained && strings.Contains(nb, na) {
+		return true
+	}
+
+	return Similarity(a, b) >= Threshold
+}
@@ -0,0 +1,84 @@
+package fuzzy
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "The Lord of the Rings", want: "lord rings"},
+		{in: "  Catch-22!  ", want: "catch 22"},
+		{in: "Harry Potter & the Philosopher's Stone", want: "harry potter philosopher s stone"},
+		{in: "Les Misérables", want: "les misérables"},
+		{in: "The", want: ""},
+		{in: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := Normalize(tt.in); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		above bool
+	}{
+		{name: "punctuation and case", a: "The Hobbit", b: "hobbit!", above: true},
+		{name: "small typo", a: "The Philosophers Stone", b: "The Philosopher's Stone", above: true},
+		{name: "misspelled", a: "Pride and Prejudice", b: "Pride and Prejudise", above: true},
+		{name: "different books", a: "War and Peace", b: "Crime and Punishment"},
+		{name: "sequel", a: "Dune", b: "Dune Messiah"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score := Similarity(tt.a, tt.b)
+			if (score >= Threshold) != tt.above {
+				t.Errorf("Similarity(%q, %q) = %.2f, above threshold %v", tt.a, tt.b, score, tt.above)
+			}
+		})
+	}
+
+	if got := Similarity("Dune", "dune"); got != 1 {
+		t.Errorf("identical titles scored %.2f", got)
+	}
+	if got := Similarity("", "Dune"); got != 0 {
+		t.Errorf("empty title scored %.2f", got)
+	}
+	if got := Similarity("The", "A"); got != 0 {
+		t.Errorf("filler words scored %.2f", got)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name: "same title", a: "Dune", b: "DUNE", want: true},
+		{name: "title with author", a: "The Hobbit", b: "The Hobbit by J.R.R. Tolkien", want: true},
+		{name: "author first", a: "Tolkien - The Hobbit", b: "Hobbit", want: true},
+		{name: "short title contained", a: "Dune", b: "Dune Messiah"},
+		{name: "short word inside longer", a: "It", b: "Little Italy"},
+		{name: "unrelated", a: "Moby Dick", b: "Middlemarch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.a, tt.b); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+			if got := Match(tt.b, tt.a); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
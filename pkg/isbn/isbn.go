@@ -0,0 +1,95 @@
+package isbn
+
+import (
+	"regexp"
+	"strings"
+)
+
+// candidate runs of digits that could be an isbn, with optional dashes
+var candidate = regexp.MustCompile(`\b[0-9][0-9\-]{8,16}[0-9Xx]\b`)
+
+// Normalize strip everything but digits and a trailing check X
+func Normalize(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if (r >= '0' && r <= '9') || r == 'X' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Valid check the length and check digit of an isbn 10 or 13
+func Valid(s string) bool {
+	s = Normalize(s)
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i, r := range s {
+			var d int
+			if r == 'X' {
+				if i != 9 {
+					return false
+				}
+				d = 10
+			} else {
+				d = int(r - '0')
+			}
+			sum += d * (10 - i)
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, r := range s {
+			if r == 'X' {
+				return false
+			}
+			d := int(r - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		return sum%10 == 0
+	}
+	return false
+}
+
+// To13 convert a valid isbn to its 13 digit form, empty if invalid
+func To13(s string) string {
+	s = Normalize(s)
+	if !Valid(s) {
+		return ""
+	}
+	if len(s) == 13 {
+		return s
+	}
+
+	// Prefix 978 and recalculate the check digit
+	body := "978" + s[:9]
+	sum := 0
+	for i, r := range body {
+		d := int(r - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	check := (10 - sum%10) % 10
+
+	return body + string(rune('0'+check))
+}
+
+// Extract find every valid isbn in some text, as 13 digit isbns
+func Extract(text string) []string {
+	found := []string{}
+	seen := map[string]bool{}
+	for _, match := range candidate.FindAllString(text, -1) {
+		isbn := To13(match)
+		if isbn != "" && !seen[isbn] {
+			seen[isbn] = true
+			found = append(found, isbn)
+		}
+	}
+	return found
+}
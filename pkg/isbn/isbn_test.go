@@ -0,0 +1,68 @@
+package isbn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want bool
+	}{
+		{name: "isbn 10", in: "0306406152", want: true},
+		{name: "isbn 10 with dashes", in: "0-306-40615-2", want: true},
+		{name: "isbn 10 check x", in: "080442957X", want: true},
+		{name: "isbn 10 lower case x", in: "080442957x", want: true},
+		{name: "isbn 10 bad check digit", in: "0306406153"},
+		{name: "isbn 10 x not last", in: "08044295X7"},
+		{name: "isbn 13", in: "9780306406157", want: true},
+		{name: "isbn 13 with dashes", in: "978-0-306-40615-7", want: true},
+		{name: "isbn 13 check zero", in: "9781558608320", want: true},
+		{name: "isbn 13 bad check digit", in: "9780306406158"},
+		{name: "isbn 13 with x", in: "978030640615X"},
+		{name: "too short", in: "030640615"},
+		{name: "too long", in: "97803064061570"},
+		{name: "empty", in: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.in); got != tt.want {
+				t.Errorf("Valid(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTo13(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "0-306-40615-2", want: "9780306406157"},
+		{in: "080442957X", want: "9780804429573"},
+		{in: "9780306406157", want: "9780306406157"},
+		{in: "0306406153", want: ""},
+		{in: "not an isbn", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := To13(tt.in); got != tt.want {
+			t.Errorf("To13(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	got := Extract("Dune (ISBN 0-306-40615-2, also 9780306406157) or 080442957X, not 0306406153 or 12345")
+	want := []string{"9780306406157", "9780804429573"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Extract() = %v, want %v", got, want)
+	}
+
+	if got := Extract("no numbers here"); len(got) != 0 {
+		t.Errorf("Extract() = %v, want none", got)
+	}
+}
@@ -0,0 +1,174 @@
+package markdown
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Inline markup, matched against already escaped text
+var (
+	linkPattern    = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+	boldPattern    = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	italicPattern  = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+	mentionPattern = regexp.MustCompile(`(^|[^\w@/])@([A-Za-z0-9_-]+(?:\.[A-Za-z0-9_-]+)*)`)
+	tokenPattern   = regexp.MustCompile("\uE000([0-9]+)\uE001")
+)
+
+// Markers around a placeholder for html that emphasis must not touch
+const (
+	tokenStart = '\uE000'
+	tokenEnd   = '\uE001'
+)
+
+// Mentions list the unique usernames @mentioned in some text
+func Mentions(text string) []string {
+	found := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if !seen[match[2]] {
+			seen[match[2]] = true
+			found = append(found, match[2])
+		}
+	}
+	return found
+}
+
+// Render convert a small subset of markdown to html, any html in the text is escaped first
+func Render(text string) string {
+
+	var out strings.Builder
+	var paragraph []string
+	var list []string
+	var quote []string
+	var code []string
+	inCode := false
+
+	// Write out whichever block is open
+	flush := func() {
+		if len(paragraph) > 0 {
+			out.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>")
+			paragraph = nil
+		}
+		if len(list) > 0 {
+			out.WriteString("<ul><li>" + strings.Join(list, "</li><li>") + "</li></ul>")
+			list = nil
+		}
+		if len(quote) > 0 {
+			out.WriteString("<blockquote>" + strings.Join(quote, "<br>") + "</blockquote>")
+			quote = nil
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Fenced code is kept as is
+		if strings.HasPrefix(trimmed, "```") {
+			if inCode {
+				out.WriteString("<pre><code>" + strings.Join(code, "\n") + "</code></pre>")
+				code = nil
+			} else {
+				flush()
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			code = append(code, html.EscapeString(line))
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			if len(paragraph) > 0 || len(quote) > 0 {
+				flush()
+			}
+			list = append(list, inline(trimmed[2:]))
+		case strings.HasPrefix(trimmed, ">"):
+			if len(paragraph) > 0 || len(list) > 0 {
+				flush()
+			}
+			quote = append(quote, inline(strings.TrimSpace(trimmed[1:])))
+		default:
+			if len(list) > 0 || len(quote) > 0 {
+				flush()
+			}
+			paragraph = append(paragraph, inline(trimmed))
+		}
+	}
+
+	// Close an unfinished code block
+	if inCode {
+		out.WriteString("<pre><code>" + strings.Join(code, "\n") + "</code></pre>")
+	}
+	flush()
+
+	return out.String()
+}
+
+// inline escape a line and apply code, links, emphasis and mentions
+func inline(line string) string {
+
+	// Placeholder markers can't come from the text
+	line = strings.Map(func(r rune) rune {
+		if r == tokenStart || r == tokenEnd {
+			return -1
+		}
+		return r
+	}, line)
+
+	// Odd pieces between backticks are code and left alone
+	pieces := strings.Split(line, "`")
+	for i, piece := range pieces {
+		piece = html.EscapeString(piece)
+		if i%2 == 1 && i < len(pieces)-1 {
+			pieces[i] = "<code>" + piece + "</code>"
+			continue
+		}
+		piece = markup(piece)
+		if i%2 == 1 {
+
+			// Unmatched backtick
+			piece = "`" + piece
+		}
+		pieces[i] = piece
+	}
+
+	return strings.Join(pieces, "")
+}
+
+// markup apply links, emphasis and mentions to escaped text. Links and mentions
+// are swapped for placeholders first so emphasis never runs inside their tags
+func markup(text string) string {
+
+	var tokens []string
+	stash := func(tag string) string {
+		tokens = append(tokens, tag)
+		return string(tokenStart) + strconv.Itoa(len(tokens)-1) + string(tokenEnd)
+	}
+
+	text = linkPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := linkPattern.FindStringSubmatch(match)
+		return stash(`<a href="` + parts[2] + `" rel="nofollow noopener" target="_blank">` + emphasis(parts[1]) + `</a>`)
+	})
+	text = mentionPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := mentionPattern.FindStringSubmatch(match)
+		return parts[1] + stash(`<a href="/user/`+parts[2]+`">@`+parts[2]+`</a>`)
+	})
+	text = emphasis(text)
+
+	return tokenPattern.ReplaceAllStringFunc(text, func(match string) string {
+		index, _ := strconv.Atoi(tokenPattern.FindStringSubmatch(match)[1])
+		return tokens[index]
+	})
+}
+
+// emphasis apply bold and italic
+func emphasis(text string) string {
+	text = boldPattern.ReplaceAllString(text, "<strong>$1</strong>")
+	return italicPattern.ReplaceAllString(text, "<em>$1$2</em>")
+}
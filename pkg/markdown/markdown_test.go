@@ -0,0 +1,116 @@
+package markdown
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "emphasis",
+			in:   "**bold** and *italic* and _also_",
+			want: "<p><strong>bold</strong> and <em>italic</em> and <em>also</em></p>",
+		},
+		{
+			name: "link",
+			in:   "[the site](https://example.com/a)",
+			want: `<p><a href="https://example.com/a" rel="nofollow noopener" target="_blank">the site</a></p>`,
+		},
+		{
+			name: "underscores in link url",
+			in:   "[docs](https://example.com/some_long_path_here)",
+			want: `<p><a href="https://example.com/some_long_path_here" rel="nofollow noopener" target="_blank">docs</a></p>`,
+		},
+		{
+			name: "asterisks in link url",
+			in:   "[a](https://example.com/*x*) and [b](https://example.com/**y**)",
+			want: `<p><a href="https://example.com/*x*" rel="nofollow noopener" target="_blank">a</a> and <a href="https://example.com/**y**" rel="nofollow noopener" target="_blank">b</a></p>`,
+		},
+		{
+			name: "mention in link url",
+			in:   "[profile](https://example.com/x@bob)",
+			want: `<p><a href="https://example.com/x@bob" rel="nofollow noopener" target="_blank">profile</a></p>`,
+		},
+		{
+			name: "mention in link text",
+			in:   "[ask @bob](https://example.com)",
+			want: `<p><a href="https://example.com" rel="nofollow noopener" target="_blank">ask @bob</a></p>`,
+		},
+		{
+			name: "emphasis in link text",
+			in:   "[**big** news](https://example.com)",
+			want: `<p><a href="https://example.com" rel="nofollow noopener" target="_blank"><strong>big</strong> news</a></p>`,
+		},
+		{
+			name: "emphasis around link",
+			in:   "**see [this](https://example.com)**",
+			want: `<p><strong>see <a href="https://example.com" rel="nofollow noopener" target="_blank">this</a></strong></p>`,
+		},
+		{
+			name: "mention",
+			in:   "thanks @bob_the_reader",
+			want: `<p>thanks <a href="/user/bob_the_reader">@bob_the_reader</a></p>`,
+		},
+		{
+			name: "bold mention",
+			in:   "**@bob**",
+			want: `<p><strong><a href="/user/bob">@bob</a></strong></p>`,
+		},
+		{
+			name: "email is not a mention",
+			in:   "mail bob@example.com",
+			want: "<p>mail bob@example.com</p>",
+		},
+		{
+			name: "html escaped",
+			in:   `<script>alert("x")</script>`,
+			want: "<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</p>",
+		},
+		{
+			name: "javascript link",
+			in:   "[x](javascript:alert(1))",
+			want: "<p>[x](javascript:alert(1))</p>",
+		},
+		{
+			name: "placeholder markers stripped",
+			in:   "a\uE0000\uE001b",
+			want: "<p>a0b</p>",
+		},
+		{
+			name: "code untouched",
+			in:   "`**not bold** @bob`",
+			want: "<p><code>**not bold** @bob</code></p>",
+		},
+		{
+			name: "list and quote",
+			in:   "- one\n- *two*\n\n> quoted",
+			want: "<ul><li>one</li><li><em>two</em></li></ul><blockquote>quoted</blockquote>",
+		},
+		{
+			name: "fenced code",
+			in:   "```\n<b>\n```",
+			want: "<pre><code>&lt;b&gt;</code></pre>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.in); got != tt.want {
+				t.Errorf("Render(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMentions(t *testing.T) {
+	got := Mentions("@alice and @bob, again @alice, not bob@example.com or https://example.com/@carol")
+	want := []string{"alice", "bob"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Mentions() = %v, want %v", got, want)
+	}
+}
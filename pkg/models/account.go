@@ -0,0 +1,384 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+)
+
+// RecordDownload remember that a user downloaded a book
+func (db *DB) RecordDownload(username, id string) {
+
+	// Query statement
+	stmt := `INSERT INTO downloads (username, volumeid, created) VALUES ($1, $2, timezone('utc', now()))`
+
+	db.Exec(stmt, username, id)
+}
+
+// GetDownloads get the download history of a user
+func (db *DB) GetDownloads(username string) (Downloads, error) {
+
+	// Query statement
+	stmt := `SELECT d.username, d.volumeid, b.title, d.created FROM downloads d 
+		INNER JOIN books b ON d.volumeid = b.volumeid AND d.username = $1 ORDER BY d.created DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty download collection
+	downloads := Downloads{}
+
+	// Get all the matching downloads
+	for rows.Next() {
+		d := &Download{}
+
+		// Pull data into download
+		err := rows.Scan(&d.Username, &d.VolumeID, &d.Title, &d.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add download to collection
+		downloads = append(downloads, d)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return downloads, nil
+}
+
+// UserRequests get every request made by a user
+func (db *DB) UserRequests(username string) (Requests, error) {
+
+	// Query statement
+	stmt := `SELECT id, requester, title, author, isbn, format, edition, language, notes, status, bookid, created 
+		FROM requests WHERE requester = $1 ORDER BY created DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty request collection
+	requests := Requests{}
+
+	// Get all the matching requests
+	for rows.Next() {
+		r := &Request{}
+
+		// Pull data into request
+		err := rows.Scan(&r.ID, &r.Requester, &r.Title, &r.Author, &r.ISBN, &r.Format, &r.Edition, &r.Language, &r.Notes,
+			&r.Status, &r.BookID, &r.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add request to collection
+		requests = append(requests, r)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// UserReviews get every review written by a user, hidden ones included
+func (db *DB) UserReviews(username string) (Reviews, error) {
+
+	// Query statement
+	stmt := `SELECT r.id, r.bookid, r.username, COALESCE(r.rating, 0), r.review, r.hidden, ` + helpfulColumn + `, r.edited, r.created 
+		FROM reviews r WHERE r.username = $1 ORDER BY r.created DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty review collection
+	reviews := Reviews{}
+
+	// Get all the matching reviews
+	for rows.Next() {
+		r := &Review{}
+
+		// Pull data into review
+		err := rows.Scan(&r.ID, &r.BookID, &r.Username, &r.Rating, &r.Review, &r.Hidden, &r.Helpful, &r.Edited, &r.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add review to collection
+		reviews = append(reviews, r)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+// UserReviewEdits get the earlier versions of every review written by a user
+func (db *DB) UserReviewEdits(username string) ([]*ReviewEdit, error) {
+
+	// Query statement
+	stmt := `SELECT e.id, e.reviewid, COALESCE(e.rating, 0), e.review, e.created FROM review_edits e 
+		INNER JOIN reviews r ON e.reviewid = r.id AND r.username = $1 ORDER BY e.created DESC, e.id DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the versions
+	edits := []*ReviewEdit{}
+	for rows.Next() {
+		e := &ReviewEdit{}
+		err := rows.Scan(&e.ID, &e.ReviewID, &e.Rating, &e.Review, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return edits, nil
+}
+
+// UserMessages get every message in the conversations a user is part of
+func (db *DB) UserMessages(username string) (Messages, error) {
+
+	// Query statement
+	stmt := `SELECT m.id, m.conversationid, m.sender, m.content, m.attachtype, m.attachid, m.created FROM messages m
+		INNER JOIN conversation_participants p ON p.conversationid = m.conversationid AND p.username = $1 ORDER BY m.id ASC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty message collection
+	messages := Messages{}
+
+	// Get all the matching messages
+	for rows.Next() {
+		m := &Message{}
+		a := &Attachment{}
+
+		// Pull data into message
+		err := rows.Scan(&m.ID, &m.ConversationID, &m.Sender, &m.Content, &a.Type, &a.ID, &m.Created)
+		if err != nil {
+			return nil, err
+		}
+		if a.Type != "" {
+			m.Attachment = a
+		}
+
+		// Add message to collection
+		messages = append(messages, m)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// InsertDataExport start a new data export for a user
+func (db *DB) InsertDataExport(username string) (int, error) {
+
+	var id int
+
+	stmt := `INSERT INTO data_exports (username, status, key, created) VALUES ($1, 'pending', '', timezone('utc', now())) RETURNING id`
+
+	err := db.QueryRow(stmt, username).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Data export %d started for %s", id, username)
+
+	return id, nil
+}
+
+// FinishDataExport record the outcome of a data export
+func (db *DB) FinishDataExport(id int, status, key string) error {
+
+	stmt := `UPDATE data_exports SET status = $1, key = $2, completed = timezone('utc', now()) WHERE id = $3`
+
+	_, err := db.Exec(stmt, status, key, id)
+	return err
+}
+
+// GetDataExport retrive a single data export
+func (db *DB) GetDataExport(id int) (*DataExport, error) {
+
+	stmt := `SELECT id, username, status, key, created, completed FROM data_exports WHERE id = $1`
+
+	e := &DataExport{}
+	err := db.QueryRow(stmt, id).Scan(&e.ID, &e.Username, &e.Status, &e.Key, &e.Created, &e.Completed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// GetDataExports get the data exports of a user
+func (db *DB) GetDataExports(username string) (DataExports, error) {
+
+	// Query statement
+	stmt := `SELECT id, username, status, key, created, completed FROM data_exports WHERE username = $1 ORDER BY created DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty export collection
+	exports := DataExports{}
+
+	// Get all the matching exports
+	for rows.Next() {
+		e := &DataExport{}
+
+		// Pull data into export
+		err := rows.Scan(&e.ID, &e.Username, &e.Status, &e.Key, &e.Created, &e.Completed)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add export to collection
+		exports = append(exports, e)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+// DeleteUser remove a user, handing what others can still see to an anonymous placeholder
+func (db *DB) DeleteUser(username string) (string, error) {
+
+	// Look up the user
+	var id int
+	err := db.QueryRow(`SELECT id FROM users WHERE username = $1`, username).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	// Placeholder that keeps reviews and messages attached to someone
+	anon := fmt.Sprintf("%s%d", forms.DeletedUserPrefix, id)
+
+	// Delete in one go
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	// Placeholder can never log in
+	_, err = tx.Exec(`INSERT INTO users (username, email, password, role, displayname, bio, avatar, emailverified, preferredformat, created) 
+		VALUES ($1, '', '', 'deleted', 'Deleted User', '', '', FALSE, '', timezone('utc', now()))`, anon)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	// Hand shared content to the placeholder, $1 is the user and $2 the placeholder
+	moves := []string{
+		`UPDATE reviews SET username = $2 WHERE username = $1`,
+		`UPDATE comments SET author = $2 WHERE author = $1`,
+		`UPDATE review_reports SET reporter = $2 WHERE reporter = $1`,
+		`UPDATE review_reports SET resolvedby = $2 WHERE resolvedby = $1`,
+		`UPDATE messages SET sender = $2 WHERE sender = $1`,
+		`UPDATE conversations SET direct = NULL WHERE id IN (SELECT conversationid FROM conversation_participants WHERE username = $1)`,
+		`UPDATE conversation_participants SET username = $2 WHERE username = $1`,
+		`UPDATE conversations SET createdby = $2 WHERE createdby = $1`,
+		`UPDATE requests SET requester = $2 WHERE requester = $1`,
+		`UPDATE request_votes SET username = $2 WHERE username = $1`,
+		`UPDATE request_events SET actor = $2 WHERE actor = $1`,
+		`UPDATE requests SET claimedby = $2 WHERE claimedby = $1`,
+		`UPDATE books SET uploader = $2 WHERE uploader = $1`,
+		`UPDATE invites SET creator = $2 WHERE creator = $1`,
+		`UPDATE invites SET username = $2 WHERE username = $1`,
+		`UPDATE notifications SET actor = $2 WHERE actor = $1`,
+		`UPDATE webhooks SET createdby = $2 WHERE createdby = $1`,
+		`UPDATE announcements SET author = $2 WHERE author = $1`,
+	}
+	for _, stmt := range moves {
+		_, err = tx.Exec(stmt, username, anon)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	// Remove everything personal, the user row last
+	deletes := []string{
+		`DELETE FROM collection WHERE username = $1`,
+		`DELETE FROM review_votes WHERE username = $1`,
+		`DELETE FROM user_filters WHERE username = $1 OR target = $1`,
+		`DELETE FROM message_deletions WHERE username = $1`,
+		`DELETE FROM notifications WHERE username = $1`,
+		`DELETE FROM notification_preferences WHERE username = $1`,
+		`DELETE FROM email_preferences WHERE username = $1`,
+		`DELETE FROM announcement_dismissals WHERE username = $1`,
+		`DELETE FROM downloads WHERE username = $1`,
+		`DELETE FROM api_tokens WHERE username = $1`,
+		`DELETE FROM refresh_tokens WHERE username = $1`,
+		`DELETE FROM user_identities WHERE username = $1`,
+		`DELETE FROM email_verifications WHERE username = $1`,
+		`DELETE FROM data_exports WHERE username = $1`,
+		`DELETE FROM users WHERE username = $1`,
+	}
+	for _, stmt := range deletes {
+		_, err = tx.Exec(stmt, username)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("User %s deleted, content kept as %s", username, anon)
+
+	return anon, nil
+}
@@ -4,29 +4,118 @@ import (
 	"database/sql"
 	"log"
 
+	"github.com/lib/pq"
 	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"gopkg.in/guregu/null.v4"
 )
 
-// GetAnnouncement gets the latest from the db
-func (db *DB) GetAnnouncement() (*Announcement, error) {
-	// Query statement
-	stmt := `SELECT author, content, created FROM announcements WHERE active = TRUE ORDER BY created DESC LIMIT 1`
+// announcementColumns the columns of an announcement in the order scanAnnouncement reads them
+const announcementColumns = `a.id, a.author, a.content, a.severity, a.roles, a.starts, a.ends, a.announced, a.edited, a.created`
 
-	// Execute query
-	row := db.QueryRow(stmt)
+// severityOrder loudest announcements first
+const severityOrder = `CASE a.severity WHEN 'critical' THEN 0 WHEN 'warning' THEN 1 ELSE 2 END`
+
+// scanAnnouncement read a row selected with announcementColumns
+func scanAnnouncement(row interface{ Scan(...interface{}) error }) (*Announcement, error) {
 	a := &Announcement{}
+	err := row.Scan(&a.ID, &a.Author, &a.Content, &a.Severity, pq.Array(&a.Roles), &a.Starts, &a.Ends, &a.Announced, &a.Edited, &a.Created)
+	return a, err
+}
+
+// queryAnnouncements run an announcement query and collect the results
+func (db *DB) queryAnnouncements(stmt string, args ...interface{}) ([]*Announcement, error) {
+
+	// Execute query
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the announcements
+	announcements := []*Announcement{}
+	for rows.Next() {
+		a, err := scanAnnouncement(rows)
+		if err != nil {
+			return nil, err
+		}
+		announcements = append(announcements, a)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return announcements, nil
+}
+
+// GetAnnouncement get an announcement by id, nil if there isn't one
+func (db *DB) GetAnnouncement(id int) (*Announcement, error) {
+
+	// Query statement
+	stmt := `SELECT ` + announcementColumns + ` FROM announcements a WHERE a.id = $1`
 
-	// Pull data into request
-	err := row.Scan(&a.Author, &a.Content, &a.Created)
+	a, err := scanAnnouncement(db.QueryRow(stmt, id))
 	if err == sql.ErrNoRows {
-		return a, nil
+		return nil, nil
 	} else if err != nil {
-		return a, err
+		return nil, err
 	}
 
 	return a, nil
 }
 
+// ActiveAnnouncements the announcements showing now to a user with a role, leaving out any they dismissed
+func (db *DB) ActiveAnnouncements(username, role string) ([]*Announcement, error) {
+	return db.queryAnnouncements(`SELECT `+announcementColumns+` FROM announcements a
+		WHERE a.starts <= timezone('utc', now()) AND (a.ends IS NULL OR a.ends > timezone('utc', now()))
+		AND (cardinality(a.roles) = 0 OR $2 = ANY(a.roles))
+		AND NOT EXISTS (SELECT 1 FROM announcement_dismissals d WHERE d.announcementid = a.id AND d.username = $1)
+		ORDER BY `+severityOrder+`, a.starts DESC`, username, role)
+}
+
+// GetAnnouncements every announcement a role could see, newest first, including scheduled ones when asked
+func (db *DB) GetAnnouncements(role string, scheduled bool) ([]*Announcement, error) {
+	return db.queryAnnouncements(`SELECT `+announcementColumns+` FROM announcements a
+		WHERE ($2 OR a.starts <= timezone('utc', now()))
+		AND ($2 OR cardinality(a.roles) = 0 OR $1 = ANY(a.roles))
+		ORDER BY a.starts DESC`, role, scheduled)
+}
+
+// DueAnnouncements announcements that have started but nobody has been told about yet
+func (db *DB) DueAnnouncements() ([]*Announcement, error) {
+	return db.queryAnnouncements(`SELECT ` + announcementColumns + ` FROM announcements a
+		WHERE a.announced = FALSE AND a.starts <= timezone('utc', now())
+		AND (a.ends IS NULL OR a.ends > timezone('utc', now()))
+		ORDER BY a.starts`)
+}
+
+// MarkAnnounced claim an announcement for telling users about it, false if it was already claimed
+func (db *DB) MarkAnnounced(id int) (bool, error) {
+
+	// Query statement
+	stmt := `UPDATE announcements SET announced = TRUE WHERE id = $1 AND announced = FALSE`
+
+	res, err := db.Exec(stmt, id)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return claimed == 1, nil
+}
+
+// announcementEnds the end of an announcement form as a nullable time
+func announcementEnds(f *forms.NewAnnouncement) null.Time {
+	ends, ok := f.EndTime()
+	return null.NewTime(ends, ok)
+}
+
 // InsertAnnouncement creates a new announcement
 func (db *DB) InsertAnnouncement(newAnnouncement *forms.NewAnnouncement) (int, error) {
 
@@ -34,11 +123,12 @@ func (db *DB) InsertAnnouncement(newAnnouncement *forms.NewAnnouncement) (int, e
 	var id int
 
 	// Query statement
-	stmt := `INSERT INTO announcements (author, content, active, created) 
-		VALUES ($1, $2, TRUE, timezone('utc', now())) RETURNING id`
+	stmt := `INSERT INTO announcements (author, content, severity, roles, starts, ends, announced, created)
+		VALUES ($1, $2, $3, $4, $5, $6, FALSE, timezone('utc', now())) RETURNING id`
 
 	// Query and fill book structure
-	err := db.QueryRow(stmt, newAnnouncement.Author, newAnnouncement.Content).Scan(&id)
+	err := db.QueryRow(stmt, newAnnouncement.Author, newAnnouncement.Content, newAnnouncement.Severity,
+		pq.Array(newAnnouncement.Roles), newAnnouncement.StartTime(), announcementEnds(newAnnouncement)).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
@@ -49,14 +139,66 @@ func (db *DB) InsertAnnouncement(newAnnouncement *forms.NewAnnouncement) (int, e
 	return id, nil
 }
 
-// RemoveAnnouncement sets an annoucement to not display
-func (db *DB) RemoveAnnouncement() {
+// UpdateAnnouncement change what an announcement says, who sees it and when
+func (db *DB) UpdateAnnouncement(id int, newAnnouncement *forms.NewAnnouncement) error {
 
 	// Query statement
-	stmt := `UPDATE announcements SET active = FALSE WHERE active = TRUE`
+	// Moving the start into the future announces it again when it comes round
+	stmt := `UPDATE announcements SET content = $2, severity = $3, roles = $4, starts = $5, ends = $6,
+		announced = announced AND $5 <= timezone('utc', now()), edited = timezone('utc', now()) WHERE id = $1`
+
+	_, err := db.Exec(stmt, id, newAnnouncement.Content, newAnnouncement.Severity,
+		pq.Array(newAnnouncement.Roles), newAnnouncement.StartTime(), announcementEnds(newAnnouncement))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Announcement %d edited by %s", id, newAnnouncement.Author)
 
-	log.Printf("Clearing announcements cleared")
+	return nil
+}
+
+// DeleteAnnouncement remove an announcement and who dismissed it
+func (db *DB) DeleteAnnouncement(id int) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM announcement_dismissals WHERE announcementid = $1`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM announcements WHERE id = $1`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Announcement %d deleted", id)
+
+	return nil
+}
+
+// DismissAnnouncement stop showing an announcement to a user
+func (db *DB) DismissAnnouncement(id int, username string) error {
+
+	// Query statement
+	stmt := `INSERT INTO announcement_dismissals (announcementid, username, created) VALUES ($1, $2, timezone('utc', now()))
+		ON CONFLICT (announcementid, username) DO NOTHING`
+
+	_, err := db.Exec(stmt, id, username)
+	if err != nil {
+		return err
+	}
 
-	// Update book
-	db.QueryRow(stmt)
+	return nil
 }
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// InsertAPIToken store the hash of a new personal access token
+func (db *DB) InsertAPIToken(username, name, tokenHash string, scopes []string, expires null.Time) (int, error) {
+
+	// Empty new token id
+	var id int
+
+	stmt := `INSERT INTO api_tokens (username, name, tokenhash, scopes, expires, created) 
+		VALUES ($1, $2, $3, $4, $5, timezone('utc', now())) RETURNING id`
+
+	// Create
+	err := db.QueryRow(stmt, username, name, tokenHash, strings.Join(scopes, ","), expires).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("New api token %s created by %s", name, username)
+
+	return id, nil
+}
+
+// GetAPIToken retrive a personal access token by its hash
+func (db *DB) GetAPIToken(tokenHash string) (*APIToken, error) {
+
+	// Query statement
+	stmt := `SELECT id, username, name, tokenhash, scopes, lastused, expires, created FROM api_tokens WHERE tokenhash = $1`
+
+	// Execute query
+	row := db.QueryRow(stmt, tokenHash)
+	t := &APIToken{}
+
+	// Pull data into token
+	var scopes string
+	err := row.Scan(&t.ID, &t.Username, &t.Name, &t.TokenHash, &scopes, &t.LastUsed, &t.Expires, &t.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+
+	return t, nil
+}
+
+// GetAPITokens get a users personal access tokens
+func (db *DB) GetAPITokens(username string) (APITokens, error) {
+
+	// Empty token collection
+	tokens := APITokens{}
+
+	// Query statement
+	stmt := `SELECT id, username, name, scopes, lastused, expires, created FROM api_tokens WHERE username = $1 ORDER BY created DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the matching tokens
+	for rows.Next() {
+		t := &APIToken{}
+
+		// Pull data into token
+		var scopes string
+		err := rows.Scan(&t.ID, &t.Username, &t.Name, &scopes, &t.LastUsed, &t.Expires, &t.Created)
+		if err != nil {
+			return nil, err
+		}
+		t.Scopes = strings.Split(scopes, ",")
+
+		// Add token to collection
+		tokens = append(tokens, t)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// TouchAPIToken record the use of a personal access token
+func (db *DB) TouchAPIToken(id int) error {
+
+	// Query statement
+	stmt := `UPDATE api_tokens SET lastused = timezone('utc', now()) WHERE id = $1`
+
+	_, err := db.Exec(stmt, id)
+	return err
+}
+
+// DeleteAPIToken remove one of a users personal access tokens
+func (db *DB) DeleteAPIToken(id int, username string) error {
+
+	// Query statement
+	stmt := `DELETE FROM api_tokens WHERE id = $1 AND username = $2`
+
+	_, err := db.Exec(stmt, id, username)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Api token %d deleted by %s", id, username)
+
+	return nil
+}
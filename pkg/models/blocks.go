@@ -0,0 +1,115 @@
+package models
+
+import (
+	"errors"
+	"log"
+)
+
+// ErrBlocked one side of a direct conversation has blocked the other
+var ErrBlocked = errors.New("models: user is blocked")
+
+// Kinds of filter a user can put on someone else
+const (
+	FilterBlock = "block"
+	FilterMute  = "mute"
+)
+
+// SetFilter block or mute a user, or lift it
+func (db *DB) SetFilter(username, target, kind string, on bool) error {
+
+	// Query statement
+	stmt := `DELETE FROM user_filters WHERE username = $1 AND target = $2 AND kind = $3`
+	if on {
+		stmt = `INSERT INTO user_filters (username, target, kind, created) VALUES ($1, $2, $3, timezone('utc', now()))
+			ON CONFLICT (username, target, kind) DO NOTHING`
+	}
+
+	_, err := db.Exec(stmt, username, target, kind)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s set %s on %s to %t", username, kind, target, on)
+
+	return nil
+}
+
+// GetFilters list the users someone has blocked or muted
+func (db *DB) GetFilters(username, kind string) ([]string, error) {
+
+	// Query statement
+	stmt := `SELECT target FROM user_filters WHERE username = $1 AND kind = $2 ORDER BY target`
+
+	// Execute query
+	rows, err := db.Query(stmt, username, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the users
+	targets := []string{}
+	for rows.Next() {
+		var target string
+		err := rows.Scan(&target)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// FilteredBy list the users who have blocked or muted someone
+func (db *DB) FilteredBy(target, kind string) (map[string]bool, error) {
+
+	// Query statement
+	stmt := `SELECT username FROM user_filters WHERE target = $1 AND kind = $2`
+
+	// Execute query
+	rows, err := db.Query(stmt, target, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the users
+	users := map[string]bool{}
+	for rows.Next() {
+		var username string
+		err := rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		users[username] = true
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Blocked check if either of two users has blocked the other
+func (db *DB) Blocked(a, b string) (bool, error) {
+
+	// Query statement
+	stmt := `SELECT EXISTS (SELECT 1 FROM user_filters WHERE kind = 'block' AND
+		((username = $1 AND target = $2) OR (username = $2 AND target = $1)))`
+
+	var blocked bool
+	err := db.QueryRow(stmt, a, b).Scan(&blocked)
+	if err != nil {
+		return false, err
+	}
+
+	return blocked, nil
+}
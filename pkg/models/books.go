@@ -7,21 +7,30 @@ import (
 	"github.com/rssnyder/louieslibrary/pkg/forms"
 )
 
+// bookColumns the columns selected for a book, with its rating summary
+const bookColumns = `b.id, b.volumeid, b.title, b.subtitle, b.publisher, b.publisheddate, b.pagecount,
+		b.maturityrating, b.authors, b.categories, b.description, b.uploader, b.price, b.isbn10, b.isbn13,
+		b.imagelink, b.downloads, b.created, COALESCE(r.count, 0) AS count, COALESCE(r.average, 0) AS average,
+		COALESCE(r.one, 0), COALESCE(r.two, 0), COALESCE(r.three, 0), COALESCE(r.four, 0), COALESCE(r.five, 0)`
+
+// scanBook pull a row selected with bookColumns into a book
+func scanBook(row interface{ Scan(...interface{}) error }) (*Book, error) {
+	b := &Book{}
+	h := &b.Rating.Histogram
+	err := row.Scan(&b.ID, &b.VolumeID, &b.Title, &b.Subtitle, &b.Publisher, &b.PublishedDate, &b.PageCount,
+		&b.MaturityRating, &b.Authors, &b.Categories, &b.Description, &b.Uploader, &b.Price, &b.ISBN10, &b.ISBN13,
+		&b.ImageLink, &b.Downloads, &b.Created, &b.Rating.Count, &b.Rating.Average,
+		&h[0], &h[1], &h[2], &h[3], &h[4])
+	return b, err
+}
+
 // GetBook retrive a book from the db
 func (db *DB) GetBook(id string) (*Book, error) {
 	// Query statement
-	stmt := `SELECT id, volumeid, title, subtitle, publisher, publisheddate, pagecount,
-		maturityrating, authors, categories, description, uploader, price, isbn10, isbn13,
-		imagelink, downloads, created FROM books WHERE volumeid = $1`
-
-	// Execute query
-	row := db.QueryRow(stmt, id)
-	b := &Book{}
+	stmt := `SELECT ` + bookColumns + ` FROM books b LEFT JOIN book_ratings r ON r.volumeid = b.volumeid WHERE b.volumeid = $1`
 
-	// Pull data into request
-	err := row.Scan(&b.ID, &b.VolumeID, &b.Title, &b.Subtitle, &b.Publisher, &b.PublishedDate, &b.PageCount,
-		&b.MaturityRating, &b.Authors, &b.Categories, &b.Description, &b.Uploader, &b.Price, &b.ISBN10, &b.ISBN13,
-		&b.ImageLink, &b.Downloads, &b.Created)
+	// Pull data into book
+	b, err := scanBook(db.QueryRow(stmt, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -33,13 +42,24 @@ func (db *DB) GetBook(id string) (*Book, error) {
 
 // LatestBooks grab the latest n books
 func (db *DB) LatestBooks(limit int) (Books, error) {
+	return db.CatalogBooks(CatalogQuery{Sort: "latest", Limit: limit})
+}
+
+// CatalogBooks grab books sorted and filtered by their ratings
+func (db *DB) CatalogBooks(query CatalogQuery) (Books, error) {
+
+	// Only known orderings make it into the statement
+	order, ok := CatalogSorts[query.Sort]
+	if !ok {
+		order = CatalogSorts["latest"]
+	}
+
 	// Query statement
-	stmt := `SELECT id, volumeid, title, subtitle, publisher, publisheddate, pagecount,
-		maturityrating, authors, categories, description, uploader, price, isbn10, isbn13,
-		imagelink, downloads, created FROM books ORDER BY created DESC LIMIT $1`
+	stmt := `SELECT ` + bookColumns + ` FROM books b LEFT JOIN book_ratings r ON r.volumeid = b.volumeid
+		WHERE COALESCE(r.average, 0) >= $1 AND COALESCE(r.count, 0) >= $2 ORDER BY ` + order + ` LIMIT $3`
 
 	// Execute query
-	rows, err := db.Query(stmt, limit)
+	rows, err := db.Query(stmt, query.MinRating, query.MinReviews, query.Limit)
 	if err != nil {
 		return nil, err
 	}
@@ -48,14 +68,11 @@ func (db *DB) LatestBooks(limit int) (Books, error) {
 	// Empty book collection
 	books := Books{}
 
-	// Get all the matching requets
+	// Get all the matching books
 	for rows.Next() {
-		b := &Book{}
 
-		// Pull data into request
-		err := rows.Scan(&b.ID, &b.VolumeID, &b.Title, &b.Subtitle, &b.Publisher, &b.PublishedDate, &b.PageCount,
-			&b.MaturityRating, &b.Authors, &b.Categories, &b.Description, &b.Uploader, &b.Price, &b.ISBN10, &b.ISBN13,
-			&b.ImageLink, &b.Downloads, &b.Created)
+		// Pull data into book
+		b, err := scanBook(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -69,7 +86,7 @@ func (db *DB) LatestBooks(limit int) (Books, error) {
 		return nil, err
 	}
 
-	// Return collection of recent books
+	// Return collection of books
 	return books, nil
 }
 
@@ -198,3 +215,44 @@ func (db *DB) GetCollection(username string) (Books, error) {
 	// Return collection for user
 	return books, nil
 }
+
+// DeleteBook remove a book and everything attached to it
+func (db *DB) DeleteBook(id string) error {
+
+	// Remove in one go
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Statements in dependency order
+	stmts := []string{
+		`DELETE FROM review_edits WHERE reviewid IN (SELECT id FROM reviews WHERE bookid = $1)`,
+		`DELETE FROM review_votes WHERE reviewid IN (SELECT id FROM reviews WHERE bookid = $1)`,
+		`DELETE FROM review_reports WHERE reviewid IN (SELECT id FROM reviews WHERE bookid = $1)`,
+		`DELETE FROM reviews WHERE bookid = $1`,
+		`DELETE FROM book_ratings WHERE volumeid = $1`,
+		`DELETE FROM comments WHERE target = 'book' AND targetid = $1`,
+		`DELETE FROM collection WHERE volumeid = $1`,
+		`INSERT INTO request_events (requestid, actor, fromstatus, tostatus, note, created) 
+			SELECT id, '', status, 'open', 'Book was deleted.', timezone('utc', now()) FROM requests WHERE bookid = $1 AND status = 'fulfilled'`,
+		`UPDATE requests SET bookid = '', status = 'open' WHERE bookid = $1 AND status = 'fulfilled'`,
+		`DELETE FROM books WHERE volumeid = $1`,
+	}
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Book %s deleted", id)
+
+	return nil
+}
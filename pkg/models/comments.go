@@ -0,0 +1,157 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+
+	"gopkg.in/guregu/null.v4"
+)
+
+// InsertComment add a comment, or a reply when parent is set
+func (db *DB) InsertComment(target, targetid string, parent null.Int, author, body string) (int, error) {
+
+	// Save stored comment
+	var id int
+
+	// Query statement
+	stmt := `INSERT INTO comments (target, targetid, parentid, author, body, deleted, created) 
+		VALUES ($1, $2, $3, $4, $5, FALSE, timezone('utc', now())) RETURNING id`
+
+	// Create new comment
+	err := db.QueryRow(stmt, target, targetid, parent, author, body).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("New comment on %s %s by %s", target, targetid, author)
+
+	return id, nil
+}
+
+// GetComment retrive a single comment
+func (db *DB) GetComment(id int) (*Comment, error) {
+
+	// Query statement
+	stmt := `SELECT id, target, targetid, parentid, author, body, edited, deleted, created FROM comments WHERE id = $1`
+
+	// Pull data into comment
+	c := &Comment{}
+	err := db.QueryRow(stmt, id).Scan(&c.ID, &c.Target, &c.TargetID, &c.ParentID, &c.Author, &c.Body, &c.Edited, &c.Deleted, &c.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// GetComments retrive every comment on a book or request, oldest first
+func (db *DB) GetComments(target, targetid string) (Comments, error) {
+
+	// Query statement
+	stmt := `SELECT id, target, targetid, parentid, author, body, edited, deleted, created FROM comments 
+		WHERE target = $1 AND targetid = $2 ORDER BY created, id`
+
+	// Execute query
+	rows, err := db.Query(stmt, target, targetid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty comment collection
+	comments := Comments{}
+
+	// Get all the matching comments
+	for rows.Next() {
+		c := &Comment{}
+
+		// Pull data into comment
+		err := rows.Scan(&c.ID, &c.Target, &c.TargetID, &c.ParentID, &c.Author, &c.Body, &c.Edited, &c.Deleted, &c.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add comment to collection
+		comments = append(comments, c)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+// UserComments retrive every comment a user has written
+func (db *DB) UserComments(username string) (Comments, error) {
+
+	// Query statement
+	stmt := `SELECT id, target, targetid, parentid, author, body, edited, deleted, created FROM comments 
+		WHERE author = $1 AND NOT deleted ORDER BY created`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty comment collection
+	comments := Comments{}
+
+	// Get all the matching comments
+	for rows.Next() {
+		c := &Comment{}
+
+		// Pull data into comment
+		err := rows.Scan(&c.ID, &c.Target, &c.TargetID, &c.ParentID, &c.Author, &c.Body, &c.Edited, &c.Deleted, &c.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add comment to collection
+		comments = append(comments, c)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+// UpdateComment change the text of a comment
+func (db *DB) UpdateComment(id int, body string) error {
+
+	// Query statement
+	stmt := `UPDATE comments SET body = $1, edited = timezone('utc', now()) WHERE id = $2 AND NOT deleted`
+
+	_, err := db.Exec(stmt, body, id)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Comment %d edited", id)
+
+	return nil
+}
+
+// DeleteComment blank a comment, keeping its place so replies stay threaded
+func (db *DB) DeleteComment(id int) error {
+
+	// Query statement
+	stmt := `UPDATE comments SET body = '', deleted = TRUE WHERE id = $1`
+
+	_, err := db.Exec(stmt, id)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Comment %d deleted", id)
+
+	return nil
+}
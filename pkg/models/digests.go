@@ -0,0 +1,119 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+)
+
+// emailPreferenceColumns the email settings of a user, users u joined to email_preferences p.
+// A digest covers what happened since it was last sent or the user last visited, whichever is later.
+const emailPreferenceColumns = `u.username, u.email, u.emailverified, COALESCE(p.frequency, 'weekly'), p.lastsent,
+	GREATEST(p.lastsent, u.lastseen, u.created)`
+
+// scanEmailPreference read a row selected with emailPreferenceColumns
+func scanEmailPreference(row interface{ Scan(...interface{}) error }) (*EmailPreference, error) {
+	e := &EmailPreference{}
+	err := row.Scan(&e.Username, &e.Email, &e.EmailVerified, &e.Frequency, &e.LastSent, &e.Since)
+	return e, err
+}
+
+// GetEmailPreference get how often a user is emailed, nil if there is no such user
+func (db *DB) GetEmailPreference(username string) (*EmailPreference, error) {
+
+	// Query statement
+	stmt := `SELECT ` + emailPreferenceColumns + ` FROM users u
+		LEFT JOIN email_preferences p ON p.username = u.username WHERE u.username = $1`
+
+	e, err := scanEmailPreference(db.QueryRow(stmt, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// SetEmailFrequency change how often a user is emailed
+func (db *DB) SetEmailFrequency(username, frequency string) error {
+
+	// Query statement
+	stmt := `INSERT INTO email_preferences (username, frequency) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET frequency = EXCLUDED.frequency`
+
+	_, err := db.Exec(stmt, username, frequency)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s set email frequency to %s", username, frequency)
+
+	return nil
+}
+
+// DueDigests users with a confirmed email whose daily or weekly digest is due
+func (db *DB) DueDigests() ([]*EmailPreference, error) {
+
+	// Query statement
+	stmt := `SELECT ` + emailPreferenceColumns + ` FROM users u
+		LEFT JOIN email_preferences p ON p.username = u.username
+		WHERE u.emailverified = TRUE AND u.email != '' AND u.role != 'deleted'
+		AND (
+			(COALESCE(p.frequency, 'weekly') = 'daily' AND (p.lastsent IS NULL OR p.lastsent < timezone('utc', now()) - interval '1 day'))
+			OR (COALESCE(p.frequency, 'weekly') = 'weekly' AND (p.lastsent IS NULL OR p.lastsent < timezone('utc', now()) - interval '7 days'))
+		)`
+
+	// Execute query
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get everyone due
+	due := []*EmailPreference{}
+	for rows.Next() {
+		e, err := scanEmailPreference(rows)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, e)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return due, nil
+}
+
+// MarkDigestSent record that a user was sent their digest
+func (db *DB) MarkDigestSent(username string) error {
+
+	// Query statement
+	stmt := `INSERT INTO email_preferences (username, frequency, lastsent) VALUES ($1, 'weekly', timezone('utc', now()))
+		ON CONFLICT (username) DO UPDATE SET lastsent = EXCLUDED.lastsent`
+
+	_, err := db.Exec(stmt, username)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TouchUser note that a user visited, at most once an hour
+func (db *DB) TouchUser(username string) error {
+
+	// Query statement
+	stmt := `UPDATE users SET lastseen = timezone('utc', now())
+		WHERE username = $1 AND (lastseen IS NULL OR lastseen < timezone('utc', now()) - interval '1 hour')`
+
+	_, err := db.Exec(stmt, username)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
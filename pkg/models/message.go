@@ -2,58 +2,121 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-// InsertMessage send a new message
-func (db *DB) InsertMessage(sender, reciver, content string) error {
+// unfiltered the sql condition that a message, by its alias, is shown to a user: they haven't deleted it
+// and haven't put any of the given filters on its sender
+func unfiltered(message, username string, kinds ...string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM message_deletions d WHERE d.messageid = %[1]s.id AND d.username = %[2]s)
+		AND NOT EXISTS (SELECT 1 FROM user_filters f WHERE f.username = %[2]s AND f.target = %[1]s.sender
+			AND f.kind IN ('%[3]s'))`, message, username, strings.Join(kinds, "', '"))
+}
 
-	// Query statement
-	stmt := `INSERT INTO messages (sender, reciver, read, content, created) VALUES ($1, $2, FALSE, $3, timezone('utc', now()))`
-
-	// Create
-	row := db.QueryRow(stmt, sender, reciver, content)
-	if row != nil {
-		err := row.Scan()
-		if err != nil && err != sql.ErrNoRows {
-			return err
+// directKey the key a one to one conversation is stored under, the same whoever starts it
+func directKey(a, b string) string {
+	users := []string{a, b}
+	sort.Strings(users)
+	return strings.Join(users, ":")
+}
+
+// DirectConversation get the one to one conversation between two users, starting it if needed
+func (db *DB) DirectConversation(a, b string) (int, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Find or start the conversation
+	var id int
+	stmt := `INSERT INTO conversations (name, direct, createdby, updated, created) VALUES ('', $1, '', timezone('utc', now()), timezone('utc', now()))
+		ON CONFLICT (direct) DO UPDATE SET direct = EXCLUDED.direct RETURNING id`
+	err = tx.QueryRow(stmt, directKey(a, b)).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// Both users take part
+	stmt = `INSERT INTO conversation_participants (conversationid, username, lastread, joined)
+		VALUES ($1, $2, 0, timezone('utc', now())) ON CONFLICT (conversationid, username) DO NOTHING`
+	for _, username := range []string{a, b} {
+		_, err = tx.Exec(stmt, id, username)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
 		}
 	}
 
-	log.Printf("%s sent a message to %s", sender, reciver)
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
 
-	// Return id of new review
-	return nil
+	return id, nil
+}
+
+// FindDirectConversation get the one to one conversation between two users, 0 when they have never talked
+func (db *DB) FindDirectConversation(a, b string) (int, error) {
+
+	// Query statement
+	stmt := `SELECT id FROM conversations WHERE direct = $1`
+
+	var id int
+	err := db.QueryRow(stmt, directKey(a, b)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return id, nil
 }
 
-// GetConversation retrives messages from a particular user
-func (db *DB) GetConversation(sender, reciver string) (Messages, error) {
+// GetConversation get a conversation as seen by one of its participants, nil when they aren't in it
+func (db *DB) GetConversation(id int, username string) (*Conversation, error) {
 
 	// Query statement
-	stmt := `SELECT sender, reciver, read, content, created FROM messages WHERE sender = $1 AND reciver = $2 OR  sender = $2 AND reciver = $1 ORDER BY created ASC`
+	stmt := `SELECT c.id, c.name, c.direct IS NOT NULL, c.createdby, c.updated, c.created,
+		COALESCE(m.id, 0), COALESCE(m.sender, ''), COALESCE(m.content, ''), COALESCE(m.created, c.created)
+		FROM conversations c INNER JOIN conversation_participants p ON p.conversationid = c.id AND p.username = $2
+		LEFT JOIN messages m ON m.id = c.lastmessage WHERE c.id = $1`
+
+	c := &Conversation{Last: &Message{ConversationID: id}}
+	err := db.QueryRow(stmt, id, username).Scan(&c.ID, &c.Name, &c.Direct, &c.CreatedBy, &c.Updated, &c.Created,
+		&c.Last.ID, &c.Last.Sender, &c.Last.Content, &c.Last.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-	// Create
-	rows, err := db.Query(stmt, sender, reciver)
+	// Everyone in it with how far they have read
+	stmt = `SELECT username, lastread, joined FROM conversation_participants WHERE conversationid = $1 ORDER BY joined, username`
+	rows, err := db.Query(stmt, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// Empty message collection
-	messages := Messages{}
-
-	// Get all the matching requets
+	c.Others = []string{}
+	c.Participants = []*Participant{}
 	for rows.Next() {
-		m := &Message{}
-
-		// Pull data into message
-		err := rows.Scan(&m.Sender, &m.Reciver, &m.Read, &m.Content, &m.Created)
+		p := &Participant{}
+		err := rows.Scan(&p.Username, &p.LastRead, &p.Joined)
 		if err != nil {
 			return nil, err
 		}
-
-		// Add book to collection
-		messages = append(messages, m)
+		p.UpToDate = p.LastRead >= c.Last.ID
+		if p.Username != username {
+			c.Others = append(c.Others, p.Username)
+		}
+		c.Participants = append(c.Participants, p)
 	}
 
 	// Catch sql errors
@@ -61,122 +124,237 @@ func (db *DB) GetConversation(sender, reciver string) (Messages, error) {
 		return nil, err
 	}
 
-	db.MarkAsRead(reciver, sender)
+	// Nothing said yet
+	if c.Last.ID == 0 {
+		c.Last = nil
+	}
+
+	return c, nil
+}
+
+// CreateGroup start a named conversation between a group of users
+func (db *DB) CreateGroup(name, creator string, members []string) (int, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Groups have no direct key so there can be any number of them
+	var id int
+	stmt := `INSERT INTO conversations (name, direct, createdby, updated, created) VALUES ($1, NULL, $2, timezone('utc', now()), timezone('utc', now())) RETURNING id`
+	err = tx.QueryRow(stmt, name, creator).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// The creator and everyone they asked
+	stmt = `INSERT INTO conversation_participants (conversationid, username, lastread, joined)
+		VALUES ($1, $2, 0, timezone('utc', now())) ON CONFLICT (conversationid, username) DO NOTHING`
+	for _, username := range append([]string{creator}, members...) {
+		_, err = tx.Exec(stmt, id, username)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("%s started group conversation %d with %d others", creator, id, len(members))
 
-	// Return id of new review
-	return messages, nil
+	return id, nil
 }
 
-// MarkAsRead sets as messages to read
-func (db *DB) MarkAsRead(sender, reciver string) {
+// AddParticipant bring a user into a group conversation, they can read its history
+func (db *DB) AddParticipant(id int, username string) error {
 
-	stmt := `UPDATE messages SET read = TRUE FROM (
-		SELECT id FROM  messages WHERE sender = $1 AND reciver = $2) AS subquery
-		WHERE messages.id = subquery.id;`
+	// Query statement
+	stmt := `INSERT INTO conversation_participants (conversationid, username, lastread, joined)
+		SELECT id, $2, 0, timezone('utc', now()) FROM conversations WHERE id = $1 AND direct IS NULL
+		ON CONFLICT (conversationid, username) DO NOTHING`
+
+	_, err := db.Exec(stmt, id, username)
+	if err != nil {
+		return err
+	}
 
-	// Create
-	db.QueryRow(stmt, sender, reciver)
+	log.Printf("%s added to conversation %d", username, id)
+
+	return nil
 }
 
-// GetThreads get the users someone has messages w
-func (db *DB) GetThreads(reciver string) (Messages, error) {
+// RemoveParticipant take a user out of a group conversation
+func (db *DB) RemoveParticipant(id int, username string) error {
+
+	// Query statement
+	stmt := `DELETE FROM conversation_participants WHERE conversationid = $1 AND username = $2
+		AND conversationid IN (SELECT id FROM conversations WHERE direct IS NULL)`
+
+	_, err := db.Exec(stmt, id, username)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s removed from conversation %d", username, id)
 
-	// Unique threads
-	var threads []string
+	return nil
+}
 
-	stmt := `SELECT DISTINCT sender FROM messages WHERE reciver = $1`
+// GetConversations list a users conversations, most recently active first, with their last message and unread count
+func (db *DB) GetConversations(username string) ([]*Conversation, error) {
 
-	// Create
-	rows, err := db.Query(stmt, reciver)
+	// Query statement
+	stmt := `SELECT c.id, c.name, c.direct IS NOT NULL, c.updated, c.created,
+		COALESCE(m.id, 0), COALESCE(m.sender, ''), COALESCE(m.content, ''), COALESCE(m.created, c.created),
+		(SELECT COUNT(*) FROM messages u WHERE u.conversationid = c.id AND u.id > p.lastread AND u.sender <> p.username
+			AND ` + unfiltered("u", "p.username", FilterBlock, FilterMute) + `),
+		COALESCE((SELECT string_agg(o.username, ',' ORDER BY o.username) FROM conversation_participants o
+			WHERE o.conversationid = c.id AND o.username <> p.username), '')
+		FROM conversation_participants p INNER JOIN conversations c ON c.id = p.conversationid
+		LEFT JOIN LATERAL (SELECT v.id, v.sender, v.content, v.created FROM messages v
+			WHERE v.conversationid = c.id AND ` + unfiltered("v", "p.username", FilterBlock) + `
+			ORDER BY v.id DESC LIMIT 1) m ON TRUE
+		WHERE p.username = $1 AND NOT (c.direct IS NOT NULL AND EXISTS (SELECT 1 FROM conversation_participants o
+			INNER JOIN user_filters f ON f.username = p.username AND f.target = o.username AND f.kind = 'block'
+			WHERE o.conversationid = c.id))
+		ORDER BY c.updated DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// Empty message collection
-	messages := Messages{}
-
-	// Get all the matching requets
+	// Get all the conversations
+	conversations := []*Conversation{}
 	for rows.Next() {
-		m := &Message{}
-
-		// Pull data into message
-		err := rows.Scan(&m.Sender)
+		c := &Conversation{Last: &Message{}}
+		var others string
+		err := rows.Scan(&c.ID, &c.Name, &c.Direct, &c.Updated, &c.Created,
+			&c.Last.ID, &c.Last.Sender, &c.Last.Content, &c.Last.Created, &c.Unread, &others)
 		if err != nil {
 			return nil, err
 		}
+		c.Last.ConversationID = c.ID
+		if c.Last.ID == 0 {
+			c.Last = nil
+		}
+		c.Others = []string{}
+		if others != "" {
+			c.Others = strings.Split(others, ",")
+		}
+		conversations = append(conversations, c)
+	}
 
-		// Add thread if unique
-		threads = AppendIfUnique(threads, m.Sender)
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	stmt = `SELECT DISTINCT reciver FROM messages WHERE sender = $1`
+	return conversations, nil
+}
+
+// InsertMessage add a message to a conversation with an optional attachment, the sender has read everything up to it
+func (db *DB) InsertMessage(conversationid int, sender, content string, attachment *Attachment) (*Message, error) {
 
-	// Create
-	rewsSecond, err := db.Query(stmt, reciver)
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer rewsSecond.Close()
 
-	// Get all the matching requets
-	for rewsSecond.Next() {
-		m := &Message{}
+	// Direct messages only go through when neither side has blocked the other
+	var blocked bool
+	stmt := `SELECT EXISTS (SELECT 1 FROM conversations c
+		INNER JOIN conversation_participants p ON p.conversationid = c.id AND p.username <> $2
+		INNER JOIN user_filters f ON f.kind = 'block' AND
+			((f.username = p.username AND f.target = $2) OR (f.username = $2 AND f.target = p.username))
+		WHERE c.id = $1 AND c.direct IS NOT NULL)`
+	err = tx.QueryRow(stmt, conversationid, sender).Scan(&blocked)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if blocked {
+		tx.Rollback()
+		return nil, ErrBlocked
+	}
 
-		// Pull data into message
-		err := rewsSecond.Scan(&m.Sender)
+	// Query statement
+	m := &Message{ConversationID: conversationid, Sender: sender, Content: content, Attachment: attachment}
+	kind, target := "", ""
+	if attachment != nil {
+		kind, target = attachment.Type, attachment.ID
+	}
+	stmt = `INSERT INTO messages (conversationid, sender, content, attachtype, attachid, created)
+		VALUES ($1, $2, $3, $4, $5, timezone('utc', now())) RETURNING id, created`
+	err = tx.QueryRow(stmt, conversationid, sender, content, kind, target).Scan(&m.ID, &m.Created)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Move the conversation along
+	stmts := []string{
+		`UPDATE conversations SET lastmessage = $2, updated = timezone('utc', now()) WHERE id = $1`,
+		`UPDATE conversation_participants SET lastread = $2 WHERE conversationid = $1 AND username = $3`,
+	}
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt, conversationid, m.ID, sender)
 		if err != nil {
+			tx.Rollback()
 			return nil, err
 		}
-
-		// Add thread if unique
-		threads = AppendIfUnique(threads, m.Sender)
 	}
 
-	// Catch sql errors
-	if err = rewsSecond.Err(); err != nil {
+	err = tx.Commit()
+	if err != nil {
 		return nil, err
 	}
 
-	for _, ele := range threads {
-		m := &Message{
-			Sender: ele,
-		}
-
-		// Add message to collection
-		messages = append(messages, m)
-	}
+	log.Printf("%s sent message %d to conversation %d", sender, m.ID, conversationid)
 
-	// Return id of new review
-	return messages, nil
+	return m, nil
 }
 
-// GetUnopened get the users unread messages
-func (db *DB) GetUnopened(reciver string) (Messages, error) {
-
-	stmt := `SELECT DISTINCT sender FROM messages WHERE reciver = $1 AND read = false`
-
-	// Create
-	rows, err := db.Query(stmt, reciver)
+// GetMessages get a page of a conversation as a user sees it, the newest messages before the cursor
+// or the newest of all when it is 0. Messages they deleted or from users they blocked are left out.
+func (db *DB) GetMessages(conversationid int, username string, before, limit int) (*MessagePage, error) {
+
+	// Query statement, one extra to tell if there are older messages
+	stmt := `SELECT m.id, m.conversationid, m.sender, m.content, m.created, m.attachtype, m.attachid,
+		COALESCE(b.title, r.title, ''), COALESCE(b.authors, r.author, ''), COALESCE(b.imagelink, ''), COALESCE(r.status, '')
+		FROM messages m
+		LEFT JOIN books b ON m.attachtype = 'book' AND b.volumeid = m.attachid
+		LEFT JOIN requests r ON m.attachtype = 'request' AND r.id::text = m.attachid
+		WHERE m.conversationid = $1 AND ($2 = 0 OR m.id < $2) AND ` + unfiltered("m", "$4", FilterBlock) + `
+		ORDER BY m.id DESC LIMIT $3`
+
+	// Execute query
+	rows, err := db.Query(stmt, conversationid, before, limit+1, username)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// Empty message collection
+	// Get all the matching messages
 	messages := Messages{}
-
-	// Get all the matching requets
 	for rows.Next() {
 		m := &Message{}
-
-		// Pull data into message
-		err := rows.Scan(&m.Sender)
+		a := &Attachment{}
+		err := rows.Scan(&m.ID, &m.ConversationID, &m.Sender, &m.Content, &m.Created, &a.Type, &a.ID,
+			&a.Title, &a.Authors, &a.ImageLink, &a.Status)
 		if err != nil {
 			return nil, err
 		}
-
-		// Add book to collection
+		if a.Type != "" {
+			m.Attachment = a
+		}
 		messages = append(messages, m)
 	}
 
@@ -185,16 +363,98 @@ func (db *DB) GetUnopened(reciver string) (Messages, error) {
 		return nil, err
 	}
 
-	// Return id of new review
-	return messages, nil
+	// Older messages continue from the oldest one shown
+	page := &MessagePage{}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.Before = messages[limit-1].ID
+	}
+
+	// Oldest first for reading
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	page.Messages = messages
+
+	return page, nil
+}
+
+// MarkRead record that a participant has read a conversation up to a message
+func (db *DB) MarkRead(conversationid int, username string, messageid int) error {
+
+	// Never move backwards or past the end
+	stmt := `UPDATE conversation_participants SET lastread = GREATEST(lastread,
+		LEAST($3, (SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversationid = $1)))
+		WHERE conversationid = $1 AND username = $2`
+
+	_, err := db.Exec(stmt, conversationid, username, messageid)
+	return err
+}
+
+// CountUnread count the messages a user has not read across their conversations
+func (db *DB) CountUnread(username string) (int, error) {
+
+	// Query statement
+	stmt := `SELECT COUNT(*) FROM conversation_participants p
+		INNER JOIN messages m ON m.conversationid = p.conversationid AND m.id > p.lastread AND m.sender <> p.username
+		WHERE p.username = $1 AND ` + unfiltered("m", "p.username", FilterBlock, FilterMute)
+
+	var count int
+	err := db.QueryRow(stmt, username).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
 }
 
-// AppendIfUnique append only if item is unique
-func AppendIfUnique(slice []string, i string) []string {
-	for _, ele := range slice {
-		if ele == i {
-			return slice
+// GetAttachment look up a book or request to attach to a message, nil when there is no such thing
+func (db *DB) GetAttachment(kind, id string) (*Attachment, error) {
+
+	a := &Attachment{Type: kind, ID: id}
+	switch kind {
+	case AttachBook:
+		book, err := db.GetBook(id)
+		if err != nil || book == nil {
+			return nil, err
+		}
+		a.Title, a.Authors, a.ImageLink = book.Title, book.Authors, book.ImageLink
+	case AttachRequest:
+		requestid, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, nil
 		}
+		request, err := db.GetRequest(requestid)
+		if err != nil || request == nil {
+			return nil, err
+		}
+		a.Title, a.Authors, a.Status = request.Title, request.Author, request.Status
+	default:
+		return nil, nil
+	}
+
+	return a, nil
+}
+
+// DeleteMessage remove a message from one participants view of a conversation, returning the conversation
+func (db *DB) DeleteMessage(messageid int, username string) (int, error) {
+
+	// Only participants can delete, and only for themselves
+	var conversationid int
+	stmt := `INSERT INTO message_deletions (messageid, username, created)
+		SELECT m.id, p.username, timezone('utc', now()) FROM messages m
+		INNER JOIN conversation_participants p ON p.conversationid = m.conversationid AND p.username = $2
+		WHERE m.id = $1
+		ON CONFLICT (messageid, username) DO UPDATE SET created = message_deletions.created RETURNING
+		(SELECT conversationid FROM messages WHERE id = $1)`
+	err := db.QueryRow(stmt, messageid, username).Scan(&conversationid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
 	}
-	return append(slice, i)
+
+	log.Printf("%s deleted message %d from their view", username, messageid)
+
+	return conversationid, nil
 }
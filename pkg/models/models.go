@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
 	"gopkg.in/guregu/null.v4"
@@ -14,30 +15,143 @@ type DB struct {
 
 // Request describe the request structure
 type Request struct {
-	ID        int
-	Requester string
-	Title     string
-	Status    string
-	BookID    string
-	Created   time.Time
+	ID           int
+	Requester    string
+	Title        string
+	Author       string
+	ISBN         string
+	Format       string
+	Edition      string
+	Language     string
+	Notes        string
+	VolumeID     string
+	Status       string
+	BookID       string
+	ClaimedBy    null.String
+	ClaimExpires null.Time
+	Reason       string
+	Votes        int
+	Voters       []string
+	Voted        bool
+	Events       []*RequestEvent
+	Created      time.Time
 }
 
 // Requests multiple requests
 type Requests []*Request
 
+// Request states
+const (
+	RequestOpen      = "open"
+	RequestClaimed   = "claimed"
+	RequestFulfilled = "fulfilled"
+	RequestRejected  = "rejected"
+)
+
+// RejectReasons reasons a request can be turned down
+var RejectReasons = []string{"unavailable", "duplicate", "invalid", "other"}
+
+// RequestEvent describe a change in a requests state
+type RequestEvent struct {
+	ID        int
+	RequestID int
+	Actor     string
+	From      string
+	To        string
+	Note      string
+	Created   time.Time
+}
+
 // User describe the user structure
 type User struct {
-	ID             int
-	Username       string
-	Email          string
-	HashedPassword []byte
-	Role           string
-	Created        time.Time
+	ID              int       `json:"id"`
+	Username        string    `json:"username"`
+	Email           string    `json:"email,omitempty"`
+	HashedPassword  []byte    `json:"-"`
+	Role            string    `json:"role"`
+	DisplayName     string    `json:"display_name"`
+	Bio             string    `json:"bio"`
+	Avatar          string    `json:"avatar,omitempty"`
+	EmailVerified   bool      `json:"email_verified"`
+	PreferredFormat string    `json:"preferred_format"`
+	Created         time.Time `json:"created"`
+}
+
+// Name the name to show for a user
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
 }
 
 // Users multiple users
 type Users []*User
 
+// Comment describe a comment on a book or request
+type Comment struct {
+	ID        int
+	Target    string
+	TargetID  string
+	ParentID  null.Int
+	Author    string
+	Body      string
+	Edited    null.Time
+	Deleted   bool
+	Editable  bool
+	Removable bool
+	Replies   []*Comment
+	Created   time.Time
+}
+
+// Comments multiple comments
+type Comments []*Comment
+
+// Things comments can be attached to
+const (
+	CommentOnBook    = "book"
+	CommentOnRequest = "request"
+)
+
+// Permissions granted to roles
+const (
+	PermUpload           = "book.upload"
+	PermEditOwnBook      = "book.edit.own"
+	PermEditAnyBook      = "book.edit.any"
+	PermDeleteBook       = "book.delete"
+	PermFillRequest      = "request.fill"
+	PermPostAnnouncement = "announcement.post"
+	PermModerateReviews  = "review.moderate"
+	PermManageUsers      = "user.manage"
+	PermModerateComments = "comment.moderate"
+	PermManageWebhooks   = "webhook.manage"
+)
+
+// Permissions every permission a role can be granted
+var Permissions = []string{PermUpload, PermEditOwnBook, PermEditAnyBook, PermDeleteBook,
+	PermFillRequest, PermPostAnnouncement, PermModerateReviews, PermManageUsers, PermModerateComments, PermManageWebhooks}
+
+// Role describe the role structure
+type Role struct {
+	Name         string
+	Permissions  []string
+	InviteQuota  int
+	InvitePeriod int
+}
+
+// Has check if a role was granted a permission
+func (r *Role) Has(permission string) bool {
+	for _, p := range r.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles multiple roles
+type Roles []*Role
+
 // Invite describe the invite structure
 type Invite struct {
 	ID        string
@@ -45,9 +159,20 @@ type Invite struct {
 	Code      string
 	Creator   string
 	Activated string
+	Email     null.String
+	Expires   null.Time
+	Revoked   bool
 	Created   time.Time
 }
 
+// Usable check if an invite can still be used to sign up
+func (i *Invite) Usable() bool {
+	if i.Activated == "true" || i.Revoked {
+		return false
+	}
+	return !i.Expires.Valid || i.Expires.Time.After(time.Now().UTC())
+}
+
 // Invites multiple invites
 type Invites []*Invite
 
@@ -71,41 +196,374 @@ type Book struct {
 	ImageLink      string
 	Downloads      int
 	Collected      bool
+	Rating         Rating
 	Created        time.Time
 }
 
 // Books multiple books
 type Books []*Book
 
+// Rating summary of the visible reviews of a book
+type Rating struct {
+	Count     int
+	Average   float64
+	Histogram [5]int
+}
+
+// RatingBar one row of a rating histogram
+type RatingBar struct {
+	Stars   int
+	Count   int
+	Percent int
+}
+
+// Bars histogram rows from five stars down to one
+func (r Rating) Bars() []RatingBar {
+	bars := []RatingBar{}
+	for stars := 5; stars >= 1; stars-- {
+		bar := RatingBar{Stars: stars, Count: r.Histogram[stars-1]}
+		if r.Count > 0 {
+			bar.Percent = bar.Count * 100 / r.Count
+		}
+		bars = append(bars, bar)
+	}
+	return bars
+}
+
+// CatalogQuery how to sort and filter a book listing
+type CatalogQuery struct {
+	Sort       string
+	MinRating  float64
+	MinReviews int
+	Limit      int
+}
+
+// CatalogSorts ways a book listing can be ordered
+var CatalogSorts = map[string]string{
+	"latest":  "b.created DESC",
+	"rating":  "average DESC, count DESC, b.created DESC",
+	"reviews": "count DESC, average DESC, b.created DESC",
+	"title":   "b.title ASC",
+}
+
 // Review describe the review structure
 type Review struct {
-	ID       int
-	BookID   string
-	Username string
-	Rating   string
-	Review   string
-	Created  time.Time
+	ID       int       `json:"id"`
+	BookID   string    `json:"book"`
+	Username string    `json:"username"`
+	Rating   int       `json:"rating"`
+	Review   string    `json:"review"`
+	Hidden   bool      `json:"hidden"`
+	Helpful  int       `json:"helpful"`
+	Voted    bool      `json:"voted"`
+	Edited   null.Time `json:"edited"`
+	Created  time.Time `json:"created"`
 }
 
 // Reviews multiple reviews
 type Reviews []*Review
 
+// ReviewOrders ways the reviews of a book can be ordered
+var ReviewOrders = map[string]string{
+	"latest":  "r.created DESC",
+	"helpful": "helpful DESC, r.created DESC",
+}
+
+// ReviewReport a review flagged for moderators
+type ReviewReport struct {
+	ID         int         `json:"id"`
+	ReviewID   int         `json:"review_id"`
+	Reporter   string      `json:"reporter"`
+	Reason     string      `json:"reason"`
+	Note       string      `json:"note"`
+	Review     *Review     `json:"review,omitempty"`
+	Resolved   null.Time   `json:"resolved"`
+	ResolvedBy null.String `json:"resolved_by"`
+	Action     string      `json:"action"`
+	Created    time.Time   `json:"created"`
+}
+
+// ReviewEdit a previous version of an edited review
+type ReviewEdit struct {
+	ID       int       `json:"id"`
+	ReviewID int       `json:"review_id"`
+	Rating   int       `json:"rating"`
+	Review   string    `json:"review"`
+	Created  time.Time `json:"created"`
+}
+
 // Message describe the message structure
 type Message struct {
-	ID      int
-	Sender  string
-	Reciver string
-	Read    bool
-	Content string
-	Created time.Time
+	ID             int         `json:"id"`
+	ConversationID int         `json:"conversation"`
+	Sender         string      `json:"sender"`
+	Content        string      `json:"content"`
+	Attachment     *Attachment `json:"attachment,omitempty"`
+	Created        time.Time   `json:"created"`
+}
+
+// Notification something that happened which a user should know about
+type Notification struct {
+	ID       int       `json:"id"`
+	Username string    `json:"username"`
+	Type     string    `json:"type"`
+	Actor    string    `json:"actor"`
+	Text     string    `json:"text"`
+	Link     string    `json:"link"`
+	Read     bool      `json:"read"`
+	Created  time.Time `json:"created"`
+}
+
+// Types of notification
+const (
+	NotifyRequestFilled = "request.filled"
+	NotifyReview        = "review"
+	NotifyAnnouncement  = "announcement"
+	NotifyMessage       = "message"
+	NotifyMention       = "mention"
+)
+
+// NotificationTypes every type of notification, in the order preferences are shown
+var NotificationTypes = []string{NotifyRequestFilled, NotifyReview, NotifyAnnouncement, NotifyMessage, NotifyMention}
+
+// NotificationLabels describe each type of notification to the user
+var NotificationLabels = map[string]string{
+	NotifyRequestFilled: "A request you made is filled",
+	NotifyReview:        "Someone reviews a book you uploaded",
+	NotifyAnnouncement:  "There is a new announcement",
+	NotifyMessage:       "You get a message",
+	NotifyMention:       "Someone mentions you in a comment",
+}
+
+// Webhook an address told about library events as they happen
+type Webhook struct {
+	ID        int
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedBy string
+	Created   time.Time
+}
+
+// WebhookDelivery one event sent, or still to be sent, to a webhook
+type WebhookDelivery struct {
+	ID           int
+	WebhookID    int
+	URL          string
+	Secret       string
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	ResponseCode null.Int
+	Error        string
+	NextAttempt  null.Time
+	Delivered    null.Time
+	Created      time.Time
+}
+
+// Events a webhook can subscribe to
+const (
+	HookBookCreated        = "book.created"
+	HookBookUpdated        = "book.updated"
+	HookRequestCreated     = "request.created"
+	HookRequestFilled      = "request.filled"
+	HookReviewCreated      = "review.created"
+	HookAnnouncementPosted = "announcement.posted"
+)
+
+// WebhookEvents every event a webhook can subscribe to
+var WebhookEvents = []string{HookBookCreated, HookBookUpdated, HookRequestCreated, HookRequestFilled, HookReviewCreated, HookAnnouncementPosted}
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySending   = "sending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// EmailPreference how often a user is emailed about their notifications
+type EmailPreference struct {
+	Username      string
+	Email         string
+	EmailVerified bool
+	Frequency     string
+	LastSent      null.Time
+	Since         time.Time
+}
+
+// How often notifications are emailed
+const (
+	EmailOff       = "off"
+	EmailImmediate = "immediate"
+	EmailDaily     = "daily"
+	EmailWeekly    = "weekly"
+)
+
+// EmailFrequencies every email option, users get the weekly digest until they pick another
+var EmailFrequencies = []string{EmailOff, EmailImmediate, EmailDaily, EmailWeekly}
+
+// Things a message can have attached
+const (
+	AttachBook    = "book"
+	AttachRequest = "request"
+)
+
+// Attachment a book or request shared in a message, with enough of it to show as a card
+type Attachment struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Authors   string `json:"authors"`
+	ImageLink string `json:"image,omitempty"`
+	Status    string `json:"status,omitempty"`
+}
+
+// Missing check if the attached book or request has since been deleted
+func (a *Attachment) Missing() bool {
+	return a.Title == ""
 }
 
 // Messages multiple messages
 type Messages []*Message
 
-// Announcement model the base announcement structure
+// Conversation a thread of messages between its participants
+type Conversation struct {
+	ID           int            `json:"id"`
+	Name         string         `json:"name"`
+	Direct       bool           `json:"direct"`
+	CreatedBy    string         `json:"created_by"`
+	Others       []string       `json:"others"`
+	Participants []*Participant `json:"participants,omitempty"`
+	Last         *Message       `json:"last,omitempty"`
+	Unread       int            `json:"unread"`
+	Updated      time.Time      `json:"updated"`
+	Created      time.Time      `json:"created"`
+}
+
+// Title what to call a conversation, its name or who else is in it
+func (c *Conversation) Title() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if len(c.Others) == 0 {
+		return "Deleted User"
+	}
+	return strings.Join(c.Others, ", ")
+}
+
+// Participant someone in a conversation and the last message they read
+type Participant struct {
+	Username string    `json:"username"`
+	LastRead int       `json:"last_read"`
+	UpToDate bool      `json:"up_to_date"`
+	Joined   time.Time `json:"joined"`
+}
+
+// MessagePage one page of a conversation, oldest message first
+type MessagePage struct {
+	Messages Messages `json:"messages"`
+	Before   int      `json:"before,omitempty"`
+}
+
+// RefreshToken describe the refresh token structure
+type RefreshToken struct {
+	ID         int
+	Username   string
+	TokenHash  string
+	Family     string
+	Expires    time.Time
+	Revoked    bool
+	ReplacedBy null.String
+	Created    time.Time
+}
+
+// API token scopes
+const (
+	ScopeReadCatalog    = "catalog:read"
+	ScopeDownload       = "books:download"
+	ScopeUpload         = "books:upload"
+	ScopeManageRequests = "requests:manage"
+	ScopeMessages       = "messages"
+	ScopeReviews        = "reviews:write"
+)
+
+// Scopes every scope a token can be granted
+var Scopes = []string{ScopeReadCatalog, ScopeDownload, ScopeUpload, ScopeManageRequests, ScopeMessages, ScopeReviews}
+
+// APIToken describe the personal access token structure
+type APIToken struct {
+	ID        int
+	Username  string
+	Name      string
+	TokenHash string
+	Scopes    []string
+	LastUsed  null.Time
+	Expires   null.Time
+	Created   time.Time
+}
+
+// HasScope check if a token was granted a scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APITokens multiple api tokens
+type APITokens []*APIToken
+
+// Download describe a book downloaded by a user
+type Download struct {
+	Username string
+	VolumeID string
+	Title    string
+	Created  time.Time
+}
+
+// Downloads multiple downloads
+type Downloads []*Download
+
+// DataExport describe a users request for a copy of their data
+type DataExport struct {
+	ID        int
+	Username  string
+	Status    string
+	Key       string
+	Created   time.Time
+	Completed null.Time
+}
+
+// DataExports multiple data exports
+type DataExports []*DataExport
+
+// Announcement model the base announcement structure, shown between starts and ends to the roles listed or everyone
 type Announcement struct {
-	Author  string
-	Content string
-	Created time.Time
+	ID        int       `json:"id"`
+	Author    string    `json:"author"`
+	Content   string    `json:"content"`
+	Severity  string    `json:"severity"`
+	Roles     []string  `json:"roles"`
+	Starts    time.Time `json:"starts"`
+	Ends      null.Time `json:"ends"`
+	Announced bool      `json:"-"`
+	Edited    null.Time `json:"edited"`
+	Created   time.Time `json:"created"`
+}
+
+// Status whether an announcement is scheduled, showing or over
+func (a *Announcement) Status() string {
+	now := time.Now().UTC()
+	if a.Starts.After(now) {
+		return "scheduled"
+	}
+	if a.Ends.Valid && !a.Ends.Time.After(now) {
+		return "ended"
+	}
+	return "active"
 }
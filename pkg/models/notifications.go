@@ -0,0 +1,247 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// InsertNotification tell a user something happened, unless they turned that type off.
+// An unread notification about the same link is brought up to date instead of adding another,
+// fresh is only true for a new one. Returns 0 when nothing was saved.
+func (db *DB) InsertNotification(n *Notification) (id int, fresh bool, err error) {
+
+	// Query statement
+	stmt := `UPDATE notifications SET actor = $4, text = $5, created = timezone('utc', now())
+		WHERE username = $1 AND type = $2 AND link = $3 AND read = FALSE
+		AND NOT EXISTS (SELECT 1 FROM notification_preferences p WHERE p.username = $1 AND p.type = $2 AND p.enabled = FALSE)
+		RETURNING id`
+
+	err = db.QueryRow(stmt, n.Username, n.Type, n.Link, n.Actor, n.Text).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	} else if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	// Query statement
+	stmt = `INSERT INTO notifications (username, type, actor, text, link, read, created)
+		SELECT $1, $2, $3, $4, $5, FALSE, timezone('utc', now())
+		WHERE NOT EXISTS (SELECT 1 FROM notification_preferences p WHERE p.username = $1 AND p.type = $2 AND p.enabled = FALSE)
+		RETURNING id`
+
+	err = db.QueryRow(stmt, n.Username, n.Type, n.Actor, n.Text, n.Link).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	log.Printf("Notified %s of %s: %s", n.Username, n.Type, n.Text)
+
+	return id, true, nil
+}
+
+// NotifyAll tell every active user except the actor something happened, returning who was told.
+// Only users with one of the roles are told when any are given.
+func (db *DB) NotifyAll(kind, actor, text, link string, roles []string) ([]string, error) {
+
+	// Query statement
+	stmt := `INSERT INTO notifications (username, type, actor, text, link, read, created)
+		SELECT u.username, $1, $2, $3, $4, FALSE, timezone('utc', now()) FROM users u
+		WHERE u.username != $2 AND u.role != 'deleted' AND (cardinality($5::text[]) = 0 OR u.role = ANY($5))
+		AND NOT EXISTS (SELECT 1 FROM notification_preferences p WHERE p.username = u.username AND p.type = $1 AND p.enabled = FALSE)
+		RETURNING username`
+
+	// Execute query
+	rows, err := db.Query(stmt, kind, actor, text, link, pq.Array(roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get everyone notified
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		err := rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Notified %d users of %s: %s", len(usernames), kind, text)
+
+	return usernames, nil
+}
+
+// GetNotification get one of a users notifications, nil if it isn't theirs
+func (db *DB) GetNotification(id int, username string) (*Notification, error) {
+
+	// Query statement
+	stmt := `SELECT id, username, type, actor, text, link, read, created FROM notifications WHERE id = $1 AND username = $2`
+
+	n := &Notification{}
+	err := db.QueryRow(stmt, id, username).Scan(&n.ID, &n.Username, &n.Type, &n.Actor, &n.Text, &n.Link, &n.Read, &n.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// GetNotifications get a users latest notifications, newest first
+func (db *DB) GetNotifications(username string, limit int) ([]*Notification, error) {
+
+	// Query statement
+	stmt := `SELECT id, username, type, actor, text, link, read, created FROM notifications
+		WHERE username = $1 ORDER BY created DESC LIMIT $2`
+
+	// Execute query
+	rows, err := db.Query(stmt, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the notifications
+	notifications := []*Notification{}
+	for rows.Next() {
+		n := &Notification{}
+		err := rows.Scan(&n.ID, &n.Username, &n.Type, &n.Actor, &n.Text, &n.Link, &n.Read, &n.Created)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+// CountUnreadNotifications count the notifications a user hasn't read
+func (db *DB) CountUnreadNotifications(username string) (int, error) {
+
+	// Query statement
+	stmt := `SELECT COUNT(*) FROM notifications WHERE username = $1 AND read = FALSE`
+
+	var count int
+	err := db.QueryRow(stmt, username).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// MarkNotificationsRead mark one of a users notifications read, or all of them for id 0
+func (db *DB) MarkNotificationsRead(username string, id int) error {
+
+	// Query statement
+	stmt := `UPDATE notifications SET read = TRUE WHERE username = $1 AND read = FALSE AND ($2 = 0 OR id = $2)`
+
+	_, err := db.Exec(stmt, username, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkLinkRead mark a users notifications about a page read once they have seen it
+func (db *DB) MarkLinkRead(username, link string) error {
+
+	// Query statement
+	stmt := `UPDATE notifications SET read = TRUE WHERE username = $1 AND link = $2 AND read = FALSE`
+
+	_, err := db.Exec(stmt, username, link)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetNotificationPreferences which types of notification a user gets, everything is on until turned off
+func (db *DB) GetNotificationPreferences(username string) (map[string]bool, error) {
+
+	preferences := map[string]bool{}
+	for _, kind := range NotificationTypes {
+		preferences[kind] = true
+	}
+
+	// Query statement
+	stmt := `SELECT type, enabled FROM notification_preferences WHERE username = $1`
+
+	// Execute query
+	rows, err := db.Query(stmt, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Apply what the user changed
+	for rows.Next() {
+		var kind string
+		var enabled bool
+		err := rows.Scan(&kind, &enabled)
+		if err != nil {
+			return nil, err
+		}
+		preferences[kind] = enabled
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return preferences, nil
+}
+
+// SetNotificationPreferences save which types of notification a user gets
+func (db *DB) SetNotificationPreferences(username string, preferences map[string]bool) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Query statement
+	stmt := `INSERT INTO notification_preferences (username, type, enabled) VALUES ($1, $2, $3)
+		ON CONFLICT (username, type) DO UPDATE SET enabled = EXCLUDED.enabled`
+
+	for _, kind := range NotificationTypes {
+		enabled, ok := preferences[kind]
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(stmt, username, kind, enabled)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s updated notification preferences", username)
+
+	return nil
+}
@@ -2,29 +2,63 @@ package models
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"time"
+
+	"github.com/rssnyder/louieslibrary/pkg/forms"
+	"github.com/rssnyder/louieslibrary/pkg/isbn"
+	"gopkg.in/guregu/null.v4"
+)
+
+// Errors returned when a request cant change state
+var (
+	ErrRequestTransition = errors.New("Request can't move to that state")
+	ErrRequestClaimed    = errors.New("Request is claimed by someone else")
+	ErrNoRequest         = errors.New("Request does not exist")
 )
 
+// requestTransitions the states a request may move to from each state
+var requestTransitions = map[string][]string{
+	RequestOpen:      {RequestClaimed, RequestFulfilled, RequestRejected},
+	RequestClaimed:   {RequestOpen, RequestFulfilled, RequestRejected},
+	RequestFulfilled: {RequestOpen},
+	RequestRejected:  {RequestOpen},
+}
+
+// CanTransition check if a request in one state may move to another
+func CanTransition(from, to string) bool {
+	for _, state := range requestTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
 // GetRequest retrive a request from the db
 func (db *DB) GetRequest(id int) (*Request, error) {
 
 	// Query statement
-	stmt := `SELECT id, requester, title, status, bookid, created FROM requests WHERE id = $1`
+	stmt := `SELECT id, requester, title, author, isbn, format, edition, language, notes, volumeid, 
+		status, bookid, claimedby, claimexpires, reason, created, 
+		(SELECT COUNT(*) FROM request_votes WHERE requestid = requests.id) FROM requests WHERE id = $1`
 
 	// Execute query
 	row := db.QueryRow(stmt, id)
 	r := &Request{}
 
 	// Pull data into request
-	err := row.Scan(&r.ID, &r.Requester, &r.Title, &r.Status, &r.BookID, &r.Created)
+	err := row.Scan(&r.ID, &r.Requester, &r.Title, &r.Author, &r.ISBN, &r.Format, &r.Edition, &r.Language, &r.Notes, &r.VolumeID,
+		&r.Status, &r.BookID, &r.ClaimedBy, &r.ClaimExpires, &r.Reason, &r.Created, &r.Votes)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	log.Printf("BOOKID IS %s", r.BookID)
-
 	// Return review
 	return r, nil
 }
@@ -33,10 +67,39 @@ func (db *DB) GetRequest(id int) (*Request, error) {
 func (db *DB) LatestRequests(limit int) (Requests, error) {
 
 	// Query statement
-	stmt := `SELECT id, requester, title, status, created FROM requests ORDER BY created DESC LIMIT $1`
+	stmt := `SELECT id, requester, title, author, isbn, volumeid, status, created, 
+		(SELECT COUNT(*) FROM request_votes WHERE requestid = requests.id) FROM requests ORDER BY created DESC LIMIT $1`
+
+	return db.queryRequests(stmt, limit)
+}
+
+// RequestsByDemand grab n requests with the most votes first, open requests ahead of closed ones
+func (db *DB) RequestsByDemand(limit int) (Requests, error) {
+
+	// Query statement
+	stmt := `SELECT id, requester, title, author, isbn, volumeid, status, created, 
+		(SELECT COUNT(*) FROM request_votes WHERE requestid = requests.id) AS votes FROM requests 
+		ORDER BY status NOT IN ('open', 'claimed'), votes DESC, created DESC LIMIT $1`
+
+	return db.queryRequests(stmt, limit)
+}
+
+// OpenRequests grab every request still being worked on
+func (db *DB) OpenRequests() (Requests, error) {
+
+	// Query statement
+	stmt := `SELECT id, requester, title, author, isbn, volumeid, status, created, 
+		(SELECT COUNT(*) FROM request_votes WHERE requestid = requests.id) FROM requests 
+		WHERE status IN ('open', 'claimed') ORDER BY created DESC`
+
+	return db.queryRequests(stmt)
+}
+
+// queryRequests run a request listing query
+func (db *DB) queryRequests(stmt string, args ...interface{}) (Requests, error) {
 
 	// Execute query
-	rows, err := db.Query(stmt, limit)
+	rows, err := db.Query(stmt, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +113,7 @@ func (db *DB) LatestRequests(limit int) (Requests, error) {
 		r := &Request{}
 
 		// Pull data into request
-		err := rows.Scan(&r.ID, &r.Requester, &r.Title, &r.Status, &r.Created)
+		err := rows.Scan(&r.ID, &r.Requester, &r.Title, &r.Author, &r.ISBN, &r.VolumeID, &r.Status, &r.Created, &r.Votes)
 		if err != nil {
 			return nil, err
 		}
@@ -67,40 +130,255 @@ func (db *DB) LatestRequests(limit int) (Requests, error) {
 	return requests, nil
 }
 
-// InsertRequest add new request to the db
-func (db *DB) InsertRequest(requester, title, source string) (int, error) {
+// InsertRequest add new request to the db, the requester votes for it
+func (db *DB) InsertRequest(form *forms.NewRequest, source string) (int, error) {
 
 	// Save stored request
 	var requestid int
 
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
 	// Query statement
-	stmt := `INSERT INTO requests (requester, title, source, status, bookid, created) VALUES ($1, $2, $3, 'missing', '', timezone('utc', now())) RETURNING id`
+	stmt := `INSERT INTO requests (requester, title, author, isbn, format, edition, language, notes, volumeid, source, status, bookid, created) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'open', '', timezone('utc', now())) RETURNING id`
 
 	// Create new request
-	err := db.QueryRow(stmt, requester, title, source).Scan(&requestid)
+	err = tx.QueryRow(stmt, form.Requester, form.Title, form.Author, isbn.Normalize(form.ISBN), form.Format, form.Edition,
+		form.Language, form.Notes, form.VolumeID, source).Scan(&requestid)
 	if err != nil {
+		tx.Rollback()
 		return 0, err
 	}
 
-	log.Printf("New request submitted by %s", requester)
+	// Count the requester as the first vote
+	stmt = `INSERT INTO request_votes (requestid, username, created) VALUES ($1, $2, timezone('utc', now()))`
+	_, err = tx.Exec(stmt, requestid, form.Requester)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("New request submitted by %s", form.Requester)
 
 	// Return new request id
 	return requestid, nil
 }
 
-// FillRequest link a request to a book
-func (db *DB) FillRequest(requestid int, bookid string) string {
+// RequestChange the details that go with a state change
+type RequestChange struct {
+	Actor        string
+	To           string
+	BookID       string
+	Reason       string
+	Note         string
+	ClaimExpires time.Time
+}
+
+// TransitionRequest move a request to a new state and record it in the history
+func (db *DB) TransitionRequest(requestid int, change RequestChange) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Lock the request while we change it
+	var from string
+	var claimedBy null.String
+	var claimExpires null.Time
+	stmt := `SELECT status, claimedby, claimexpires FROM requests WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRow(stmt, requestid).Scan(&from, &claimedBy, &claimExpires)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return ErrNoRequest
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if !CanTransition(from, change.To) {
+		tx.Rollback()
+		return ErrRequestTransition
+	}
+
+	// Only the claimer can move a claimed request on until their claim runs out
+	if from == RequestClaimed && claimedBy.String != change.Actor && claimExpires.Time.After(time.Now().UTC()) {
+		tx.Rollback()
+		return ErrRequestClaimed
+	}
+
+	// Work out the new columns for the state
+	bookid, reason := "", ""
+	claimer, expires := null.String{}, null.Time{}
+	note := change.Note
+	switch change.To {
+	case RequestClaimed:
+		claimer = null.StringFrom(change.Actor)
+		expires = null.TimeFrom(change.ClaimExpires)
+	case RequestFulfilled:
+		bookid = change.BookID
+		note = strings.TrimSpace(fmt.Sprintf("Filled with %s. %s", bookid, note))
+	case RequestRejected:
+		reason = change.Reason
+		note = strings.TrimSpace(fmt.Sprintf("Rejected as %s. %s", reason, note))
+	}
+
+	stmt = `UPDATE requests SET status = $1, bookid = $2, reason = $3, claimedby = $4, claimexpires = $5 WHERE id = $6`
+	_, err = tx.Exec(stmt, change.To, bookid, reason, claimer, expires, requestid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	stmt = `INSERT INTO request_events (requestid, actor, fromstatus, tostatus, note, created) VALUES ($1, $2, $3, $4, $5, timezone('utc', now()))`
+	_, err = tx.Exec(stmt, requestid, change.Actor, from, change.To, note)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Request %d moved from %s to %s by %s", requestid, from, change.To, change.Actor)
+
+	return nil
+}
+
+// ReleaseExpiredClaims reopen requests whose claim ran out
+func (db *DB) ReleaseExpiredClaims() error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Reopen and record each released request
+	stmt := `WITH released AS (
+			UPDATE requests SET status = 'open', claimedby = NULL, claimexpires = NULL 
+			WHERE status = 'claimed' AND claimexpires < timezone('utc', now()) RETURNING id
+		) 
+		INSERT INTO request_events (requestid, actor, fromstatus, tostatus, note, created) 
+		SELECT id, '', 'claimed', 'open', 'Claim expired.', timezone('utc', now()) FROM released`
+	res, err := tx.Exec(stmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if released, _ := res.RowsAffected(); released > 0 {
+		log.Printf("Released %d expired request claims", released)
+	}
+
+	return nil
+}
+
+// GetRequestEvents list the history of a request, oldest first
+func (db *DB) GetRequestEvents(requestid int) ([]*RequestEvent, error) {
 
 	// Query statement
-	stmt := `UPDATE requests SET bookid = $1, status = 'found' WHERE id = $2`
+	stmt := `SELECT id, requestid, actor, fromstatus, tostatus, note, created FROM request_events WHERE requestid = $1 ORDER BY created, id`
+
+	// Execute query
+	rows, err := db.Query(stmt, requestid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the events
+	events := []*RequestEvent{}
+	for rows.Next() {
+		e := &RequestEvent{}
+		err := rows.Scan(&e.ID, &e.RequestID, &e.Actor, &e.From, &e.To, &e.Note, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
 
-	// Link
-	err := db.QueryRow(stmt, bookid, requestid)
-	if err == nil {
-		return ""
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
 
-	log.Printf("Request %d filled", requestid)
+	return events, nil
+}
+
+// VoteRequest toggle a users vote on a request, returns whether they now have a vote
+func (db *DB) VoteRequest(requestid int, username string) (bool, error) {
+
+	// Take back an existing vote
+	stmt := `DELETE FROM request_votes WHERE requestid = $1 AND username = $2`
+	res, err := db.Exec(stmt, requestid, username)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if removed > 0 {
+		log.Printf("%s removed their vote for request %d", username, requestid)
+		return false, nil
+	}
+
+	// Otherwise add one
+	stmt = `INSERT INTO request_votes (requestid, username, created) VALUES ($1, $2, timezone('utc', now())) 
+		ON CONFLICT (requestid, username) DO NOTHING`
+	_, err = db.Exec(stmt, requestid, username)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("%s voted for request %d", username, requestid)
+
+	return true, nil
+}
+
+// GetRequestVoters list the users who voted for a request, oldest vote first
+func (db *DB) GetRequestVoters(requestid int) ([]string, error) {
+
+	// Query statement
+	stmt := `SELECT username FROM request_votes WHERE requestid = $1 ORDER BY created`
+
+	// Execute query
+	rows, err := db.Query(stmt, requestid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the voters
+	voters := []string{}
+	for rows.Next() {
+		var username string
+		err := rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		voters = append(voters, username)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return bookid
+	return voters, nil
 }
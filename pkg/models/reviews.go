@@ -9,7 +9,7 @@ import (
 func (db *DB) GetReview(bookid string) (*Review, error) {
 
 	// Query statement
-	stmt := `SELECT bookid, username, rating, review, created FROM reviews WHERE bookid = $1`
+	stmt := `SELECT bookid, username, COALESCE(rating, 0), review, created FROM reviews WHERE bookid = $1`
 
 	// Execute query
 	row := db.QueryRow(stmt, bookid)
@@ -26,14 +26,43 @@ func (db *DB) GetReview(bookid string) (*Review, error) {
 	return r, nil
 }
 
-// LatestReviews grab latest n reviews
-func (db *DB) LatestReviews(bookid string, limit int) (Reviews, error) {
+// GetReviewByID get a single review
+func (db *DB) GetReviewByID(id int) (*Review, error) {
 
 	// Query statement
-	stmt := `SELECT bookid, username, rating, review, created FROM reviews WHERE bookid = $1 ORDER BY created DESC LIMIT $2`
+	stmt := `SELECT r.id, r.bookid, r.username, COALESCE(r.rating, 0), r.review, r.hidden, ` + helpfulColumn + `, r.edited, r.created 
+		FROM reviews r WHERE r.id = $1`
+
+	// Pull data into review
+	r := &Review{}
+	err := db.QueryRow(stmt, id).Scan(&r.ID, &r.BookID, &r.Username, &r.Rating, &r.Review, &r.Hidden, &r.Helpful, &r.Edited, &r.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// helpfulColumn counts the helpful votes of the review aliased r
+const helpfulColumn = `(SELECT COUNT(*) FROM review_votes v WHERE v.reviewid = r.id) AS helpful`
+
+// LatestReviews grab n reviews in the given order, hidden ones only when asked for
+func (db *DB) LatestReviews(bookid string, limit int, hidden bool, order string) (Reviews, error) {
+
+	// Only known orderings make it into the statement
+	orderBy, ok := ReviewOrders[order]
+	if !ok {
+		orderBy = ReviewOrders["latest"]
+	}
+
+	// Query statement
+	stmt := `SELECT r.id, r.bookid, r.username, COALESCE(r.rating, 0), r.review, r.hidden, ` + helpfulColumn + `, r.edited, r.created 
+		FROM reviews r WHERE r.bookid = $1 AND (NOT r.hidden OR $3) ORDER BY ` + orderBy + ` LIMIT $2`
 
 	// Execute query
-	rows, err := db.Query(stmt, bookid, limit)
+	rows, err := db.Query(stmt, bookid, limit, hidden)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +76,7 @@ func (db *DB) LatestReviews(bookid string, limit int) (Reviews, error) {
 		r := &Review{}
 
 		// Pull data into request
-		err := rows.Scan(&r.BookID, &r.Username, &r.Rating, &r.Review, &r.Created)
+		err := rows.Scan(&r.ID, &r.BookID, &r.Username, &r.Rating, &r.Review, &r.Hidden, &r.Helpful, &r.Edited, &r.Created)
 		if err != nil {
 			return nil, err
 		}
@@ -68,8 +97,8 @@ func (db *DB) LatestReviews(bookid string, limit int) (Reviews, error) {
 func (db *DB) UserLatestReviews(username string, limit int) (Reviews, error) {
 
 	// Query statement
-	stmt := `SELECT r.bookid id, r.rating, r.review, r.created, b.title FROM reviews r 
-	INNER JOIN books b ON r.bookid = b.volumeid AND r.username = $1 ORDER BY created DESC LIMIT $2`
+	stmt := `SELECT r.bookid id, COALESCE(r.rating, 0), r.review, r.created, b.title FROM reviews r 
+	INNER JOIN books b ON r.bookid = b.volumeid AND r.username = $1 WHERE NOT r.hidden ORDER BY created DESC LIMIT $2`
 
 	// Execute query
 	rows, err := db.Query(stmt, username, limit)
@@ -103,23 +132,390 @@ func (db *DB) UserLatestReviews(username string, limit int) (Reviews, error) {
 	return reviews, nil
 }
 
-// InsertReview add a new review
-func (db *DB) InsertReview(bookid, username, rating, review string) (int, error) {
+// InsertReview add a users review of a book, replacing their earlier one and keeping it as history
+func (db *DB) InsertReview(bookid, username string, rating int, review string) (int, bool, error) {
 
-	// Save stored request
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Look for an existing review to replace
 	var reviewid int
+	stmt := `SELECT id FROM reviews WHERE bookid = $1 AND username = $2 FOR UPDATE`
+	err = tx.QueryRow(stmt, bookid, username).Scan(&reviewid)
+	if err == sql.ErrNoRows {
+
+		// First review of this book
+		stmt = `INSERT INTO reviews (bookid, username, rating, review, hidden, created) VALUES ($1, $2, $3, $4, FALSE, timezone('utc', now())) RETURNING id`
+		err = tx.QueryRow(stmt, bookid, username, rating, review).Scan(&reviewid)
+		if err != nil {
+			tx.Rollback()
+			return 0, false, err
+		}
+
+		err = refreshBookRating(tx, bookid)
+		if err != nil {
+			tx.Rollback()
+			return 0, false, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return 0, false, err
+		}
+
+		log.Printf("New review added by %s", username)
+
+		return reviewid, false, nil
+	} else if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+
+	err = updateReview(tx, reviewid, rating, review)
+	if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, err
+	}
+
+	log.Printf("Review %d replaced by %s", reviewid, username)
+
+	return reviewid, true, nil
+}
+
+// UpdateReview change a review, keeping the old version as history
+func (db *DB) UpdateReview(id, rating int, review string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = updateReview(tx, id, rating, review)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Review %d edited", id)
+
+	return nil
+}
+
+// updateReview save the current version of a review to its history and overwrite it
+func updateReview(tx *sql.Tx, id, rating int, review string) error {
+
+	stmt := `INSERT INTO review_edits (reviewid, rating, review, created) 
+		SELECT id, rating, review, COALESCE(edited, created) FROM reviews WHERE id = $1`
+	_, err := tx.Exec(stmt, id)
+	if err != nil {
+		return err
+	}
+
+	var bookid string
+	stmt = `UPDATE reviews SET rating = $1, review = $2, edited = timezone('utc', now()) WHERE id = $3 RETURNING bookid`
+	err = tx.QueryRow(stmt, rating, review, id).Scan(&bookid)
+	if err != nil {
+		return err
+	}
+
+	return refreshBookRating(tx, bookid)
+}
+
+// refreshBookRating recount the rating summary of a book from its visible, rated reviews
+func refreshBookRating(tx *sql.Tx, bookid string) error {
+
+	stmt := `INSERT INTO book_ratings (volumeid, count, average, one, two, three, four, five)
+		SELECT $1, COUNT(rating), COALESCE(AVG(rating), 0),
+			COUNT(*) FILTER (WHERE rating = 1), COUNT(*) FILTER (WHERE rating = 2), COUNT(*) FILTER (WHERE rating = 3),
+			COUNT(*) FILTER (WHERE rating = 4), COUNT(*) FILTER (WHERE rating = 5)
+		FROM reviews WHERE bookid = $1 AND NOT hidden
+		ON CONFLICT (volumeid) DO UPDATE SET count = EXCLUDED.count, average = EXCLUDED.average, one = EXCLUDED.one,
+			two = EXCLUDED.two, three = EXCLUDED.three, four = EXCLUDED.four, five = EXCLUDED.five`
+	_, err := tx.Exec(stmt, bookid)
+	return err
+}
+
+// DeleteReview remove a review and its history
+func (db *DB) DeleteReview(id int) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// History, votes and reports go first
+	stmts := []string{
+		`DELETE FROM review_edits WHERE reviewid = $1`,
+		`DELETE FROM review_votes WHERE reviewid = $1`,
+		`DELETE FROM review_reports WHERE reviewid = $1`,
+	}
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// Remove the review and recount its book
+	var bookid string
+	stmt := `DELETE FROM reviews WHERE id = $1 RETURNING bookid`
+	err = tx.QueryRow(stmt, id).Scan(&bookid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = refreshBookRating(tx, bookid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Review %d deleted", id)
+
+	return nil
+}
+
+// HideReview hide or show a review
+func (db *DB) HideReview(id int, hidden bool) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Hidden reviews drop out of the book rating
+	var bookid string
+	stmt := `UPDATE reviews SET hidden = $1 WHERE id = $2 RETURNING bookid`
+	err = tx.QueryRow(stmt, hidden, id).Scan(&bookid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = refreshBookRating(tx, bookid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Review %d hidden set to %t", id, hidden)
+
+	return nil
+}
+
+// GetReviewEdits list earlier versions of a review, newest first
+func (db *DB) GetReviewEdits(id int) ([]*ReviewEdit, error) {
+
+	// Query statement
+	stmt := `SELECT id, reviewid, COALESCE(rating, 0), review, created FROM review_edits WHERE reviewid = $1 ORDER BY created DESC, id DESC`
+
+	// Execute query
+	rows, err := db.Query(stmt, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the versions
+	edits := []*ReviewEdit{}
+	for rows.Next() {
+		e := &ReviewEdit{}
+		err := rows.Scan(&e.ID, &e.ReviewID, &e.Rating, &e.Review, &e.Created)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return edits, nil
+}
+
+// HelpfulVotes the reviews of a book a user found helpful
+func (db *DB) HelpfulVotes(bookid, username string) (map[int]bool, error) {
+
+	// Query statement
+	stmt := `SELECT v.reviewid FROM review_votes v INNER JOIN reviews r ON r.id = v.reviewid 
+		WHERE r.bookid = $1 AND v.username = $2`
+
+	// Execute query
+	rows, err := db.Query(stmt, bookid, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the votes
+	votes := map[int]bool{}
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		votes[id] = true
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return votes, nil
+}
+
+// VoteReview toggle a users helpful vote on a review, reporting whether the vote now stands
+func (db *DB) VoteReview(reviewid int, username string) (bool, error) {
+
+	// Take back an existing vote
+	stmt := `DELETE FROM review_votes WHERE reviewid = $1 AND username = $2`
+	res, err := db.Exec(stmt, reviewid, username)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if removed > 0 {
+		log.Printf("%s removed their helpful vote for review %d", username, reviewid)
+		return false, nil
+	}
+
+	// Otherwise add one
+	stmt = `INSERT INTO review_votes (reviewid, username, created) VALUES ($1, $2, timezone('utc', now())) 
+		ON CONFLICT (reviewid, username) DO NOTHING`
+	_, err = db.Exec(stmt, reviewid, username)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("%s found review %d helpful", username, reviewid)
+
+	return true, nil
+}
+
+// ReportReview queue a review for moderators, once per reporter until it is dealt with
+func (db *DB) ReportReview(reviewid int, reporter, reason, note string) (bool, error) {
+
+	// Query statement
+	stmt := `INSERT INTO review_reports (reviewid, reporter, reason, note, action, created) 
+		SELECT $1, $2, $3, $4, '', timezone('utc', now()) WHERE NOT EXISTS 
+		(SELECT 1 FROM review_reports WHERE reviewid = $1 AND reporter = $2 AND resolved IS NULL)`
+
+	res, err := db.Exec(stmt, reviewid, reporter, reason, note)
+	if err != nil {
+		return false, err
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if added == 0 {
+		return false, nil
+	}
+
+	log.Printf("Review %d reported by %s for %s", reviewid, reporter, reason)
+
+	return true, nil
+}
+
+// OpenReports list the reports waiting on a moderator, oldest first
+func (db *DB) OpenReports() ([]*ReviewReport, error) {
+
+	// Query statement
+	stmt := `SELECT p.id, p.reviewid, p.reporter, p.reason, p.note, p.action, p.created, 
+		r.id, r.bookid, r.username, r.rating, r.review, r.hidden, r.created 
+		FROM review_reports p INNER JOIN reviews r ON r.id = p.reviewid 
+		WHERE p.resolved IS NULL ORDER BY p.created, p.id`
+
+	return db.queryReports(stmt)
+}
+
+// UserReports list the reports a user has filed
+func (db *DB) UserReports(username string) ([]*ReviewReport, error) {
+
+	// Query statement
+	stmt := `SELECT p.id, p.reviewid, p.reporter, p.reason, p.note, p.action, p.created, 
+		r.id, r.bookid, r.username, r.rating, r.review, r.hidden, r.created 
+		FROM review_reports p INNER JOIN reviews r ON r.id = p.reviewid 
+		WHERE p.reporter = $1 ORDER BY p.created DESC`
+
+	return db.queryReports(stmt, username)
+}
+
+// queryReports run a report query, pulling each row into a report with its review
+func (db *DB) queryReports(stmt string, args ...interface{}) ([]*ReviewReport, error) {
+
+	// Execute query
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the reports
+	reports := []*ReviewReport{}
+	for rows.Next() {
+		p := &ReviewReport{Review: &Review{}}
+		r := p.Review
+		err := rows.Scan(&p.ID, &p.ReviewID, &p.Reporter, &p.Reason, &p.Note, &p.Action, &p.Created,
+			&r.ID, &r.BookID, &r.Username, &r.Rating, &r.Review, &r.Hidden, &r.Created)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, p)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// ResolveReports close every open report on a review with the action a moderator took
+func (db *DB) ResolveReports(reviewid int, moderator, action string) error {
 
 	// Query statement
-	stmt := `INSERT INTO reviews (bookid, username, rating, review, created) VALUES ($1, $2, $3, $4, timezone('utc', now())) RETURNING id`
+	stmt := `UPDATE review_reports SET resolved = timezone('utc', now()), resolvedby = $2, action = $3 
+		WHERE reviewid = $1 AND resolved IS NULL`
 
-	// Create
-	err := db.QueryRow(stmt, bookid, username, rating, review).Scan(&reviewid)
+	_, err := db.Exec(stmt, reviewid, moderator, action)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	log.Printf("New review added by %s", username)
+	log.Printf("Reports on review %d resolved by %s: %s", reviewid, moderator, action)
 
-	// Return id of new review
-	return reviewid, nil
+	return nil
 }
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+)
+
+// GetRoles get every role with its permissions
+func (db *DB) GetRoles() (Roles, error) {
+
+	// Query statement
+	stmt := `SELECT r.name, r.invitequota, r.inviteperiod, p.permission FROM roles r 
+		LEFT JOIN role_permissions p ON p.role = r.name ORDER BY r.name, p.permission`
+
+	// Execute query
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Empty role collection
+	roles := Roles{}
+
+	// Get all the roles, one row per permission
+	for rows.Next() {
+		r := &Role{}
+		var permission sql.NullString
+
+		// Pull data into role
+		err := rows.Scan(&r.Name, &r.InviteQuota, &r.InvitePeriod, &permission)
+		if err != nil {
+			return nil, err
+		}
+
+		// Start a new role when the name changes
+		if len(roles) == 0 || roles[len(roles)-1].Name != r.Name {
+			roles = append(roles, r)
+		}
+		if permission.Valid {
+			role := roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, permission.String)
+		}
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetRole get a single role with its permissions
+func (db *DB) GetRole(name string) (*Role, error) {
+
+	role := &Role{Name: name}
+
+	// Unknown roles have no quota
+	stmt := `SELECT invitequota, inviteperiod FROM roles WHERE name = $1`
+	err := db.QueryRow(stmt, name).Scan(&role.InviteQuota, &role.InvitePeriod)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Query statement
+	stmt = `SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission`
+
+	// Execute query
+	rows, err := db.Query(stmt, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the permissions
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		role.Permissions = append(role.Permissions, permission)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+// RoleExists check if a role has been created
+func (db *DB) RoleExists(name string) (bool, error) {
+
+	var exists bool
+
+	stmt := `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`
+
+	err := db.QueryRow(stmt, name).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// InsertRole create a new role with no permissions
+func (db *DB) InsertRole(name string) error {
+
+	stmt := `INSERT INTO roles (name, invitequota, inviteperiod, created) VALUES ($1, 0, 30, timezone('utc', now()))`
+
+	_, err := db.Exec(stmt, name)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("New role %s created", name)
+
+	return nil
+}
+
+// SetRolePermissions replace the permissions of a role
+func (db *DB) SetRolePermissions(name string, permissions []string) error {
+
+	// Swap permissions in one go
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM role_permissions WHERE role = $1`, name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, permission := range permissions {
+		_, err = tx.Exec(`INSERT INTO role_permissions (role, permission) VALUES ($1, $2)`, name, permission)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Permissions of role %s updated", name)
+
+	return nil
+}
+
+// SetRoleInviteQuota set how many invites a role may create per period of days
+func (db *DB) SetRoleInviteQuota(name string, quota, period int) error {
+
+	stmt := `UPDATE roles SET invitequota = $1, inviteperiod = $2 WHERE name = $3`
+
+	_, err := db.Exec(stmt, quota, period, name)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Invite quota of role %s set to %d per %d days", name, quota, period)
+
+	return nil
+}
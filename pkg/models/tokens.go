@@ -0,0 +1,172 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// InsertRefreshToken store the hash of a new refresh token, starting a family named after it
+func (db *DB) InsertRefreshToken(username, tokenHash string, expires time.Time) error {
+
+	// Empty new token id
+	var id int
+
+	stmt := `INSERT INTO refresh_tokens (username, tokenhash, family, expires, revoked, created) 
+		VALUES ($1, $2, $2, $3, FALSE, timezone('utc', now())) RETURNING id`
+
+	// Create
+	err := db.QueryRow(stmt, username, tokenHash, expires).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetRefreshToken retrive a refresh token by its hash
+func (db *DB) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+
+	// Query statement
+	stmt := `SELECT id, username, tokenhash, family, expires, revoked, replacedby, created FROM refresh_tokens WHERE tokenhash = $1`
+
+	// Execute query
+	row := db.QueryRow(stmt, tokenHash)
+	t := &RefreshToken{}
+
+	// Pull data into token
+	err := row.Scan(&t.ID, &t.Username, &t.TokenHash, &t.Family, &t.Expires, &t.Revoked, &t.ReplacedBy, &t.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// RotateRefreshToken swap a refresh token for a new one in a single transaction. The presented token is
+// locked so concurrent refreshes queue behind each other and only the first can rotate it.
+// Returns the token as stored before the swap, nil if there is no such token, and whether it was rotated.
+func (db *DB) RotateRefreshToken(tokenHash, nextHash string, expires time.Time) (*RefreshToken, bool, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Lock the presented token
+	stmt := `SELECT id, username, tokenhash, family, expires, revoked, replacedby, created FROM refresh_tokens
+		WHERE tokenhash = $1 FOR UPDATE`
+
+	t := &RefreshToken{}
+	err = tx.QueryRow(stmt, tokenHash).Scan(&t.ID, &t.Username, &t.TokenHash, &t.Family, &t.Expires, &t.Revoked, &t.ReplacedBy, &t.Created)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, false, nil
+	} else if err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+
+	// Only a live token can be rotated
+	if t.Revoked || t.Expires.Before(time.Now().UTC()) {
+		tx.Rollback()
+		return t, false, nil
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET revoked = TRUE, replacedby = $2 WHERE id = $1`, t.ID, nextHash)
+	if err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+
+	// The replacement stays in the family of the token it replaces
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (username, tokenhash, family, expires, revoked, created)
+		VALUES ($1, $2, $3, $4, FALSE, timezone('utc', now()))`, t.Username, nextHash, t.Family, expires)
+	if err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return t, true, nil
+}
+
+// RevokeRefreshToken revoke a single refresh token
+func (db *DB) RevokeRefreshToken(tokenHash string) error {
+
+	// Query statement
+	stmt := `UPDATE refresh_tokens SET revoked = TRUE WHERE tokenhash = $1`
+
+	_, err := db.Exec(stmt, tokenHash)
+	return err
+}
+
+// RevokeRefreshFamily revoke every refresh token descended from the same login
+func (db *DB) RevokeRefreshFamily(family string) error {
+
+	// Query statement
+	stmt := `UPDATE refresh_tokens SET revoked = TRUE WHERE family = $1 AND revoked = FALSE`
+
+	_, err := db.Exec(stmt, family)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Revoked refresh token family %.8s", family)
+
+	return nil
+}
+
+// RevokeJWT add a jwt id to the denylist until it would have expired
+func (db *DB) RevokeJWT(jti string, expires time.Time) error {
+
+	// Query statement
+	stmt := `INSERT INTO revoked_tokens (jti, expires, created) VALUES ($1, $2, timezone('utc', now()))
+		ON CONFLICT (jti) DO NOTHING`
+
+	_, err := db.Exec(stmt, jti, expires)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Revoked token %s", jti)
+
+	return nil
+}
+
+// JWTRevoked check if a jwt id is on the denylist
+func (db *DB) JWTRevoked(jti string) (bool, error) {
+
+	var id string
+
+	// Query statement
+	stmt := `SELECT jti FROM revoked_tokens WHERE jti = $1`
+
+	err := db.QueryRow(stmt, jti).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// PruneRevokedTokens clear out expired refresh tokens and denylist entries
+func (db *DB) PruneRevokedTokens() error {
+
+	// Denylisted tokens are only needed until they would have expired
+	_, err := db.Exec(`DELETE FROM revoked_tokens WHERE expires < timezone('utc', now())`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM refresh_tokens WHERE expires < timezone('utc', now())`)
+	return err
+}
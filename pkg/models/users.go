@@ -3,12 +3,27 @@ package models
 import (
 	"database/sql"
 	"log"
+	"time"
 
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/guregu/null.v4"
 )
 
-// InsertUser create a new user
-func (db *DB) InsertUser(name, email, password string) error {
+// InsertUser create a new user, claiming their invite in the same transaction.
+// An empty invite code skips the claim, false is returned if the invite could not be claimed.
+func (db *DB) InsertUser(name, email, password, inviteCode string) (bool, error) {
+	return db.insertUser(name, email, password, inviteCode, "reader", false, "", "")
+}
+
+// InsertIdentityUser create a user linked to an external identity, with its role and whether the
+// provider verified its email, in one transaction so a failure never leaves an unlinked user behind
+func (db *DB) InsertIdentityUser(name, email, password, inviteCode, role string, verified bool, issuer, subject string) (bool, error) {
+	return db.insertUser(name, email, password, inviteCode, role, verified, issuer, subject)
+}
+
+// insertUser create a user, claiming an invite and linking an identity when given
+func (db *DB) insertUser(name, email, password, inviteCode, role string, verified bool, issuer, subject string) (bool, error) {
 
 	// Empty new user id
 	var userid int
@@ -16,20 +31,55 @@ func (db *DB) InsertUser(name, email, password string) error {
 	// Hash and salt password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	// Claim the invite first so two signups can't share it
+	if inviteCode != "" {
+		claimed, err := fillInvite(tx, name, inviteCode)
+		if err != nil || !claimed {
+			tx.Rollback()
+			return false, err
+		}
 	}
 
-	stmt := `INSERT INTO users (username, email, password, role, created) VALUES($1, $2, $3, 'reader', timezone('utc', now())) RETURNING id`
+	stmt := `INSERT INTO users (username, email, password, role, displayname, bio, avatar, emailverified, preferredformat, created) 
+		VALUES($1, $2, $3, $4, '', '', '', $5, '', timezone('utc', now())) RETURNING id`
 
 	// Create
-	err = db.QueryRow(stmt, name, email, hashedPassword).Scan(&userid)
+	err = tx.QueryRow(stmt, name, email, hashedPassword, role, verified).Scan(&userid)
 	if err != nil {
-		return err
+		tx.Rollback()
+		return false, err
+	}
+
+	// Link the external identity
+	if issuer != "" {
+		stmt = `INSERT INTO user_identities (username, issuer, subject, created) VALUES ($1, $2, $3, timezone('utc', now()))`
+
+		_, err = tx.Exec(stmt, name, issuer, subject)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
 	}
 
 	log.Printf("User %s registered!", name)
+	if issuer != "" {
+		log.Printf("Linked %s to identity %s at %s", name, subject, issuer)
+	}
 
-	return nil
+	return true, nil
 }
 
 // AuthenticateUser checks the valitity of a login
@@ -39,16 +89,23 @@ func (db *DB) AuthenticateUser(username, password string) (*User, error) {
 	u := &User{}
 
 	// Get id and password hash for given username
-	row := db.QueryRow("SELECT id, username, password, role FROM users WHERE username = $1", username)
+	row := db.QueryRow(`SELECT id, username, email, password, role, displayname, bio, avatar, emailverified, preferredformat, created 
+		FROM users WHERE username = $1`, username)
 
 	// Pull in password for comparesson
-	err := row.Scan(&u.ID, &u.Username, &u.HashedPassword, &u.Role)
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.HashedPassword, &u.Role, &u.DisplayName, &u.Bio, &u.Avatar,
+		&u.EmailVerified, &u.PreferredFormat, &u.Created)
 	if err == sql.ErrNoRows {
 		return &User{}, nil
 	} else if err != nil {
 		return &User{}, err
 	}
 
+	// Placeholders of deleted users have no password
+	if len(u.HashedPassword) == 0 {
+		return &User{}, nil
+	}
+
 	// Check whether the hashed password and plain-text password provided match
 	err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(password))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
@@ -70,10 +127,12 @@ func (db *DB) GetUser(username string) (*User, error) {
 	u := &User{}
 
 	// Get attributes of user
-	row := db.QueryRow("SELECT id, username, role, created FROM users WHERE username = $1", username)
+	row := db.QueryRow(`SELECT id, username, email, role, displayname, bio, avatar, emailverified, preferredformat, created 
+		FROM users WHERE username = $1`, username)
 
 	// Grab user
-	err := row.Scan(&u.ID, &u.Username, &u.Role, &u.Created)
+	err := row.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.DisplayName, &u.Bio, &u.Avatar,
+		&u.EmailVerified, &u.PreferredFormat, &u.Created)
 	if err == sql.ErrNoRows {
 		return &User{}, nil
 	} else if err != nil {
@@ -92,7 +151,7 @@ func (db *DB) GetUsers() (Users, error) {
 	users := Users{}
 
 	// Get attributes of user
-	rows, err := db.Query("SELECT username, role FROM users")
+	rows, err := db.Query("SELECT username, role, created FROM users ORDER BY username")
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +162,7 @@ func (db *DB) GetUsers() (Users, error) {
 		u := &User{}
 
 		// Pull data into request
-		err := rows.Scan(&u.Username, &u.Role)
+		err := rows.Scan(&u.Username, &u.Role, &u.Created)
 		if err != nil {
 			return nil, err
 		}
@@ -127,7 +186,7 @@ func (db *DB) GetInvites(creator string) (Invites, error) {
 	invites := Invites{}
 
 	// Query statement
-	stmt := `SELECT id, code, username, creator, status, created FROM invites WHERE creator = $1 ORDER BY created DESC`
+	stmt := `SELECT id, code, username, creator, status, email, expires, revoked, created FROM invites WHERE creator = $1 ORDER BY created DESC`
 
 	// Execute query
 	rows, err := db.Query(stmt, creator)
@@ -141,7 +200,7 @@ func (db *DB) GetInvites(creator string) (Invites, error) {
 		i := &Invite{}
 
 		// Pull data into request
-		err := rows.Scan(&i.ID, &i.Code, &i.Username, &i.Creator, &i.Activated, &i.Created)
+		err := rows.Scan(&i.ID, &i.Code, &i.Username, &i.Creator, &i.Activated, &i.Email, &i.Expires, &i.Revoked, &i.Created)
 		if err != nil {
 			return nil, err
 		}
@@ -158,35 +217,98 @@ func (db *DB) GetInvites(creator string) (Invites, error) {
 	return invites, nil
 }
 
-// ValidateInvite check the valitity of an invite code
+// GetAcceptedInvites get every invite that was used to sign up
+func (db *DB) GetAcceptedInvites() (Invites, error) {
+
+	// Empty invite collection
+	invites := Invites{}
+
+	// Query statement
+	stmt := `SELECT id, code, username, creator, status, email, expires, revoked, created FROM invites WHERE status = TRUE ORDER BY created ASC`
+
+	// Execute query
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the matching invites
+	for rows.Next() {
+		i := &Invite{}
+
+		// Pull data into invite
+		err := rows.Scan(&i.ID, &i.Code, &i.Username, &i.Creator, &i.Activated, &i.Email, &i.Expires, &i.Revoked, &i.Created)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add invite to collection
+		invites = append(invites, i)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invites, nil
+}
+
+// ValidateInvite check if an invite code can be used to sign up
 func (db *DB) ValidateInvite(inviteCode string) (bool, error) {
 
-	// Used or not
-	var status bool
+	// Used, revoked and expiry state
+	var used, revoked bool
+	var expires null.Time
 
-	// Get id and password hash for given username
-	row := db.QueryRow("SELECT status FROM invites WHERE code = $1", inviteCode)
+	// Get state of the invite
+	row := db.QueryRow("SELECT status, revoked, expires FROM invites WHERE code = $1", inviteCode)
 
-	err := row.Scan(&status)
+	err := row.Scan(&used, &revoked, &expires)
 	if err == sql.ErrNoRows {
-		return true, nil
+		return false, nil
 	} else if err != nil {
-		return true, nil
+		return false, err
+	}
+
+	// Invite must be unused, unrevoked and unexpired
+	if used || revoked {
+		return false, nil
+	}
+	if expires.Valid && expires.Time.Before(time.Now().UTC()) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// CountInvitesSince count the invites a user created after a point in time
+func (db *DB) CountInvitesSince(creator string, since time.Time) (int, error) {
+
+	var count int
+
+	stmt := `SELECT COUNT(*) FROM invites WHERE creator = $1 AND created > $2`
+
+	err := db.QueryRow(stmt, creator, since).Scan(&count)
+	if err != nil {
+		return 0, err
 	}
 
-	return status, nil
+	return count, nil
 }
 
 // CreateInvite add a new invite
-func (db *DB) CreateInvite(creator, code string) error {
+func (db *DB) CreateInvite(creator, code string, email null.String, expires null.Time) error {
 
 	// Empty invite id
 	var id int
 
-	stmt := `INSERT INTO invites (code, creator, status, created) VALUES($1, $2, FALSE, timezone('utc', now())) RETURNING id`
+	stmt := `INSERT INTO invites (code, creator, status, email, expires, revoked, created) 
+		VALUES($1, $2, FALSE, $3, $4, FALSE, timezone('utc', now())) RETURNING id`
 
 	// Add invite
-	err := db.QueryRow(stmt, code, creator).Scan(&id)
+	err := db.QueryRow(stmt, code, creator, email, expires).Scan(&id)
 	if err == sql.ErrNoRows {
 		return err
 	} else if err != nil {
@@ -196,20 +318,202 @@ func (db *DB) CreateInvite(creator, code string) error {
 	return nil
 }
 
-// FillInvite use an invite, invalidate for future use
-func (db *DB) FillInvite(username, code string) error {
+// RevokeInvite revoke one of a users unused invites
+func (db *DB) RevokeInvite(code, creator string) error {
+
+	stmt := `UPDATE invites SET revoked = TRUE WHERE code = $1 AND creator = $2 AND status = FALSE`
+
+	_, err := db.Exec(stmt, code, creator)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Invite %s revoked by %s", code, creator)
+
+	return nil
+}
+
+// RevokeInvitesBy revoke every unused invite created by a group of users
+func (db *DB) RevokeInvitesBy(creators []string) (int64, error) {
+
+	stmt := `UPDATE invites SET revoked = TRUE WHERE creator = ANY($1) AND status = FALSE AND revoked = FALSE`
+
+	res, err := db.Exec(stmt, pq.Array(creators))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// fillInvite use an invite, invalidate for future use. False if the invite was already used, revoked or expired
+func fillInvite(tx *sql.Tx, username, code string) (bool, error) {
 
 	// The empty used invite
 	var id int
 
-	stmt := `UPDATE invites SET username = $1, activated = timezone('utc', now()), status = TRUE WHERE code = $2 RETURNING id`
+	stmt := `UPDATE invites SET username = $1, activated = timezone('utc', now()), status = TRUE 
+		WHERE code = $2 AND status = FALSE AND revoked = FALSE 
+		AND (expires IS NULL OR expires > timezone('utc', now())) RETURNING id`
 
-	err := db.QueryRow(stmt, username, code).Scan(&id)
+	err := tx.QueryRow(stmt, username, code).Scan(&id)
 	if err == sql.ErrNoRows {
-		return nil
+		return false, nil
 	} else if err != nil {
-		return nil
+		return false, err
 	}
 
+	return true, nil
+}
+
+// GetUserByIdentity retrive the user linked to an external identity
+func (db *DB) GetUserByIdentity(issuer, subject string) (*User, error) {
+
+	// Empty user
+	u := &User{}
+
+	// Get attributes of linked user
+	stmt := `SELECT u.id, u.username, u.email, u.role, u.displayname, u.bio, u.avatar, u.emailverified, u.preferredformat, u.created 
+		FROM users u INNER JOIN user_identities i ON i.username = u.username AND i.issuer = $1 AND i.subject = $2`
+
+	// Grab user
+	err := db.QueryRow(stmt, issuer, subject).Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.DisplayName, &u.Bio, &u.Avatar,
+		&u.EmailVerified, &u.PreferredFormat, &u.Created)
+	if err == sql.ErrNoRows {
+		return &User{}, nil
+	} else if err != nil {
+		return &User{}, err
+	}
+
+	return u, nil
+}
+
+// HasIdentity check if a user signs in through an external identity
+func (db *DB) HasIdentity(username string) (bool, error) {
+
+	var linked bool
+
+	stmt := `SELECT EXISTS (SELECT 1 FROM user_identities WHERE username = $1)`
+
+	err := db.QueryRow(stmt, username).Scan(&linked)
+	if err != nil {
+		return false, err
+	}
+
+	return linked, nil
+}
+
+// SetUserRole change the role of a user, false if there is no such user
+func (db *DB) SetUserRole(username, role string) (bool, error) {
+
+	// Placeholders of deleted users keep their role
+	stmt := `UPDATE users SET role = $1 WHERE username = $2 AND role != 'deleted'`
+
+	res, err := db.Exec(stmt, role, username)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil || updated == 0 {
+		return false, err
+	}
+
+	log.Printf("User %s is now a %s", username, role)
+
+	return true, nil
+}
+
+// UpdateProfile change the editable profile of a user
+func (db *DB) UpdateProfile(username, displayName, bio, preferredFormat string) error {
+
+	stmt := `UPDATE users SET displayname = $1, bio = $2, preferredformat = $3 WHERE username = $4`
+
+	_, err := db.Exec(stmt, displayName, bio, preferredFormat, username)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("User %s updated their profile", username)
+
 	return nil
 }
+
+// SetAvatar record the storage key of a users avatar
+func (db *DB) SetAvatar(username, key string) error {
+
+	stmt := `UPDATE users SET avatar = $1 WHERE username = $2`
+
+	_, err := db.Exec(stmt, key, username)
+	return err
+}
+
+// InsertEmailVerification store the hash of an email confirmation token
+func (db *DB) InsertEmailVerification(username, email, tokenHash string, expires time.Time) error {
+
+	stmt := `INSERT INTO email_verifications (username, email, tokenhash, expires, created) 
+		VALUES ($1, $2, $3, $4, timezone('utc', now()))`
+
+	_, err := db.Exec(stmt, username, email, tokenHash, expires)
+	return err
+}
+
+// ConfirmEmail use a confirmation token to set and verify a users email
+func (db *DB) ConfirmEmail(tokenHash string) (string, error) {
+
+	var username, email string
+	var expires time.Time
+
+	// Confirm in one go
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	stmt := `SELECT username, email, expires FROM email_verifications WHERE tokenhash = $1`
+	err = tx.QueryRow(stmt, tokenHash).Scan(&username, &email, &expires)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return "", nil
+	} else if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	// Expired tokens are ignored
+	if expires.Before(time.Now().UTC()) {
+		tx.Rollback()
+		return "", nil
+	}
+
+	_, err = tx.Exec(`UPDATE users SET email = $1, emailverified = TRUE WHERE username = $2`, email, username)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	// Any other outstanding tokens are now stale
+	_, err = tx.Exec(`DELETE FROM email_verifications WHERE username = $1`, username)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("User %s confirmed their email", username)
+
+	return username, nil
+}
+
+// MarkEmailVerified trust the current email of a user
+func (db *DB) MarkEmailVerified(username string) error {
+
+	stmt := `UPDATE users SET emailverified = TRUE WHERE username = $1`
+
+	_, err := db.Exec(stmt, username)
+	return err
+}
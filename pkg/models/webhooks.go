@@ -0,0 +1,296 @@
+package models
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/guregu/null.v4"
+)
+
+// webhookColumns the columns of a webhook in the order scanWebhook reads them
+const webhookColumns = `id, url, secret, events, active, createdby, created`
+
+// scanWebhook read a row selected with webhookColumns
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	h := &Webhook{}
+	err := row.Scan(&h.ID, &h.URL, &h.Secret, pq.Array(&h.Events), &h.Active, &h.CreatedBy, &h.Created)
+	return h, err
+}
+
+// InsertWebhook add a webhook for the events given
+func (db *DB) InsertWebhook(url, secret string, events []string, createdby string) (int, error) {
+
+	// Query statement
+	stmt := `INSERT INTO webhooks (url, secret, events, active, createdby, created)
+		VALUES ($1, $2, $3, TRUE, $4, timezone('utc', now())) RETURNING id`
+
+	var id int
+	err := db.QueryRow(stmt, url, secret, pq.Array(events), createdby).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Webhook %d to %s added by %s", id, url, createdby)
+
+	return id, nil
+}
+
+// GetWebhook get a webhook by id, nil if there isn't one
+func (db *DB) GetWebhook(id int) (*Webhook, error) {
+
+	// Query statement
+	stmt := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = $1`
+
+	h, err := scanWebhook(db.QueryRow(stmt, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// GetWebhooks get every webhook
+func (db *DB) GetWebhooks() ([]*Webhook, error) {
+
+	// Query statement
+	stmt := `SELECT ` + webhookColumns + ` FROM webhooks ORDER BY id`
+
+	// Execute query
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the webhooks
+	hooks := []*Webhook{}
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// UpdateWebhook change where a webhook points, what it listens for and if it is on,
+// turning it off gives up on anything still waiting to be delivered
+func (db *DB) UpdateWebhook(id int, url string, events []string, active bool) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Query statement
+	stmt := `UPDATE webhooks SET url = $2, events = $3, active = $4 WHERE id = $1`
+
+	_, err = tx.Exec(stmt, id, url, pq.Array(events), active)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if !active {
+		stmt = `UPDATE webhook_deliveries SET status = 'failed', error = 'webhook turned off', nextattempt = NULL
+			WHERE webhookid = $1 AND status IN ('pending', 'sending')`
+		_, err = tx.Exec(stmt, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Webhook %d updated", id)
+
+	return nil
+}
+
+// DeleteWebhook remove a webhook and its deliveries
+func (db *DB) DeleteWebhook(id int) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE webhookid = $1`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Webhook %d deleted", id)
+
+	return nil
+}
+
+// QueueDeliveries queue an event for every active webhook listening for it, returning how many
+func (db *DB) QueueDeliveries(event, payload string) (int, error) {
+
+	// Query statement
+	stmt := `INSERT INTO webhook_deliveries (webhookid, event, payload, status, attempts, error, nextattempt, created)
+		SELECT id, $1, $2, 'pending', 0, '', timezone('utc', now()), timezone('utc', now())
+		FROM webhooks WHERE active = TRUE AND $1 = ANY(events)`
+
+	res, err := db.Exec(stmt, event, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(count), nil
+}
+
+// deliveryColumns the columns of a delivery, webhook_deliveries d joined to webhooks h
+const deliveryColumns = `d.id, d.webhookid, h.url, h.secret, d.event, d.payload, d.status, d.attempts,
+	d.responsecode, d.error, d.nextattempt, d.delivered, d.created`
+
+// scanDelivery read a row selected with deliveryColumns
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	err := row.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.ResponseCode, &d.Error, &d.NextAttempt, &d.Delivered, &d.Created)
+	return d, err
+}
+
+// queryDeliveries run a delivery query and collect the results
+func (db *DB) queryDeliveries(stmt string, args ...interface{}) ([]*WebhookDelivery, error) {
+
+	// Execute query
+	rows, err := db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Get all the deliveries
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	// Catch sql errors
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// DueDeliveries claim pending deliveries to active webhooks whose next attempt has come, oldest first.
+// Claimed deliveries are marked sending until the lease runs out so other instances leave them be,
+// a delivery whose attempt is never recorded is picked up again after that.
+func (db *DB) DueDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	return db.queryDeliveries(`UPDATE webhook_deliveries d SET status = 'sending', nextattempt = $2
+		FROM webhooks h WHERE h.id = d.webhookid AND d.id IN (
+			SELECT d.id FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhookid
+			WHERE d.status IN ('pending', 'sending') AND h.active AND d.nextattempt <= timezone('utc', now())
+			ORDER BY d.nextattempt LIMIT $1 FOR UPDATE OF d SKIP LOCKED)
+		RETURNING `+deliveryColumns, limit, time.Now().UTC().Add(lease))
+}
+
+// GetDeliveries the latest deliveries to a webhook, newest first
+func (db *DB) GetDeliveries(webhookid, limit int) ([]*WebhookDelivery, error) {
+	return db.queryDeliveries(`SELECT `+deliveryColumns+` FROM webhook_deliveries d
+		JOIN webhooks h ON h.id = d.webhookid
+		WHERE d.webhookid = $1 ORDER BY d.created DESC, d.id DESC LIMIT $2`, webhookid, limit)
+}
+
+// GetDelivery get a delivery by id, nil if there isn't one
+func (db *DB) GetDelivery(id int) (*WebhookDelivery, error) {
+
+	deliveries, err := db.queryDeliveries(`SELECT `+deliveryColumns+` FROM webhook_deliveries d
+		JOIN webhooks h ON h.id = d.webhookid WHERE d.id = $1`, id)
+	if err != nil || len(deliveries) == 0 {
+		return nil, err
+	}
+
+	return deliveries[0], nil
+}
+
+// RecordAttempt save how an attempt at a delivery went, next is when to try again when it is still pending
+func (db *DB) RecordAttempt(id int, status string, code null.Int, errText string, next null.Time) error {
+
+	// Query statement
+	stmt := `UPDATE webhook_deliveries SET attempts = attempts + 1, status = $2, responsecode = $3, error = $4, nextattempt = $5,
+		delivered = CASE WHEN $2 = 'succeeded' THEN timezone('utc', now()) ELSE delivered END
+		WHERE id = $1`
+
+	_, err := db.Exec(stmt, id, status, code, errText, next)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Redeliver queue a delivery again as a new one with the same payload, 0 if its webhook is off
+func (db *DB) Redeliver(id int) (int, error) {
+
+	// Query statement
+	stmt := `INSERT INTO webhook_deliveries (webhookid, event, payload, status, attempts, error, nextattempt, created)
+		SELECT webhookid, event, payload, 'pending', 0, '', timezone('utc', now()), timezone('utc', now())
+		FROM webhook_deliveries WHERE id = $1 AND webhookid IN (SELECT id FROM webhooks WHERE active) RETURNING id`
+
+	var newid int
+	err := db.QueryRow(stmt, id).Scan(&newid)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Delivery %d queued again as %d", id, newid)
+
+	return newid, nil
+}
+
+// PruneDeliveries forget deliveries that finished before a time
+func (db *DB) PruneDeliveries(before time.Time) error {
+
+	// Query statement
+	stmt := `DELETE FROM webhook_deliveries WHERE status IN ('succeeded', 'failed') AND created < $1`
+
+	_, err := db.Exec(stmt, before)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}